@@ -0,0 +1,8 @@
+package assets
+
+import "embed"
+
+// FS holds the static files served by the router, compiled into the binary.
+//
+//go:embed favicon.ico icon.png manifest.json sw.js font javascript stylesheets
+var FS embed.FS
@@ -0,0 +1,184 @@
+// Live admin dashboard. The server pushes a snapshot over the socket every
+// couple of seconds, moderation goes through the admin API.
+
+function connectDashboard() {
+	let state = document.getElementById('server-state')
+	let proto = location.protocol === 'https:' ? 'wss://' : 'ws://'
+	let ws = new WebSocket(proto + location.host + DashboardWebsocketPath)
+
+	ws.onopen = function () {
+		state.className = 'tag is-success'
+		state.innerText = 'live'
+	}
+
+	ws.onclose = function () {
+		state.className = 'tag is-danger'
+		state.innerText = 'disconnected'
+		setTimeout(connectDashboard, 2000)
+	}
+
+	ws.onmessage = function (evt) {
+		let snapshot = JSON.parse(evt.data)
+		if (!snapshot) {
+			return console.log('failed to parse snapshot')
+		}
+
+		showServer(snapshot.server)
+		if (document.getElementById('rooms')) {
+			showRooms(snapshot.rooms || [])
+		}
+		if (document.getElementById('participants')) {
+			showRoom(snapshot.room, snapshot.error)
+		}
+	}
+}
+
+function showServer(server) {
+	let values = {
+		uptime: server.uptime,
+		rooms: server.rooms,
+		participants: server.participants,
+		viewers: server.viewers,
+		chatClients: server.chatClients,
+		goroutines: server.goroutines,
+		memory: server.heapMb.toFixed(1) + ' / ' + server.sysMb.toFixed(1)
+	}
+	document.querySelectorAll('[data-stat]').forEach(el => {
+		el.innerText = values[el.dataset.stat]
+	})
+	if (server.draining) {
+		let state = document.getElementById('server-state')
+		state.className = 'tag is-warning'
+		state.innerText = 'draining'
+	}
+}
+
+function showRooms(rooms) {
+	let body = document.getElementById('rooms')
+	body.replaceChildren()
+	if (rooms.length === 0) {
+		body.appendChild(row([cell('No rooms', 'has-text-grey', 6)]))
+		return
+	}
+	rooms.forEach(room => {
+		let link = document.createElement('a')
+		link.href = '/admin/rooms/' + encodeURIComponent(room.id)
+		link.innerText = room.id
+		let first = cell('')
+		first.appendChild(link)
+		body.appendChild(row([
+			first,
+			cell(room.participants),
+			cell(room.viewers),
+			cell(room.tracks),
+			cell(room.chatClients),
+			cell(room.uptime)
+		]))
+	})
+}
+
+function showRoom(room, error) {
+	let notice = document.getElementById('room-error')
+	if (error) {
+		notice.innerText = 'The room is gone: ' + error
+		notice.style.display = 'block'
+		document.getElementById('participants').replaceChildren()
+		document.getElementById('tracks').replaceChildren()
+		return
+	}
+	notice.style.display = 'none'
+	document.querySelector('[data-room="uptime"]').innerText = 'up ' + room.uptime
+
+	let quality = {}
+	;(room.quality || []).forEach(q => { quality[q.participant] = q })
+
+	let participants = document.getElementById('participants')
+	participants.replaceChildren()
+	room.peers.forEach(peer => {
+		let q = quality[peer.id] || { score: 'unknown', rttMs: 0, lossPercent: 0, jitterMs: 0, bitrateKbps: 0 }
+		let badge = cell('')
+		let tag = document.createElement('span')
+		tag.className = 'tag ' + (qualityClasses[q.score] || qualityClasses.unknown)
+		tag.innerText = q.score
+		badge.appendChild(tag)
+
+		let actions = cell('')
+		let kick = document.createElement('button')
+		kick.className = 'button is-small is-danger is-outlined'
+		kick.innerText = 'Kick'
+		kick.onclick = () => kickParticipant(room.id, peer.id)
+		actions.appendChild(kick)
+
+		participants.appendChild(row([
+			cell(peer.name ? peer.name + ' (' + peer.id + ')' : peer.id),
+			cell(peer.viewer ? 'viewer' : 'participant'),
+			cell(peer.connectionState),
+			cell(peer.iceState),
+			badge,
+			cell(Math.round(q.rttMs) + ' ms / ' + q.lossPercent.toFixed(1) + ' % / ' + Math.round(q.jitterMs) + ' ms'),
+			cell(Math.round(q.bitrateKbps)),
+			actions
+		]))
+	})
+
+	let tracks = document.getElementById('tracks')
+	tracks.replaceChildren()
+	room.tracks.forEach(track => {
+		tracks.appendChild(row([cell(track.id), cell(track.streamId), cell(track.kind)]))
+	})
+}
+
+function row(cells) {
+	let tr = document.createElement('tr')
+	cells.forEach(c => tr.appendChild(c))
+	return tr
+}
+
+function cell(text, className, colSpan) {
+	let td = document.createElement('td')
+	td.innerText = text
+	if (className) {
+		td.className = className
+	}
+	if (colSpan) {
+		td.colSpan = colSpan
+	}
+	return td
+}
+
+function adminRequest(method, path, body) {
+	let options = { method: method, headers: {} }
+	if (body) {
+		options.headers['Content-Type'] = 'application/json'
+		options.body = JSON.stringify(body)
+	}
+	return fetch(path, options).then(resp => {
+		if (!resp.ok) {
+			return resp.text().then(text => { throw new Error(text || resp.statusText) })
+		}
+	}).catch(err => alert(err.message))
+}
+
+function kickParticipant(roomId, participant) {
+	if (confirm('Kick ' + participant + '?')) {
+		adminRequest('DELETE', '/api/rooms/' + encodeURIComponent(roomId) + '/participants/' + encodeURIComponent(participant))
+	}
+}
+
+function closeRoom(roomId) {
+	if (confirm('End the call for everyone in this room?')) {
+		adminRequest('DELETE', '/api/rooms/' + encodeURIComponent(roomId))
+	}
+}
+
+function broadcastMessage(roomId) {
+	let input = document.getElementById('broadcast')
+	let message = input.value.trim()
+	if (!message) {
+		return
+	}
+	adminRequest('POST', '/api/rooms/' + encodeURIComponent(roomId) + '/messages', { message: message })
+		.then(() => { input.value = '' })
+}
+
+connectDashboard()
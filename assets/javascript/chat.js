@@ -2,6 +2,55 @@ var msg = document.getElementById("msg");
 var log = document.getElementById("log");
 
 var slideOpen = false;
+var chatWs = null;
+// lastMessageId is the newest message shown and seen drops messages
+// replayed twice. chatCursor is the newest message ID or revision seen,
+// so a reconnect only replays the messages and changes we missed.
+var lastMessageId = null;
+var chatCursor = null;
+var seen = new Set();
+// chatModerator is set when the server tells us we moderate the chat.
+var chatModerator = false;
+// names remembers the display names of senders for moderation notices,
+// authors those of author keys for reactions.
+var names = {};
+var authors = {};
+// chatSelf is the ID our messages are sent under and chatAuthor our
+// author key, which stays the same across reconnects; both are told by
+// the server.
+var chatSelf = null;
+var chatAuthor = null;
+// chatTo is the participant the next messages go to privately, if any.
+var chatTo = null;
+var chatToName = null;
+// chatParent is the message the next message replies to in a thread, and
+// chatEditing our message being edited, if any.
+var chatParent = null;
+var chatEditing = null;
+// editWindow is how long the server lets us edit our messages.
+var editWindow = 15 * 60 * 1000;
+// readUpTo is the last message we read, as the server remembers it across
+// reconnects; unread holds the messages of others we were shown.
+var readUpTo = '';
+var unread = new Set();
+// typists maps who is typing to their name and the timer hiding them.
+var typists = {};
+// typingSent is when we last told the others we are typing.
+var typingSent = 0;
+var typingTimer = null;
+// typingInterval and typingTimeout mirror the server's TypingInterval and
+// TypingTimeout.
+var typingInterval = 3000;
+var typingTimeout = 6000;
+var quickReactions = ['\u{1F44D}', '\u2764\uFE0F', '\u{1F602}', '\u{1F389}', '\u{1F62E}', '\u{1F622}'];
+// chatRetry is how long to wait before reconnecting, longer after the
+// server disconnected us for spam.
+var chatRetry = 1000;
+
+// Files can be shared where the page got an upload address.
+if (typeof UploadAddr !== 'undefined' && UploadAddr) {
+    document.getElementById('chat-attach').style.display = 'block';
+}
 
 function slideToggle() {
     var chat = document.getElementById('chat-content');
@@ -10,9 +59,110 @@ function slideToggle() {
         slideOpen = false;
     } else {
         chat.style.display = 'block'
-        document.getElementById('chat-alert').style.display = 'none';
         document.getElementById('msg').focus();
         slideOpen = true
+        markRead();
+    }
+    showUnread();
+}
+
+// showUnread counts the messages of others after our read marker on the
+// chat alert.
+function showUnread() {
+    var count = 0;
+    unread.forEach(function (id) {
+        if (id > readUpTo) {
+            count++;
+        }
+    });
+    var alert = document.getElementById('chat-alert');
+    alert.innerText = count > 99 ? '99+' : String(count);
+    alert.style.display = count > 0 && !slideOpen ? 'block' : 'none';
+}
+
+// markRead moves our read marker to the newest message while the chat is
+// open.
+function markRead() {
+    if (slideOpen && lastMessageId && lastMessageId > readUpTo) {
+        readUpTo = lastMessageId;
+        sendChat({
+            type: 'read',
+            data: lastMessageId
+        });
+    }
+}
+
+// setRead takes our read marker from reads, which maps author keys to
+// markers.
+function setRead(reads) {
+    Object.keys(reads).forEach(function (author) {
+        if (author === chatAuthor && reads[author] > readUpTo) {
+            readUpTo = reads[author];
+        }
+    });
+    showUnread();
+}
+
+function showTypists() {
+    var names = Object.keys(typists).map(function (id) {
+        return typists[id].name;
+    });
+    var text = '';
+    if (names.length === 1) {
+        text = names[0] + ' is typing...';
+    } else if (names.length === 2) {
+        text = names[0] + ' and ' + names[1] + ' are typing...';
+    } else if (names.length > 2) {
+        text = names.length + ' people are typing...';
+    }
+    document.getElementById('chat-typing').innerText = text;
+}
+
+// setTyping shows or hides someone typing. Indicators not repeated within
+// typingTimeout are dropped, in case the stop never comes.
+function setTyping(message, typing) {
+    if (isSelf(message.sender)) {
+        return;
+    }
+    var typist = typists[message.sender];
+    if (typist) {
+        clearTimeout(typist.timer);
+        delete typists[message.sender];
+    }
+    if (typing) {
+        typists[message.sender] = {
+            name: senderName(message),
+            timer: setTimeout(function () {
+                delete typists[message.sender];
+                showTypists();
+            }, typingTimeout)
+        };
+    }
+    showTypists();
+}
+
+// Others see us typing public messages, not private ones or edits.
+msg.addEventListener('input', function () {
+    if (chatTo || chatEditing || !msg.value) {
+        return;
+    }
+    if (Date.now() - typingSent > typingInterval) {
+        typingSent = Date.now();
+        sendChat({
+            type: 'typing'
+        });
+    }
+    clearTimeout(typingTimer);
+    typingTimer = setTimeout(stopTyping, typingInterval);
+});
+
+function stopTyping() {
+    clearTimeout(typingTimer);
+    if (typingSent) {
+        typingSent = 0;
+        sendChat({
+            type: 'typing-stopped'
+        });
     }
 }
 
@@ -24,10 +174,11 @@ function appendLog(item) {
     }
 }
 
-function currentTime() {
-    var date = new Date;
-    hour = date.getHours();
-    minute = date.getMinutes();
+// formatTime shows the server timestamp of a message in local time.
+function formatTime(time) {
+    var date = new Date(time);
+    var hour = date.getHours();
+    var minute = date.getMinutes();
     if (hour < 10) {
         hour = "0" + hour
     }
@@ -37,6 +188,460 @@ function currentTime() {
     return hour + ":" + minute
 }
 
+function isSelf(id) {
+    return id === chatSelf || (typeof participantId !== 'undefined' && id === participantId)
+}
+
+function senderName(message) {
+    if (isSelf(message.sender)) {
+        return "You"
+    }
+    return message.name || "Guest " + message.sender.slice(0, 4)
+}
+
+// ownMessage reports whether we sent message, in this connection or an
+// earlier one.
+function ownMessage(message) {
+    return isSelf(message.sender) || (!!chatAuthor && message.author === chatAuthor)
+}
+
+function authorName(author) {
+    if (author === chatAuthor) {
+        return "You"
+    }
+    return authors[author] || participantName(author)
+}
+
+function participantName(id) {
+    if (isSelf(id)) {
+        return "You"
+    }
+    return names[id] || "Guest " + id.slice(0, 4)
+}
+
+function canModerateChat() {
+    return chatModerator || (typeof IsHost !== 'undefined' && IsHost)
+}
+
+function sendChat(request) {
+    if (chatWs && chatWs.readyState === WebSocket.OPEN) {
+        chatWs.send(JSON.stringify(request));
+    }
+}
+
+// inCall reports whether id is a participant of the call, whom anyone may
+// message privately.
+function inCall(id) {
+    return typeof roster !== 'undefined' && roster.some(function (p) {
+        return p.id === id
+    })
+}
+
+// showCompose tells in the input what the next message does.
+function showCompose() {
+    if (chatEditing) {
+        msg.placeholder = "edit your message (Esc to cancel)";
+    } else if (chatParent) {
+        msg.placeholder = "reply to " + senderName(chatParent) + " (Esc to cancel)";
+    } else if (chatTo) {
+        msg.placeholder = "private message to " + chatToName + " (Esc to cancel)";
+    } else {
+        msg.placeholder = "type message...";
+    }
+    if (!slideOpen) {
+        slideToggle();
+    }
+    msg.focus();
+}
+
+// startDirect sends the next messages privately to a participant until
+// cancelled with Escape.
+function startDirect(id, name) {
+    chatTo = id;
+    chatToName = name;
+    showCompose();
+}
+
+// startReply sends the next message as a reply to message.
+function startReply(message) {
+    chatParent = message;
+    showCompose();
+}
+
+function startEdit(message) {
+    chatEditing = message.id;
+    msg.value = message.body;
+    showCompose();
+}
+
+// stopCompose cancels an edit, then a reply, then private messages.
+function stopCompose() {
+    if (chatEditing) {
+        chatEditing = null;
+        msg.value = "";
+    } else if (chatParent) {
+        chatParent = null;
+    } else {
+        chatTo = null;
+    }
+    showCompose();
+}
+
+msg.addEventListener('keydown', function (e) {
+    if (e.key === 'Escape') {
+        stopCompose();
+    }
+});
+
+// fileUrl adds what lets us into the room, the join token of the page and
+// the admission ticket of the call, to the address of a shared file.
+function fileUrl(path) {
+    var params = new URL(UploadAddr, location.href).searchParams;
+    if (typeof admission !== 'undefined' && admission) {
+        params.set('admission', admission);
+    }
+    var query = params.toString();
+    return query ? path + '?' + query : path;
+}
+
+function formatSize(size) {
+    if (size < 1024) {
+        return size + " B";
+    }
+    if (size < 1024 * 1024) {
+        return Math.round(size / 1024) + " KB";
+    }
+    return (size / 1024 / 1024).toFixed(1) + " MB";
+}
+
+function attachmentLink(attachment) {
+    var link = document.createElement("a");
+    link.href = fileUrl(attachment.url);
+    link.target = "_blank";
+    link.rel = "noopener";
+    if (attachment.thumbnail) {
+        var img = document.createElement("img");
+        img.className = "chat-thumbnail";
+        img.src = fileUrl(attachment.thumbnail);
+        img.alt = attachment.name;
+        link.appendChild(img);
+    } else {
+        link.innerText = " " + attachment.name + " (" + formatSize(attachment.size) + ")";
+    }
+    return link;
+}
+
+function showNotice(text) {
+    var item = document.createElement("div");
+    item.className = "has-text-grey is-italic";
+    item.innerText = text;
+    appendLog(item);
+}
+
+// uploadFile shares the file picked in input, with the typed text if any.
+function uploadFile(input) {
+    var file = input.files[0];
+    input.value = "";
+    if (!file || !chatWs) {
+        return;
+    }
+    var form = new FormData();
+    form.append('file', file);
+    fetch(fileUrl(UploadAddr.split('?')[0]), {
+        method: 'POST',
+        body: form
+    }).then(function (response) {
+        return response.json().then(function (body) {
+            if (!response.ok) {
+                throw new Error(body.error || response.statusText);
+            }
+            return body;
+        });
+    }).then(function (attachment) {
+        sendChat({
+            type: 'text',
+            body: msg.value,
+            to: chatTo || '',
+            parent: chatParent ? chatParent.id : '',
+            attachment: attachment.id
+        });
+        msg.value = "";
+        chatParent = null;
+        showCompose();
+    }).catch(function (err) {
+        showNotice('Could not share ' + file.name + ': ' + err.message);
+    });
+}
+
+function setSlowMode(seconds) {
+    sendChat({
+        type: 'slow-mode',
+        data: String(seconds)
+    });
+}
+
+function switchChat() {
+    sendChat({
+        type: msg.disabled ? 'enable' : 'disable'
+    });
+}
+
+function chatAction(text, onclick) {
+    var action = document.createElement("a");
+    action.className = "chat-action has-text-grey";
+    action.innerText = text;
+    action.onclick = onclick;
+    return action;
+}
+
+var rejections = {
+    'disabled': 'The chat is disabled.',
+    'muted': 'You are muted in this chat.',
+    'slow-mode': 'Slow mode is on, wait a little before sending again.',
+    'forbidden': 'Only hosts can do that.',
+    'invalid': 'That did not work.',
+    'unknown-recipient': 'That participant is not in the chat anymore.',
+    'expired': 'Messages can only be edited for 15 minutes.'
+};
+
+var offenses = {
+    'rate': 'You are sending messages too fast.',
+    'ip-rate': 'Too many messages are sent from your network.',
+    'duplicate': 'You already sent that.',
+    'filter': 'Your message contains words or links not allowed here.'
+};
+
+// eventText describes a chat event, or returns nothing for events that are
+// not shown.
+function eventText(message) {
+    switch (message.body) {
+        case 'chat-disabled':
+            msg.disabled = true;
+            document.getElementById('chat-switch').innerText = 'Enable chat';
+            return 'The chat has been disabled.';
+        case 'chat-enabled':
+            msg.disabled = false;
+            document.getElementById('chat-switch').innerText = 'Disable chat';
+            return 'The chat has been enabled.';
+        case 'chat-muted':
+            return isSelf(message.data) ? 'You have been muted in this chat.' : participantName(message.data) + ' has been muted.';
+        case 'chat-unmuted':
+            return isSelf(message.data) ? 'You can chat again.' : participantName(message.data) + ' can chat again.';
+        case 'slow-mode':
+            document.getElementById('slow-mode').value = message.data;
+            return message.data === '0' ? 'Slow mode is off.' : 'Slow mode is on: one message every ' + message.data + ' seconds.';
+        case 'self':
+            chatSelf = message.data;
+            chatAuthor = message.author || null;
+            return;
+        case 'typing':
+            setTyping(message, true);
+            return;
+        case 'typing-stopped':
+            setTyping(message, false);
+            return;
+        case 'reads':
+            setRead(message.reads);
+            return;
+        case 'role':
+            chatModerator = message.data === 'moderator';
+            document.getElementById('chat-tools').style.display = canModerateChat() ? 'flex' : 'none';
+            return;
+        case 'rejected':
+            return rejections[message.data];
+        case 'warning':
+            return (offenses[message.data] || 'Your message was refused.') + ' Keep going and you will be disconnected.';
+        case 'disconnected':
+            chatRetry = 60000;
+            return (offenses[message.data] || 'Your message was refused.') + ' You have been disconnected from the chat for a minute.';
+    }
+}
+
+// parentQuote shows the message a reply is for; clicking it scrolls to
+// that message.
+function parentQuote(id) {
+    var parent = document.getElementById("msg-" + id);
+    var quote = document.createElement("div");
+    quote.className = "chat-parent has-text-grey";
+    quote.innerText = "\u21AA " + (parent ? parent.dataset.summary : "an earlier message");
+    quote.onclick = function () {
+        var parent = document.getElementById("msg-" + id);
+        if (parent) {
+            parent.scrollIntoView({ block: 'center' });
+        }
+    };
+    return quote;
+}
+
+// reactionBar shows the reactions to a message with their counts; ours are
+// highlighted and clicking one adds or takes back ours.
+function reactionBar(message) {
+    var bar = document.createElement("span");
+    Object.keys(message.reactions).forEach(function (emoji) {
+        var who = message.reactions[emoji];
+        var mine = who.some(function (author) {
+            return author === chatAuthor || isSelf(author);
+        });
+        var tag = document.createElement("a");
+        tag.className = "tag is-rounded chat-reaction" + (mine ? " is-info is-light" : "");
+        tag.innerText = emoji + " " + who.length;
+        tag.title = who.map(authorName).join(", ");
+        tag.onclick = function () {
+            sendChat({
+                type: mine ? 'unreact' : 'react',
+                data: message.id,
+                body: emoji
+            });
+        };
+        bar.appendChild(tag);
+    });
+    return bar;
+}
+
+function toggleReactionPicker(item, message) {
+    var picker = item.querySelector(".chat-picker");
+    if (picker) {
+        picker.remove();
+        return;
+    }
+    picker = document.createElement("span");
+    picker.className = "chat-picker";
+    quickReactions.forEach(function (emoji) {
+        picker.appendChild(chatAction(emoji, function () {
+            picker.remove();
+            sendChat({
+                type: 'react',
+                data: message.id,
+                body: emoji
+            });
+        }));
+    });
+    item.appendChild(picker);
+}
+
+function showMessage(message) {
+    var item = document.createElement("div");
+    switch (message.type) {
+        case 'text':
+            names[message.sender] = message.name || names[message.sender];
+            if (message.author) {
+                authors[message.author] = senderName(message);
+            }
+            var current = document.getElementById("msg-" + message.id);
+            if (current) {
+                item = current;
+                item.replaceChildren();
+                item.className = "";
+                item.title = "";
+            } else {
+                item.id = "msg-" + message.id;
+            }
+            item.dataset.summary = senderName(message) + ": " + (message.body || (message.attachment ? message.attachment.name : "")).slice(0, 60);
+            if (message.parent) {
+                item.appendChild(parentQuote(message.parent));
+            }
+            var line = document.createElement("span");
+            if (message.to) {
+                item.className = "has-text-link";
+                line.innerText = formatTime(message.time) + " - " + senderName(message) + " to " + participantName(message.to) + " (private): " + message.body;
+            } else {
+                line.innerText = formatTime(message.time) + " - " + senderName(message) + ": " + message.body;
+            }
+            item.appendChild(line);
+            if (message.edited) {
+                var edited = document.createElement("span");
+                edited.className = "has-text-grey is-size-7";
+                edited.innerText = " (edited)";
+                edited.title = "Edited at " + formatTime(message.edited);
+                item.appendChild(edited);
+            }
+            if (message.attachment) {
+                item.appendChild(attachmentLink(message.attachment));
+            }
+            if (message.reactions) {
+                item.appendChild(reactionBar(message));
+            }
+            // Direct messages are not recorded, so they cannot be replied
+            // to, reacted to or changed.
+            if (!message.to) {
+                item.appendChild(chatAction('reply', function () {
+                    startReply(message);
+                }));
+                item.appendChild(chatAction('react', function () {
+                    toggleReactionPicker(item, message);
+                }));
+            }
+            if (!isSelf(message.sender) && (canModerateChat() || inCall(message.sender))) {
+                item.appendChild(chatAction('reply privately', function () {
+                    startDirect(message.sender, senderName(message));
+                }));
+            }
+            if (message.flagged && canModerateChat()) {
+                item.className = "has-background-warning-light";
+                item.title = "Flagged by the chat filter";
+            }
+            if (ownMessage(message) && !message.to) {
+                if (Date.now() - new Date(message.time).getTime() < editWindow) {
+                    item.appendChild(chatAction('edit', function () {
+                        startEdit(message);
+                    }));
+                }
+            }
+            if ((canModerateChat() || ownMessage(message)) && !message.to) {
+                item.appendChild(chatAction('delete', function () {
+                    sendChat({
+                        type: 'delete',
+                        data: message.id
+                    });
+                }));
+            }
+            if (canModerateChat() && !message.to && !isSelf(message.sender)) {
+                item.appendChild(chatAction('mute', function () {
+                    sendChat({
+                        type: 'mute',
+                        data: message.sender
+                    });
+                }));
+            }
+            if (current) {
+                return;
+            }
+            break;
+        case 'deleted':
+            var shown = document.getElementById("msg-" + message.id);
+            if (shown) {
+                item = shown;
+                item.replaceChildren();
+            } else {
+                item.id = "msg-" + message.id;
+            }
+            unread.delete(message.id);
+            showUnread();
+            item.className = "has-text-grey is-italic";
+            item.innerText = formatTime(message.time) + " - " + senderName(message) + ": message deleted";
+            item.dataset.summary = senderName(message) + ": message deleted";
+            if (shown) {
+                return;
+            }
+            break;
+        case 'system':
+            item.className = "has-text-info";
+            item.innerText = formatTime(message.time) + " - " + message.body;
+            break;
+        case 'event':
+            var text = eventText(message);
+            if (!text) {
+                return;
+            }
+            item.className = "has-text-grey is-italic";
+            item.innerText = formatTime(message.time) + " - " + text;
+            break;
+        default:
+            return;
+    }
+    appendLog(item);
+}
+
 document.getElementById("form").onsubmit = function () {
     if (!chatWs) {
         return false;
@@ -44,33 +649,92 @@ document.getElementById("form").onsubmit = function () {
     if (!msg.value) {
         return false;
     }
-    chatWs.send(msg.value);
+    if (chatEditing) {
+        sendChat({
+            type: 'edit',
+            data: chatEditing,
+            body: msg.value
+        });
+        stopCompose();
+        return false;
+    }
+    stopTyping();
+    sendChat({
+        type: 'text',
+        body: msg.value,
+        to: chatTo || '',
+        parent: chatParent ? chatParent.id : ''
+    });
     msg.value = "";
+    if (chatParent) {
+        chatParent = null;
+        showCompose();
+    }
     return false;
 };
 
-function connectChat() {
-    chatWs = new WebSocket(ChatWebsocketAddr)
+function advanceCursor(id) {
+    if (!chatCursor || id > chatCursor) {
+        chatCursor = id;
+    }
+}
+
+// connectChat opens the chat socket at addr. Pages call it once they may
+// chat; the room page waits until the participant is in the call.
+function connectChat(addr) {
+    var url = addr;
+    if (chatCursor) {
+        url += (addr.includes('?') ? '&' : '?') + 'after=' + encodeURIComponent(chatCursor);
+    }
+    chatWs = new WebSocket(url)
 
     chatWs.onclose = function (evt) {
         console.log("websocket has closed")
         document.getElementById('chat-button').disabled = true
         setTimeout(function () {
-            connectChat();
-        }, 1000);
+            connectChat(addr);
+        }, chatRetry);
+        chatRetry = 1000;
     }
 
     chatWs.onmessage = function (evt) {
-        var messages = evt.data.split('\n');
-        if (slideOpen == false) {
-            document.getElementById('chat-alert').style.display = 'block'
+        var message = JSON.parse(evt.data);
+        if (!message) {
+            return console.log('failed to parse chat message')
         }
-        for (var i = 0; i < messages.length; i++) {
-            var item = document.createElement("div");
-
-            item.innerText = currentTime() + " - " + messages[i];
-            appendLog(item);
+        // Changes carry a revision. One to a message older than those we
+        // were shown is not ours to show.
+        if (message.revision) {
+            advanceCursor(message.revision);
+            if (!seen.has(message.id) && lastMessageId && message.id < lastMessageId) {
+                return;
+            }
+        }
+        // Events and tombstones are not replayed by ID: the state is sent
+        // again on every connect, and tombstones keep the ID they delete.
+        if (message.type === 'text' || message.type === 'system') {
+            // A text message seen before was edited or reacted to.
+            if (seen.has(message.id)) {
+                if (message.type === 'text') {
+                    showMessage(message);
+                }
+                return;
+            }
+            seen.add(message.id);
+            if (!lastMessageId || message.id > lastMessageId) {
+                lastMessageId = message.id;
+            }
+            advanceCursor(message.id);
+            if (message.type === 'text') {
+                setTyping(message, false);
+            }
+            if (!isSelf(message.sender)) {
+                unread.add(message.id);
+            }
         }
+        showMessage(message);
+        markRead();
+        showUnread();
     }
 
     chatWs.onerror = function (evt) {
@@ -83,5 +747,3 @@ function connectChat() {
         }
     }, 1000);
 }
-
-connectChat();
\ No newline at end of file
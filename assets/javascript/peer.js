@@ -42,6 +42,185 @@ document.addEventListener('DOMContentLoaded', () => {
 	});
 });
 
+// ended is set once the server removed us or closed the room, so the
+// socket is not reopened.
+let ended = false
+
+// roomSocket is the signaling socket of the current connection.
+let roomSocket = null
+
+function toggleLock() {
+	let button = document.getElementById('lock')
+	sendRoomEvent('lock', String(button.dataset.locked !== 'true'))
+}
+
+function showLocked(locked) {
+	let button = document.getElementById('lock')
+	if (button) {
+		button.dataset.locked = String(locked)
+		button.innerText = (locked ? 'Unlock' : 'Lock') + ' Room'
+	}
+}
+
+// admission is the ticket handed out once we are in the call. It skips the
+// lobby on reconnect and opens the chat.
+let admission = null
+
+function withAdmission(addr) {
+	return addr + (addr.includes('?') ? '&' : '?') + 'admission=' + encodeURIComponent(admission)
+}
+
+// setStreamLink offers the stream of the room, which a room in lobby mode
+// only hands out once we are admitted.
+function setStreamLink(link) {
+	StreamLink = link
+	document.getElementById('stream-link').href = link
+	document.getElementById('stream-offer').style.display = ''
+	document.getElementById('viewer-link').style.display = ''
+}
+
+function sendRoomEvent(event, data) {
+	roomSocket.send(JSON.stringify({
+		event: event,
+		data: data || ''
+	}))
+}
+
+function toggleLobby() {
+	let button = document.getElementById('lobby-toggle')
+	sendRoomEvent('lobby', String(button.dataset.lobby !== 'true'))
+}
+
+function admitAll() {
+	sendRoomEvent('admit-all')
+}
+
+function showLobby(enabled) {
+	let button = document.getElementById('lobby-toggle')
+	if (button) {
+		button.dataset.lobby = String(enabled)
+		button.innerText = (enabled ? 'Disable' : 'Enable') + ' Lobby'
+	}
+}
+
+function showPending(pending) {
+	let list = document.getElementById('lobby')
+	if (!list) {
+		return
+	}
+	let count = document.getElementById('lobby-count')
+	count.innerText = pending.length
+	count.style.display = pending.length ? 'inline-flex' : 'none'
+
+	list.replaceChildren()
+	pending.forEach(p => {
+		let item = document.createElement('div')
+		item.className = 'navbar-item'
+		let name = document.createElement('span')
+		name.innerText = p.name || p.id.slice(0, 8)
+		let admit = document.createElement('button')
+		admit.className = 'button is-small is-success ml-2'
+		admit.innerText = 'Admit'
+		admit.onclick = () => sendRoomEvent('admit', p.id)
+		let deny = document.createElement('button')
+		deny.className = 'button is-small is-danger ml-1'
+		deny.innerText = 'Deny'
+		deny.onclick = () => sendRoomEvent('deny', p.id)
+		item.append(name, admit, deny)
+		list.appendChild(item)
+	})
+	if (pending.length) {
+		Swal.fire({
+			position: 'top-end',
+			icon: 'info',
+			text: pending.length + ' waiting in the lobby.',
+			showConfirmButton: false,
+			timer: 3000
+		})
+	}
+}
+
+// participantId is our own ID in the call, taken from the admission ticket.
+let participantId = null
+let roster = []
+
+function setHost(host) {
+	IsHost = host
+	document.querySelectorAll('.host-only').forEach(el => {
+		el.style.display = host ? '' : 'none'
+	})
+	document.getElementById('chat-tools').style.display = canModerateChat() ? 'flex' : 'none'
+	showParticipants(roster)
+}
+
+function toggleChat() {
+	let button = document.getElementById('chat-toggle')
+	sendRoomEvent('chat', String(button.dataset.enabled !== 'true'))
+}
+
+function showChatEnabled(enabled) {
+	let button = document.getElementById('chat-toggle')
+	button.dataset.enabled = String(enabled)
+	button.innerText = (enabled ? 'Disable' : 'Enable') + ' Chat'
+}
+
+function endMeeting() {
+	if (confirm('End the meeting for everyone?')) {
+		sendRoomEvent('end')
+	}
+}
+
+function hostButton(text, className, onclick) {
+	let button = document.createElement('button')
+	button.className = 'button is-small ml-1 ' + className
+	button.innerText = text
+	button.onclick = onclick
+	return button
+}
+
+function showParticipants(participants) {
+	roster = participants
+	let list = document.getElementById('participants')
+	list.replaceChildren()
+	participants.forEach(p => {
+		let item = document.createElement('div')
+		item.className = 'navbar-item'
+		let name = document.createElement('span')
+		name.innerText = (p.name || p.id.slice(0, 8)) + (p.id === participantId ? ' (you)' : '') + (p.host ? ' · host' : '')
+		item.appendChild(name)
+		if (p.id !== participantId) {
+			item.appendChild(hostButton('Message', 'is-link is-light', () => startDirect(p.id, p.name || p.id.slice(0, 8))))
+		}
+		if (IsHost && p.id !== participantId) {
+			let mute = (kind, muted) => sendRoomEvent('mute', JSON.stringify({
+				participant: p.id,
+				kind: kind,
+				muted: muted
+			}))
+			item.append(
+				hostButton(p.audioMuted ? 'Unmute' : 'Mute', 'is-light', () => mute('audio', !p.audioMuted)),
+				hostButton(p.videoMuted ? 'Show video' : 'Hide video', 'is-light', () => mute('video', !p.videoMuted)),
+				p.host ?
+				hostButton('Remove host', 'is-light', () => sendRoomEvent('demote', p.id)) :
+				hostButton('Make host', 'is-info is-light', () => sendRoomEvent('promote', p.id)),
+				hostButton('Make sole host', 'is-info is-light', () => sendRoomEvent('transfer', p.id)),
+				hostButton('Remove', 'is-danger is-light', () => sendRoomEvent('remove', p.id))
+			)
+		}
+		list.appendChild(item)
+	})
+}
+
+function toast(text) {
+	Swal.fire({
+		position: 'top-end',
+		icon: 'info',
+		text: text,
+		showConfirmButton: false,
+		timer: 3000
+	})
+}
+
 function connect(stream) {
 	document.getElementById('peers').style.display = 'block'
 	document.getElementById('chat').style.display = 'flex'
@@ -70,6 +249,7 @@ function connect(stream) {
 		el.setAttribute("autoplay", "true")
 		el.setAttribute("playsinline", "true")
 		col.appendChild(el)
+		qualityBadge(col, event.streams[0].id)
 		document.getElementById('noone').style.display = 'none'
 		document.getElementById('nocon').style.display = 'none'
 		document.getElementById('videos').appendChild(col)
@@ -93,7 +273,8 @@ function connect(stream) {
 
 	stream.getTracks().forEach(track => pc.addTrack(track, stream))
 
-	let ws = new WebSocket(RoomWebsocketAddr)
+	let ws = new WebSocket(admission ? withAdmission(RoomWebsocketAddr) : RoomWebsocketAddr)
+	roomSocket = ws
 	pc.onicecandidate = e => {
 		if (!e.candidate) {
 			return
@@ -119,6 +300,9 @@ function connect(stream) {
 		}
 		document.getElementById('noone').style.display = 'none'
 		document.getElementById('nocon').style.display = 'flex'
+		if (ended) {
+			return
+		}
 		setTimeout(function () {
 			connect(stream);
 		}, 1000);
@@ -153,6 +337,117 @@ function connect(stream) {
 				}
 
 				pc.addIceCandidate(candidate)
+				return
+
+			case 'waiting':
+				document.getElementById('waiting').style.display = 'flex'
+				return
+
+			case 'admitted':
+				admission = msg.data
+				participantId = msg.data.split('.')[0]
+				document.getElementById('waiting').style.display = 'none'
+				if (!chatWs) {
+					connectChat(withAdmission(ChatWebsocketAddr))
+				}
+				return
+
+			case 'stream':
+				setStreamLink(location.origin + msg.data)
+				return
+
+			case 'denied':
+				ended = true
+				document.getElementById('waiting').style.display = 'none'
+				Swal.fire({
+					icon: 'error',
+					text: 'The host did not let you in.'
+				})
+				return
+
+			case 'lobby':
+				showLobby(msg.data === 'true')
+				return
+
+			case 'pending':
+				showPending(JSON.parse(msg.data))
+				return
+
+			case 'participants':
+				showParticipants(JSON.parse(msg.data))
+				return
+
+			case 'muted':
+				let muted = JSON.parse(msg.data)
+				if (muted.participant === participantId) {
+					toast('The host ' + (muted.muted ? 'muted' : 'unmuted') + ' your ' + muted.kind + '.')
+				}
+				return
+
+			case 'promoted':
+				fetch(location.pathname + '/host', {
+					method: 'POST',
+					body: new URLSearchParams({
+						key: msg.data
+					})
+				})
+				setHost(true)
+				toast('You are now a host.')
+				return
+
+			case 'demoted':
+				setHost(false)
+				toast('You are no longer a host.')
+				return
+
+			case 'chat':
+				showChatEnabled(msg.data === 'true')
+				toast(msg.data === 'true' ? 'The chat is enabled.' : 'The host disabled the chat.')
+				return
+
+			case 'failed':
+				toast('The host action failed: ' + msg.data + '.')
+				return
+
+			case 'quality':
+				showQuality(JSON.parse(msg.data))
+				return
+
+			case 'shutdown':
+				Swal.fire({
+					position: 'top-end',
+					icon: 'warning',
+					text: 'The server is restarting, the call will end in ' + msg.data + ' seconds.',
+					showConfirmButton: false,
+					timer: 5000
+				})
+				return
+
+			case 'locked':
+				showLocked(msg.data === 'true')
+				Swal.fire({
+					position: 'top-end',
+					icon: 'info',
+					text: msg.data === 'true' ? 'The room is locked, nobody else can join.' : 'The room is unlocked.',
+					showConfirmButton: false,
+					timer: 3000
+				})
+				return
+
+			case 'kicked':
+				ended = true
+				Swal.fire({
+					icon: 'error',
+					text: 'You have been removed from the call.'
+				})
+				return
+
+			case 'closed':
+				ended = true
+				Swal.fire({
+					icon: 'info',
+					text: 'The call has been ended.'
+				})
 		}
 	}
 
@@ -0,0 +1,27 @@
+var qualityClasses = {
+	good: 'is-success',
+	fair: 'is-warning',
+	poor: 'is-danger',
+	unknown: 'is-light'
+}
+
+function qualityBadge(col, streamId) {
+	col.dataset.stream = streamId
+	let badge = document.createElement("span")
+	badge.className = "tag quality is-light"
+	badge.innerText = "..."
+	col.appendChild(badge)
+}
+
+function showQuality(participants) {
+	participants.forEach(p => {
+		(p.streams || []).forEach(streamId => {
+			document.querySelectorAll('.peer[data-stream="' + streamId + '"] .quality').forEach(badge => {
+				badge.className = "tag quality " + (qualityClasses[p.score] || qualityClasses.unknown)
+				badge.innerText = p.score
+				badge.title = "rtt " + Math.round(p.rttMs) + " ms, loss " + p.lossPercent.toFixed(1) +
+					" %, jitter " + Math.round(p.jitterMs) + " ms"
+			})
+		})
+	})
+}
@@ -1,3 +1,7 @@
+// ended is set once the server removed us or closed the stream, so the
+// socket is not reopened.
+let ended = false
+
 function connectStream() {
 	document.getElementById('peers').style.display = 'block'
 	document.getElementById('chat').style.display = 'flex'
@@ -36,6 +40,7 @@ function connectStream() {
 		}, 3000);
 
 		col.appendChild(el)
+		qualityBadge(col, event.streams[0].id)
 		document.getElementById('noonestream').style.display = 'none'
 		document.getElementById('nocon').style.display = 'none'
 		document.getElementById('videos').appendChild(col)
@@ -82,6 +87,9 @@ function connectStream() {
 		}
 		document.getElementById('noonestream').style.display = 'none'
 		document.getElementById('nocon').style.display = 'flex'
+		if (ended) {
+			return
+		}
 		setTimeout(function () {
 			connectStream();
 		}, 1000);
@@ -116,6 +124,36 @@ function connectStream() {
 				}
 
 				pc.addIceCandidate(candidate)
+				return
+
+			case 'quality':
+				showQuality(JSON.parse(msg.data))
+				return
+
+			case 'shutdown':
+				Swal.fire({
+					position: 'top-end',
+					icon: 'warning',
+					text: 'The server is restarting, the call will end in ' + msg.data + ' seconds.',
+					showConfirmButton: false,
+					timer: 5000
+				})
+				return
+
+			case 'kicked':
+				ended = true
+				Swal.fire({
+					icon: 'error',
+					text: 'You have been removed from the stream.'
+				})
+				return
+
+			case 'closed':
+				ended = true
+				Swal.fire({
+					icon: 'info',
+					text: 'The stream has been ended.'
+				})
 		}
 	}
 
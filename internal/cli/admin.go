@@ -0,0 +1,287 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/router"
+	w "pinzoom/pkg/webrtc"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminClient calls the admin API of a node over HTTP or a Unix socket.
+type adminClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// adminFlags registers the connection flags shared by the admin commands.
+func adminFlags(name string) (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	addr := fs.String("addr", envOr("PINZOOM_ADMIN_ADDR", "http://127.0.0.1:9090"), "admin listener, unix:<path> or http(s)://host:port")
+	token := fs.String("token", os.Getenv("PINZOOM_ADMIN_TOKEN"), "bearer token of the admin listener")
+	return fs, addr, token
+}
+
+func newAdminClient(addr, token string) (*adminClient, error) {
+	c := &adminClient{token: token, http: &http.Client{Timeout: 10 * time.Second}}
+	if path, ok := strings.CutPrefix(addr, router.UnixPrefix); ok {
+		c.base = "http://unix"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return c, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid admin address %q, want unix:<path> or http(s)://host:port", addr)
+	}
+	c.base = strings.TrimSuffix(addr, "/")
+	return c, nil
+}
+
+// do sends a request with an optional JSON body and decodes a JSON answer
+// into out when it is not nil.
+func (c *adminClient) do(method, path string, body, out interface{}) error {
+	resp, err := c.send(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// download copies the answer of a GET request to w.
+func (c *adminClient) download(path string, w io.Writer) error {
+	resp, err := c.send(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// send makes a request and turns error statuses into errors carrying the
+// API's message.
+func (c *adminClient) send(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// parseAdmin parses the flags of an admin command, checks it got want
+// positional arguments (at least want when atLeast is set) and connects.
+func parseAdmin(name string, args []string, want int, atLeast bool, extra func(*flag.FlagSet)) (*adminClient, []string, error) {
+	fs, addr, token := adminFlags(name)
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	n := fs.NArg()
+	if n < want || (!atLeast && n != want) {
+		return nil, nil, errUsage
+	}
+	c, err := newAdminClient(*addr, *token)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func roomsList(args []string) error {
+	var asJSON bool
+	c, _, err := parseAdmin("rooms list", args, 0, false, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print the raw JSON")
+	})
+	if err != nil {
+		return err
+	}
+
+	var rooms []w.RoomSummary
+	if err := c.do(http.MethodGet, "/api/rooms", nil, &rooms); err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(rooms)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROOM\tPARTICIPANTS\tVIEWERS\tTRACKS\tCHAT\tUPTIME")
+	for _, r := range rooms {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", r.ID, r.Participants, r.Viewers, r.Tracks, r.ChatClients, r.Uptime)
+	}
+	return tw.Flush()
+}
+
+func roomsInspect(args []string) error {
+	c, rest, err := parseAdmin("rooms inspect", args, 1, false, nil)
+	if err != nil {
+		return err
+	}
+	var room json.RawMessage
+	if err := c.do(http.MethodGet, "/api/rooms/"+url.PathEscape(rest[0]), nil, &room); err != nil {
+		return err
+	}
+	return printJSON(room)
+}
+
+func roomsClose(args []string) error {
+	c, rest, err := parseAdmin("rooms close", args, 1, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.do(http.MethodDelete, "/api/rooms/"+url.PathEscape(rest[0]), nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("room %s closed\n", rest[0])
+	return nil
+}
+
+func roomsLock(args []string) error {
+	return setLocked("rooms lock", args, true)
+}
+
+func roomsUnlock(args []string) error {
+	return setLocked("rooms unlock", args, false)
+}
+
+func setLocked(name string, args []string, locked bool) error {
+	c, rest, err := parseAdmin(name, args, 1, false, nil)
+	if err != nil {
+		return err
+	}
+	body := map[string]bool{"locked": locked}
+	if err := c.do(http.MethodPost, "/api/rooms/"+url.PathEscape(rest[0])+"/settings", body, nil); err != nil {
+		return err
+	}
+	state := "unlocked"
+	if locked {
+		state = "locked"
+	}
+	fmt.Printf("room %s %s\n", rest[0], state)
+	return nil
+}
+
+func kick(args []string) error {
+	c, rest, err := parseAdmin("kick", args, 2, false, nil)
+	if err != nil {
+		return err
+	}
+	path := "/api/rooms/" + url.PathEscape(rest[0]) + "/participants/" + url.PathEscape(rest[1])
+	if err := c.do(http.MethodDelete, path, nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("participant %s kicked from %s\n", rest[1], rest[0])
+	return nil
+}
+
+func broadcast(args []string) error {
+	c, rest, err := parseAdmin("broadcast", args, 2, true, nil)
+	if err != nil {
+		return err
+	}
+	body := map[string]string{"message": strings.Join(rest[1:], " ")}
+	return c.do(http.MethodPost, "/api/rooms/"+url.PathEscape(rest[0])+"/messages", body, nil)
+}
+
+func chatExport(args []string) error {
+	var format, from, to, base, output string
+	c, rest, err := parseAdmin("chat export", args, 1, false, func(fs *flag.FlagSet) {
+		fs.StringVar(&format, "format", chat.FormatMarkdown, "json, markdown or html")
+		fs.StringVar(&from, "from", "", "first message time to export, RFC 3339")
+		fs.StringVar(&to, "to", "", "time to export messages until, RFC 3339")
+		fs.StringVar(&base, "base-url", "", "public address of the node, prefixed to attachment links")
+		fs.StringVar(&output, "o", "", "file to write, default stdout")
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := chat.ParseFormat(format); err != nil {
+		return err
+	}
+	query := url.Values{"format": {format}}
+	for name, value := range map[string]string{"from": from, "to": to, "base": base} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	out := io.Writer(os.Stdout)
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	// A transcript can take longer than the other calls.
+	c.http.Timeout = time.Minute
+	return c.download("/api/rooms/"+url.PathEscape(rest[0])+"/chat/transcript?"+query.Encode(), out)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,103 @@
+// Package cli implements the pinzoom subcommands: serve starts the server,
+// the others operate a running node through its admin API.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"pinzoom/internal/server"
+	"strings"
+)
+
+// errUsage makes Run print the usage of the command and exit with 2.
+var errUsage = errors.New("usage")
+
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[flags]", "start the server, the default without a command", serve},
+		{"rooms list", "[-json]", "list live rooms", roomsList},
+		{"rooms inspect", "<room>", "show participants, tracks and quality of a room", roomsInspect},
+		{"rooms close", "<room>", "end the call and remove a room", roomsClose},
+		{"rooms lock", "<room>", "refuse new joiners", roomsLock},
+		{"rooms unlock", "<room>", "let new joiners in again", roomsUnlock},
+		{"kick", "<room> <participant>", "disconnect a participant", kick},
+		{"broadcast", "<room> <message>", "post a system message into a room chat", broadcast},
+		{"chat export", "[flags] <room>", "export the chat transcript of a room", chatExport},
+		{"token", "[flags] <room>", "sign a join token for a room", token},
+		{"config validate", "[serve flags]", "check serve flags without starting", configValidate},
+		{"version", "", "print the version", version},
+	}
+}
+
+// Run executes the command named by args and returns the exit code. Flags
+// without a command start the server, as before subcommands existed.
+func Run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return exitCode("serve", serve(args))
+	}
+	if args[0] == "help" {
+		usage(os.Stdout)
+		return 0
+	}
+
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return exitCode(c.name, c.run(args[len(words):]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(args, " "))
+	usage(os.Stderr)
+	return 2
+}
+
+func exitCode(name string, err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(os.Stderr, "usage: pinzoom %s %s\n", c.name, c.args)
+			}
+		}
+		return 2
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: pinzoom <command> [arguments]")
+	fmt.Fprintln(w)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-34s %s\n", strings.TrimSpace(c.name+" "+c.args), c.short)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Admin commands reach the node at -addr or $PINZOOM_ADMIN_ADDR, e.g.")
+	fmt.Fprintln(w, "unix:/run/pinzoom/admin.sock or http://127.0.0.1:9090, and send -token")
+	fmt.Fprintln(w, "or $PINZOOM_ADMIN_TOKEN as a bearer token.")
+}
+
+func configValidate(args []string) error {
+	if err := server.Validate(args); err != nil {
+		return err
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
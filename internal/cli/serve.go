@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"pinzoom/internal/server"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serve runs the server until the first SIGINT or SIGTERM, then drains.
+// A second signal exits immediately.
+func serve(args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Run(ctx, args)
+	}()
+
+	select {
+	case <-sigChan:
+		logrus.Println("Shutting down, send the signal again to force exit.")
+		cancel()
+	case err := <-errChan:
+		return stopped(err)
+	}
+
+	select {
+	case err := <-errChan:
+		return stopped(err)
+	case <-sigChan:
+		logrus.Println("Forcing shutdown.")
+		os.Exit(1)
+		return nil
+	}
+}
+
+func stopped(err error) error {
+	if err != nil {
+		return err
+	}
+	logrus.Println("Server stopped gracefully.")
+	return nil
+}
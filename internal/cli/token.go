@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"pinzoom/pkg/auth"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// token signs a join token, for testing and for backends that shell out
+// instead of signing tokens themselves.
+func token(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	key := fs.String("key", "", "signing key, defaults to $PINZOOM_JOIN_KEY")
+	identity := fs.String("identity", "", "identity of the user in your product")
+	name := fs.String("name", "", "display name")
+	grants := fs.String("grants", "publish,subscribe,chat", "comma separated grants: publish, subscribe, chat, moderate")
+	ttl := fs.Duration("ttl", time.Hour, "how long the token is valid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	if *key == "" {
+		*key = os.Getenv("PINZOOM_JOIN_KEY")
+	}
+	if len(*key) < auth.MinKeyLength {
+		return fmt.Errorf("signing key must be at least %d bytes", auth.MinKeyLength)
+	}
+
+	claims := auth.Claims{Name: *name, Room: fs.Arg(0)}
+	for _, g := range strings.Split(*grants, ",") {
+		switch grant := auth.Grant(strings.TrimSpace(g)); grant {
+		case auth.GrantPublish, auth.GrantSubscribe, auth.GrantChat, auth.GrantModerate:
+			claims.Grants = append(claims.Grants, grant)
+		case "":
+		default:
+			return fmt.Errorf("unknown grant %q", grant)
+		}
+	}
+	if len(claims.Grants) == 0 {
+		return errors.New("a token needs at least one grant")
+	}
+	now := time.Now()
+	claims.Subject = *identity
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(*ttl))
+
+	signed, err := auth.SignWith([]byte(*key), claims)
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is set at build time with -ldflags "-X pinzoom/internal/cli.Version=v1.2.3".
+var Version = "dev"
+
+func version(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	revision, modified := "unknown", ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					modified = "+dirty"
+				}
+			}
+		}
+	}
+	fmt.Printf("pinzoom %s (%s%s, %s)\n", Version, revision, modified, runtime.Version())
+	return nil
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/hub"
+	w "pinzoom/pkg/webrtc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// accessCookiePrefix names the cookie carrying a room's access key. The
+// cookie is keyed by stream ID, which room participants and viewers both
+// know, so it does not leak the room ID to viewers.
+const accessCookiePrefix = "pz_access_"
+
+// Password guessing is limited per client and room.
+const (
+	passwordAttempts = 5
+	passwordWindow   = time.Minute
+)
+
+var passwordLimiter = newAttemptLimiter(passwordAttempts, passwordWindow)
+
+// checkAccess refuses identities a host removed, and lets anonymous requests
+// into a password protected or locked room only with the access key handed
+// out when they got in. Token holders were let in by the backend and skip
+// the password; only moderators may enter a locked room. Pages get the
+// password prompt, sockets an error.
+func checkAccess(ctx *hub.Ctx, room *w.Room, claims *auth.Claims) (bool, error) {
+	if room.Banned(clientIdentity(ctx, claims)) {
+		return false, refuseAccess(ctx, room, http.StatusForbidden, "")
+	}
+	if !room.Restricted() || hasAccessKey(ctx, room) {
+		return true, nil
+	}
+	tokenHolder := auth.Token(ctx.Request) != ""
+	if room.Locked() && !claims.Has(auth.GrantModerate) {
+		return false, refuseAccess(ctx, room, http.StatusLocked, "")
+	}
+	if room.HasPassword() && !tokenHolder {
+		return false, refuseAccess(ctx, room, http.StatusUnauthorized, "")
+	}
+	return true, nil
+}
+
+func refuseAccess(ctx *hub.Ctx, room *w.Room, status int, message string) error {
+	withRoom(ctx, room)
+	ctx.Log.WithField("status", status).Info("Room access refused")
+	if websocket.IsWebSocketUpgrade(ctx.Request) {
+		http.Error(ctx.Response, http.StatusText(status), status)
+		return nil
+	}
+	action := "/room/" + room.ID + "/password"
+	if strings.HasPrefix(ctx.Request.URL.Path, "/stream/") {
+		action = "/stream/" + room.StreamID + "/password"
+	}
+	return renderPageStatus(ctx, status, "access", map[string]interface{}{
+		"Removed": status == http.StatusForbidden,
+		"Locked":  status == http.StatusLocked,
+		"Message": message,
+		"Action":  action,
+	})
+}
+
+// Admitted keeps the chat of a room in lobby mode closed to participants
+// still waiting for a host. They get the admission ticket once they are in
+// the call and pass it as ?admission=. Hosts need no ticket.
+func Admitted(next func(*hub.Ctx) error) func(*hub.Ctx) error {
+	return func(ctx *hub.Ctx) error {
+		room, err := w.LookupRoom(ctx.Param("uuid"))
+		if err != nil || admitted(ctx, room, room.CheckAdmission(ctx.Request.URL.Query().Get("admission"))) {
+			return next(ctx)
+		}
+		return refuseLobby(ctx, room)
+	}
+}
+
+// StreamAdmitted is Admitted for the stream of a room, which would
+// otherwise let participants waiting in the lobby watch and chat. Viewers
+// pass the grant of the stream link as ?viewer=; admission tickets are not
+// taken here, as stream links are shared.
+func StreamAdmitted(next func(*hub.Ctx) error) func(*hub.Ctx) error {
+	return func(ctx *hub.Ctx) error {
+		w.RoomsLock.RLock()
+		room, ok := w.Streams[ctx.Param("suuid")]
+		w.RoomsLock.RUnlock()
+		if !ok || admitted(ctx, room, room.CheckViewerGrant(ctx.Request.URL.Query().Get("viewer"))) {
+			return next(ctx)
+		}
+		return refuseLobby(ctx, room)
+	}
+}
+
+func admitted(ctx *hub.Ctx, room *w.Room, granted bool) bool {
+	return !room.Lobby() || granted ||
+		auth.FromContext(ctx.Request.Context()).Has(auth.GrantModerate)
+}
+
+func refuseLobby(ctx *hub.Ctx, room *w.Room) error {
+	withRoom(ctx, room)
+	ctx.Log.Info("Refused a participant waiting in the lobby")
+	http.Error(ctx.Response, "waiting for the host to let you in", http.StatusForbidden)
+	return nil
+}
+
+// grantAccess hands out the access key, so the sockets of the page and
+// later reconnects are let in even once the room is locked.
+func grantAccess(ctx *hub.Ctx, room *w.Room) {
+	http.SetCookie(ctx.Response, &http.Cookie{
+		Name:     accessCookiePrefix + room.StreamID,
+		Value:    room.AccessKey(),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   os.Getenv("ENVIRONMENT") == "PRODUCTION",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func hasAccessKey(ctx *hub.Ctx, room *w.Room) bool {
+	cookie, err := ctx.Request.Cookie(accessCookiePrefix + room.StreamID)
+	return err == nil && room.CheckAccessKey(cookie.Value)
+}
+
+// RoomPassword checks the password posted from the prompt of a room page.
+func RoomPassword(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil
+	}
+	return checkPassword(ctx, room, "/room/"+room.ID)
+}
+
+// StreamPassword checks the password posted from the prompt of a stream page.
+func StreamPassword(ctx *hub.Ctx) error {
+	w.RoomsLock.RLock()
+	room, ok := w.Streams[ctx.Param("suuid")]
+	w.RoomsLock.RUnlock()
+	if !ok {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil
+	}
+	return checkPassword(ctx, room, "/stream/"+room.StreamID)
+}
+
+func checkPassword(ctx *hub.Ctx, room *w.Room, page string) error {
+	withRoom(ctx, room)
+
+	key := clientIP(ctx.Request) + "|" + room.ID
+	if wait := passwordLimiter.blocked(key); wait > 0 {
+		ctx.Response.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		return refuseAccess(ctx, room, http.StatusTooManyRequests,
+			fmt.Sprintf("Too many attempts, try again in %d seconds.", int(wait.Seconds())+1))
+	}
+	if room.Locked() {
+		return refuseAccess(ctx, room, http.StatusLocked, "")
+	}
+	if err := room.CheckPassword(ctx.Request.PostFormValue("password")); err != nil {
+		passwordLimiter.fail(key)
+		ctx.Log.Warn("Wrong room password")
+		return refuseAccess(ctx, room, http.StatusUnauthorized, "Wrong password.")
+	}
+
+	passwordLimiter.reset(key)
+	grantAccess(ctx, room)
+	http.Redirect(ctx.Response, ctx.Request, page, http.StatusSeeOther)
+	return nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attemptLimiter blocks a key after max failures within window.
+type attemptLimiter struct {
+	max    int
+	window time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{max: max, window: window, failures: make(map[string][]time.Time)}
+}
+
+// blocked returns how long key has to wait before the next attempt.
+func (l *attemptLimiter) blocked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := l.recent(key)
+	if len(recent) < l.max {
+		return 0
+	}
+	return time.Until(recent[0].Add(l.window))
+}
+
+func (l *attemptLimiter) fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures[key] = append(l.recent(key), time.Now())
+
+	// Forget clients that gave up, so the map doesn't grow without bound.
+	if len(l.failures) > 1024 {
+		for k := range l.failures {
+			l.recent(k)
+		}
+	}
+}
+
+func (l *attemptLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// recent drops failures older than the window. Callers hold mu.
+func (l *attemptLimiter) recent(key string) []time.Time {
+	failures := l.failures[key]
+	cutoff := time.Now().Add(-l.window)
+	for len(failures) > 0 && failures[0].Before(cutoff) {
+		failures = failures[1:]
+	}
+	if len(failures) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = failures
+	return failures
+}
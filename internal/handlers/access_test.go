@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"pinzoom/assets"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/hub"
+	"pinzoom/pkg/render"
+	"pinzoom/pkg/router"
+	w "pinzoom/pkg/webrtc"
+	"pinzoom/views"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	w.Rooms = make(map[string]*w.Room)
+	w.Streams = make(map[string]*w.Room)
+
+	static, err := router.NewAssets(assets.FS, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading assets, err=%v\n", err)
+		os.Exit(1)
+	}
+	if Views, err = render.New(views.FS, false, static.FuncMap()); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading views, err=%v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testRoom registers a room and its stream for the length of a test.
+func testRoom(t *testing.T) *w.Room {
+	room := w.NewRoom("test-room", "test-stream")
+	w.RoomsLock.Lock()
+	w.Rooms[room.ID] = room
+	w.Streams[room.StreamID] = room
+	w.RoomsLock.Unlock()
+	t.Cleanup(func() {
+		w.RoomsLock.Lock()
+		delete(w.Rooms, room.ID)
+		delete(w.Streams, room.StreamID)
+		w.RoomsLock.Unlock()
+	})
+	return room
+}
+
+// testSocket builds the context of a websocket request with claims, so
+// refusals come as plain errors rather than pages.
+func testSocket(target string, params map[string]string, claims *auth.Claims) (*hub.Ctx, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if claims != nil {
+		r = r.WithContext(auth.WithClaims(r.Context(), claims))
+	}
+	rec := httptest.NewRecorder()
+	return hub.NewContext(r, rec, params, nil, nil), rec
+}
+
+func TestAdmitted(t *testing.T) {
+	room := testRoom(t)
+	room.SetLobby(true)
+	ticket := room.AdmissionTicket("p1")
+	grant := room.ViewerGrant()
+	moderator := &auth.Claims{Grants: []auth.Grant{auth.GrantModerate}}
+
+	roomChat := map[string]string{"uuid": room.ID}
+	streamChat := map[string]string{"suuid": room.StreamID}
+	tests := []struct {
+		name   string
+		stream bool
+		query  string
+		claims *auth.Claims
+		want   bool
+	}{
+		{name: "room without ticket"},
+		{name: "room with ticket", query: "?admission=" + ticket, want: true},
+		{name: "room with forged ticket", query: "?admission=p1.1.00"},
+		{name: "room with viewer grant", query: "?viewer=" + grant},
+		{name: "room moderator", claims: moderator, want: true},
+		{name: "stream without grant", stream: true},
+		{name: "stream with grant", stream: true, query: "?viewer=" + grant, want: true},
+		{name: "stream with admission ticket", stream: true, query: "?admission=" + ticket},
+		{name: "stream with ticket as grant", stream: true, query: "?viewer=" + ticket},
+		{name: "stream moderator", stream: true, claims: moderator, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrap, params := Admitted, roomChat
+			if tt.stream {
+				wrap, params = StreamAdmitted, streamChat
+			}
+			ctx, rec := testSocket("/chat/websocket"+tt.query, params, tt.claims)
+			called := false
+			wrap(func(*hub.Ctx) error { called = true; return nil })(ctx)
+			if called != tt.want {
+				t.Errorf("admitted = %v, want %v", called, tt.want)
+			}
+			if !tt.want && rec.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+
+	room.SetLobby(false)
+	ctx, _ := testSocket("/chat/websocket", streamChat, nil)
+	called := false
+	StreamAdmitted(func(*hub.Ctx) error { called = true; return nil })(ctx)
+	if !called {
+		t.Error("stream refused without a lobby")
+	}
+}
+
+// testPage builds the context of a page request.
+func testPage(r *http.Request, params map[string]string, claims *auth.Claims) (*hub.Ctx, *httptest.ResponseRecorder) {
+	if claims == nil {
+		claims = &auth.Claims{}
+	}
+	r = r.WithContext(auth.WithClaims(r.Context(), claims))
+	rec := httptest.NewRecorder()
+	return hub.NewContext(r, rec, params, nil, nil), rec
+}
+
+func TestCheckAccess(t *testing.T) {
+	room := testRoom(t)
+	moderator := &auth.Claims{Grants: []auth.Grant{auth.GrantModerate}}
+	accessKey := &http.Cookie{Name: accessCookiePrefix + room.StreamID, Value: room.AccessKey()}
+	wrongKey := &http.Cookie{Name: accessCookiePrefix + room.StreamID, Value: "00"}
+
+	tests := []struct {
+		name     string
+		password bool
+		locked   bool
+		token    bool
+		cookie   *http.Cookie
+		claims   *auth.Claims
+		want     int
+	}{
+		{name: "open room", want: http.StatusOK},
+		{name: "password", password: true, want: http.StatusUnauthorized},
+		{name: "password with token", password: true, token: true, want: http.StatusOK},
+		{name: "password with access key", password: true, cookie: accessKey, want: http.StatusOK},
+		{name: "password with wrong key", password: true, cookie: wrongKey, want: http.StatusUnauthorized},
+		{name: "locked", locked: true, want: http.StatusLocked},
+		{name: "locked with token", locked: true, token: true, want: http.StatusLocked},
+		{name: "locked moderator", locked: true, claims: moderator, want: http.StatusOK},
+		{name: "locked with access key", locked: true, cookie: accessKey, want: http.StatusOK},
+		{name: "locked with password", locked: true, password: true, want: http.StatusLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password := ""
+			if tt.password {
+				password = "secret"
+			}
+			if err := room.SetPassword(password); err != nil {
+				t.Fatal(err)
+			}
+			room.SetLocked(tt.locked)
+
+			r := httptest.NewRequest(http.MethodGet, "/room/"+room.ID, nil)
+			if tt.token {
+				r.Header.Set("Authorization", "Bearer token")
+			}
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			ctx, rec := testPage(r, map[string]string{"uuid": room.ID}, tt.claims)
+			ok, err := checkAccess(ctx, room, auth.FromContext(ctx.Request.Context()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (tt.want == http.StatusOK) || rec.Code != tt.want {
+				t.Errorf("checkAccess = %v, status %d, want %d", ok, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	passwordLimiter = newAttemptLimiter(passwordAttempts, passwordWindow)
+	room := testRoom(t)
+	if err := room.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(password, remote string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/room/"+room.ID+"/password", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remote
+		ctx, rec := testPage(r, map[string]string{"uuid": room.ID}, nil)
+		if err := RoomPassword(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := post("secret", "192.0.2.1:1000")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/room/"+room.ID {
+		t.Fatalf("right password = %d to %q, want a redirect to the room", rec.Code, rec.Header().Get("Location"))
+	}
+	var granted bool
+	for _, c := range rec.Result().Cookies() {
+		granted = granted || c.Name == accessCookiePrefix+room.StreamID && room.CheckAccessKey(c.Value)
+	}
+	if !granted {
+		t.Error("right password did not grant the access key")
+	}
+
+	for i := 0; i < passwordAttempts; i++ {
+		if rec := post("wrong", "192.0.2.2:1000"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d = %d, want %d", i, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	rec = post("secret", "192.0.2.2:2000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("after %d failures = %d, Retry-After %q, want %d", passwordAttempts,
+			rec.Code, rec.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if rec := post("secret", "192.0.2.3:1000"); rec.Code != http.StatusSeeOther {
+		t.Errorf("other client = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+
+	room.SetLocked(true)
+	if rec := post("secret", "192.0.2.3:1000"); rec.Code != http.StatusLocked {
+		t.Errorf("locked room = %d, want %d", rec.Code, http.StatusLocked)
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	const window = 50 * time.Millisecond
+	l := newAttemptLimiter(3, window)
+
+	for i := 0; i < 3; i++ {
+		if wait := l.blocked("a"); wait != 0 {
+			t.Fatalf("blocked after %d failures for %v", i, wait)
+		}
+		l.fail("a")
+	}
+	if wait := l.blocked("a"); wait <= 0 || wait > window {
+		t.Errorf("blocked = %v, want up to %v", wait, window)
+	}
+	if wait := l.blocked("b"); wait != 0 {
+		t.Errorf("other key blocked for %v", wait)
+	}
+
+	l.reset("a")
+	if wait := l.blocked("a"); wait != 0 {
+		t.Errorf("blocked for %v after reset", wait)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.fail("c")
+	}
+	time.Sleep(window + 10*time.Millisecond)
+	if wait := l.blocked("c"); wait != 0 {
+		t.Errorf("blocked for %v after the window", wait)
+	}
+	if _, ok := l.failures["c"]; ok {
+		t.Error("expired failures are kept")
+	}
+}
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/hub"
+	"pinzoom/pkg/logger"
+	w "pinzoom/pkg/webrtc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAdminBody bounds the JSON bodies accepted by the admin API.
+const maxAdminBody = 64 << 10
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// AdminRooms lists the live rooms with their participant and track counts.
+func AdminRooms(ctx *hub.Ctx) error {
+	return writeJSON(ctx, http.StatusOK, w.ListRooms())
+}
+
+// AdminRoom shows the participants, tracks, stats and chat clients of a room.
+func AdminRoom(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	return writeJSON(ctx, http.StatusOK, room.Detail())
+}
+
+// AdminKick disconnects a participant from a room.
+func AdminKick(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	withRoom(ctx, room)
+	participant := ctx.Param("participant")
+	if err := room.Kick(participant); err != nil {
+		return writeAdminError(ctx, err)
+	}
+	room.Audit("admin", "remove", participant, "")
+	ctx.Log.WithField(logger.FieldParticipant, participant).Warn("Participant kicked by admin")
+	ctx.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// AdminCloseRoom ends the call of every participant and removes the room.
+func AdminCloseRoom(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	withRoom(ctx, room)
+	room.Audit("admin", "end", "", "")
+	room.Close()
+	ctx.Log.Warn("Room closed by admin")
+	ctx.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// AdminBroadcast posts a system message into the chat of a room. The body
+// is {"message": "..."}.
+func AdminBroadcast(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	withRoom(ctx, room)
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(ctx.Response, ctx.Request.Body, maxAdminBody)).Decode(&body); err != nil {
+		return writeJSON(ctx, http.StatusBadRequest, adminError{Error: "invalid JSON body"})
+	}
+	message := strings.TrimSpace(body.Message)
+	if message == "" {
+		return writeJSON(ctx, http.StatusBadRequest, adminError{Error: "message is empty"})
+	}
+
+	room.Hub.Broadcast(chat.System(message))
+	room.Audit("admin", "broadcast", "", message)
+	ctx.Log.WithField("message", message).Info("System message broadcast by admin")
+	ctx.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// AdminRoomSettings changes the password, lock, lobby and chat of a room.
+// The body is {"password": "...", "locked": true, "lobby": true, "chat":
+// false, "slowMode": 10}; omitted fields are left alone, an empty password
+// lifts the protection and a slow mode of 0 seconds turns it off.
+func AdminRoomSettings(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	withRoom(ctx, room)
+
+	var body struct {
+		Password *string `json:"password"`
+		Locked   *bool   `json:"locked"`
+		Lobby    *bool   `json:"lobby"`
+		Chat     *bool   `json:"chat"`
+		SlowMode *int    `json:"slowMode"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(ctx.Response, ctx.Request.Body, maxAdminBody)).Decode(&body); err != nil {
+		return writeJSON(ctx, http.StatusBadRequest, adminError{Error: "invalid JSON body"})
+	}
+	if body.SlowMode != nil && (*body.SlowMode < 0 || time.Duration(*body.SlowMode)*time.Second > chat.MaxSlowMode) {
+		return writeJSON(ctx, http.StatusBadRequest, adminError{Error: fmt.Sprintf("slowMode must be between 0 and %d seconds", int(chat.MaxSlowMode.Seconds()))})
+	}
+	if body.Password != nil {
+		if err := room.SetPassword(*body.Password); err != nil {
+			return writeJSON(ctx, http.StatusBadRequest, adminError{Error: err.Error()})
+		}
+		room.Audit("admin", "password", "", fmt.Sprint(*body.Password != ""))
+		ctx.Log.WithField("protected", *body.Password != "").Warn("Room password changed by admin")
+	}
+	if body.Locked != nil {
+		room.SetLocked(*body.Locked)
+		room.Audit("admin", "lock", "", fmt.Sprint(*body.Locked))
+		ctx.Log.WithField("locked", *body.Locked).Warn("Room lock changed by admin")
+	}
+	if body.Lobby != nil {
+		room.SetLobby(*body.Lobby)
+		room.Audit("admin", "lobby", "", fmt.Sprint(*body.Lobby))
+		ctx.Log.WithField("lobby", *body.Lobby).Warn("Room lobby changed by admin")
+	}
+	if body.Chat != nil {
+		room.SetChatEnabled(*body.Chat)
+		room.Audit("admin", "chat", "", fmt.Sprint(*body.Chat))
+		ctx.Log.WithField("chat", *body.Chat).Warn("Room chat changed by admin")
+	}
+	if body.SlowMode != nil {
+		room.Hub.SetSlowMode(time.Duration(*body.SlowMode) * time.Second)
+		room.Audit("admin", "slow-mode", "", strconv.Itoa(*body.SlowMode))
+		ctx.Log.WithField("slowMode", *body.SlowMode).Warn("Room chat slow mode changed by admin")
+	}
+	return writeJSON(ctx, http.StatusOK, room.Summary())
+}
+
+// AdminDeleteMessage takes a chat message of a live room back, leaving a
+// tombstone.
+func AdminDeleteMessage(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	withRoom(ctx, room)
+	m, err := room.Hub.Delete(ctx.Param("message"))
+	if errors.Is(err, chat.ErrNotText) {
+		return writeJSON(ctx, http.StatusBadRequest, adminError{Error: err.Error()})
+	}
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	room.Audit("admin", "delete", m.ID, m.Sender)
+	ctx.Log.WithField("message", m.ID).Warn("Chat message deleted by admin")
+	ctx.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Page sizes of AdminChatHistory.
+const (
+	defaultChatPage = 50
+	maxChatPage     = 500
+)
+
+// chatPage is a page of recorded chat. More tells whether older messages,
+// or newer ones when paging with after, are left.
+type chatPage struct {
+	Messages []*chat.Message `json:"messages"`
+	More     bool            `json:"more"`
+}
+
+// AdminChatHistory pages through the recorded chat of a room, live or not.
+// Without parameters it returns the latest messages; ?before=<id> pages
+// back, ?after=<id> forward, and ?limit= sets the page size.
+func AdminChatHistory(ctx *hub.Ctx) error {
+	query := ctx.Request.URL.Query()
+	q := chat.Query{
+		After:  query.Get("after"),
+		Before: query.Get("before"),
+		Limit:  defaultChatPage,
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxChatPage {
+			return writeJSON(ctx, http.StatusBadRequest, adminError{Error: fmt.Sprintf("limit must be between 1 and %d", maxChatPage)})
+		}
+		q.Limit = limit
+	}
+
+	// Ask for one more to tell whether another page follows.
+	limit := q.Limit
+	q.Limit++
+	messages, err := chat.History(ctx.Param("uuid"), q)
+	if err != nil {
+		return writeAdminError(ctx, err)
+	}
+	page := chatPage{Messages: messages}
+	if len(messages) > limit {
+		page.More = true
+		if q.After != "" {
+			page.Messages = messages[:limit]
+		} else {
+			page.Messages = messages[1:]
+		}
+	}
+	return writeJSON(ctx, http.StatusOK, page)
+}
+
+func writeAdminError(ctx *hub.Ctx, err error) error {
+	status := http.StatusInternalServerError
+	if errors.Is(err, w.ErrRoomNotFound) || errors.Is(err, w.ErrParticipantNotFound) || errors.Is(err, chat.ErrMessageNotFound) {
+		status = http.StatusNotFound
+	}
+	return writeJSON(ctx, status, adminError{Error: err.Error()})
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/hub"
+	w "pinzoom/pkg/webrtc"
+)
+
+// Authorize checks the join token of a request against the room named by
+// its uuid or suuid parameter before next runs, so websockets are refused
+// before the upgrade, and then lets checkAccess enforce the room's password,
+// lock and bans. A host key adds the moderate grant. The claims are stored in
+// the request context. An unknown stream
+// has nothing to protect and is left to next.
+func Authorize(grant auth.Grant, next func(*hub.Ctx) error) func(*hub.Ctx) error {
+	return func(ctx *hub.Ctx) error {
+		roomID := ctx.Param("uuid")
+		w.RoomsLock.RLock()
+		room := w.Rooms[roomID]
+		if suuid := ctx.Param("suuid"); suuid != "" {
+			room = w.Streams[suuid]
+		}
+		w.RoomsLock.RUnlock()
+		if room != nil {
+			roomID = room.ID
+		} else if ctx.Param("suuid") != "" {
+			return next(ctx)
+		}
+
+		claims, err := auth.Authorize(ctx.Request, roomID, grant)
+		if err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, auth.ErrTokenRequired) || errors.Is(err, auth.ErrInvalidToken) {
+				status = http.StatusUnauthorized
+			}
+			ctx.Log.WithField("grant", grant).Warnf("Join refused, err=%v", err)
+			http.Error(ctx.Response, err.Error(), status)
+			return nil
+		}
+		if room != nil {
+			if key := hostKey(ctx, room); key != "" {
+				claims = hostClaims(claims)
+				ctx.Request = ctx.Request.WithContext(w.WithHostKey(ctx.Request.Context(), key))
+			}
+			if ok, err := checkAccess(ctx, room, claims); !ok {
+				return err
+			}
+			ctx.Request = ctx.Request.WithContext(w.WithIdentity(ctx.Request.Context(), clientIdentity(ctx, claims)))
+		}
+		ctx.Request = ctx.Request.WithContext(auth.WithClaims(ctx.Request.Context(), claims))
+		return next(ctx)
+	}
+}
+
+// tokenQuery carries the join token a page was opened with over to the
+// websocket addresses rendered into it.
+func tokenQuery(ctx *hub.Ctx) string {
+	if token := auth.Token(ctx.Request); token != "" {
+		return "?token=" + url.QueryEscape(token)
+	}
+	return ""
+}
@@ -1,63 +1,151 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"html/template"
-	"log"
+	"net/http"
+	"os"
+	"pinzoom/pkg/auth"
 	"pinzoom/pkg/chat"
 	"pinzoom/pkg/hub"
 	"pinzoom/pkg/webrtc"
+	"time"
+
+	"github.com/google/uuid"
 )
 
-func RoomChat(ctx *hub.Ctx) error {
-	tmpl, err := template.ParseFiles("views/chat.html", "views/layouts/main.html")
-	if err != nil {
-		log.Printf("Error parsing template: %v", err)
-		return fmt.Errorf("error while parsing template, err=%v", err)
+// identityCookie holds the private chat identity of a browser, shared by
+// all its tabs.
+const identityCookie = "pz_id"
+
+// ensureIdentity gives the browser a chat identity if it has none yet.
+func ensureIdentity(ctx *hub.Ctx) {
+	if _, err := ctx.Request.Cookie(identityCookie); err == nil {
+		return
 	}
-	if err = tmpl.ExecuteTemplate(ctx.Response, "main", nil); err != nil {
-		log.Printf("Error executing template: %v", err)
-		return fmt.Errorf("error while executing template, err=%v", err)
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		ctx.Log.Errorf("failed to create chat identity, err=%v", err)
+		return
 	}
-	return nil
+	http.SetCookie(ctx.Response, &http.Cookie{
+		Name:     identityCookie,
+		Value:    hex.EncodeToString(b[:]),
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		Secure:   os.Getenv("ENVIRONMENT") == "PRODUCTION",
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
-func RoomChatWebsocket(ctx *hub.Ctx) error {
+// clientIdentity is the stable identity of a request: the subject of its
+// join token or its identity cookie, empty when it has neither.
+func clientIdentity(ctx *hub.Ctx, claims *auth.Claims) string {
+	if claims.Subject != "" {
+		return "subject:" + claims.Subject
+	}
+	if cookie, err := ctx.Request.Cookie(identityCookie); err == nil && cookie.Value != "" {
+		return "browser:" + cookie.Value
+	}
+	return ""
+}
+
+// chatMember describes the client of a chat request. Participants of the
+// call, who pass their admission ticket, chat under their call ID; others
+// under an ID derived from their identity, the subject of their join token
+// or their identity cookie, so their tabs share it without giving the
+// identity away. Stream routes pass no ticket.
+func chatMember(ctx *hub.Ctx, room *webrtc.Room, admission string) chat.Member {
+	claims := auth.FromContext(ctx.Request.Context())
+	member := chat.Member{
+		Name:      claims.Name,
+		Moderator: func() bool { return claims.Has(auth.GrantModerate) },
+	}
+	member.Identity = clientIdentity(ctx, claims)
+
+	if id, ok := room.AdmittedParticipant(admission); ok {
+		// A participant moderates the chat while it is a host of the call.
+		member.ID = id
+		member.Participant = true
+		member.Moderator = func() bool { return room.IsHost(id) }
+	} else if member.Identity != "" {
+		sum := sha256.Sum256([]byte("chat:" + member.Identity))
+		member.ID = hex.EncodeToString(sum[:16])
+	} else {
+		member.ID = uuid.NewString()
+	}
+	return member
+}
+
+func RoomChat(ctx *hub.Ctx) error {
 	uuid := ctx.Param("uuid")
 	if uuid == "" {
-		log.Println("No uuid parameter provided")
+		ctx.Log.Error("No uuid parameter provided")
+		return fmt.Errorf("missing uuid parameter")
+	}
+
+	wsProto := "ws"
+	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
+		wsProto = "wss"
+	}
+
+	if room, err := webrtc.LookupRoom(uuid); err == nil {
+		grantAccess(ctx, room)
+	}
+	ensureIdentity(ctx)
+
+	data := map[string]interface{}{
+		"ChatWebsocketAddr": fmt.Sprintf("%s://%s/room/%s/chat/websocket%s", wsProto, ctx.Host(), uuid, tokenQuery(ctx)),
+		"UploadAddr":        uploadAddr(uuid, tokenQuery(ctx)),
+	}
+	return renderPage(ctx, "chat", data)
+}
+
+func RoomChatWebsocket(ctx *hub.Ctx) error {
+	roomID := ctx.Param("uuid")
+	if roomID == "" {
+		ctx.Log.Error("No uuid parameter provided")
 		return fmt.Errorf("missing uuid parameter")
 	}
 
 	webrtc.RoomsLock.Lock()
-	room := webrtc.Rooms[uuid]
+	room := webrtc.Rooms[roomID]
 	webrtc.RoomsLock.Unlock()
 	if room == nil {
 		return nil
 	}
-	if room.Hub == nil {
+	if room.Hub == nil || webrtc.Draining() {
 		return nil
 	}
-	chat.PeerChatConn(ctx.WebSocket, room.Hub)
+	withRoom(ctx, room)
+	chat.PeerChatConn(ctx, room.Hub, chatMember(ctx, room, ctx.Request.URL.Query().Get("admission")))
 	return nil
 }
 
 func StreamChatWebsocket(ctx *hub.Ctx) error {
 	suuid := ctx.Param("suuid")
 	if suuid == "" {
-		log.Println("No suuid parameter provided")
+		ctx.Log.Error("No suuid parameter provided")
 		return fmt.Errorf("missing suuid parameter")
 	}
 
+	if webrtc.Draining() {
+		return nil
+	}
+
 	webrtc.RoomsLock.Lock()
 	if stream, ok := webrtc.Streams[suuid]; ok {
 		webrtc.RoomsLock.Unlock()
 		if stream.Hub == nil {
-			hub := chat.NewHub()
+			hub := chat.NewHub(suuid)
 			stream.Hub = hub
 			go hub.Run()
 		}
-		chat.PeerChatConn(ctx.WebSocket, stream.Hub)
+		withRoom(ctx, stream)
+		chat.PeerChatConn(ctx, stream.Hub, chatMember(ctx, stream, ""))
 		return nil
 	}
 	webrtc.RoomsLock.Unlock()
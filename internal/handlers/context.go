@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"pinzoom/pkg/hub"
+	"pinzoom/pkg/tracing"
+	w "pinzoom/pkg/webrtc"
+	"runtime/pprof"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withRoom tags the request log and span with the room and stream IDs, and
+// labels the goroutine so that it and the goroutines it starts show up in
+// the room's goroutine dump.
+func withRoom(ctx *hub.Ctx, room *w.Room) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx.Request.Context(), roomLabels(room)))
+	ctx.Log = ctx.Log.WithFields(room.Fields())
+	trace.SpanFromContext(ctx.Request.Context()).SetAttributes(
+		tracing.AttrRoom.String(room.ID),
+		tracing.AttrStream.String(room.StreamID),
+	)
+}
+
+func roomLabels(room *w.Room) pprof.LabelSet {
+	return pprof.Labels("room", room.ID, "stream", room.StreamID)
+}
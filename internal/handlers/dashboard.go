@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"fmt"
+	"pinzoom/pkg/hub"
+	w "pinzoom/pkg/webrtc"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dashboardInterval is how often the dashboard sockets push a snapshot.
+const dashboardInterval = 2 * time.Second
+
+var started = time.Now()
+
+// ServerStats describes the process and its load for the dashboard.
+type ServerStats struct {
+	Uptime       string  `json:"uptime"`
+	Goroutines   int     `json:"goroutines"`
+	HeapMB       float64 `json:"heapMb"`
+	SysMB        float64 `json:"sysMb"`
+	GCRuns       uint32  `json:"gcRuns"`
+	CPUs         int     `json:"cpus"`
+	Rooms        int     `json:"rooms"`
+	Participants int     `json:"participants"`
+	Viewers      int     `json:"viewers"`
+	ChatClients  int     `json:"chatClients"`
+	Draining     bool    `json:"draining"`
+}
+
+type dashboardSnapshot struct {
+	Server ServerStats     `json:"server"`
+	Rooms  []w.RoomSummary `json:"rooms,omitempty"`
+	Room   *w.RoomDetail   `json:"room,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// AdminDashboard renders the live room listing. Dashboard pages get the path
+// of their socket and connect to the host they were loaded from, since the
+// admin listener is often reached through a tunnel.
+func AdminDashboard(ctx *hub.Ctx) error {
+	return renderPage(ctx, "admin", map[string]string{
+		"DashboardWebsocketPath": "/admin/websocket",
+	})
+}
+
+// AdminRoomPage renders the participants, tracks and moderation controls of
+// a room.
+func AdminRoomPage(ctx *hub.Ctx) error {
+	uuid := ctx.Param("uuid")
+	return renderPage(ctx, "admin_room", map[string]string{
+		"RoomID":                 uuid,
+		"DashboardWebsocketPath": fmt.Sprintf("/admin/rooms/%s/websocket", uuid),
+	})
+}
+
+// AdminWebsocket pushes the server stats and room listing until the
+// dashboard goes away.
+func AdminWebsocket(ctx *hub.Ctx) error {
+	pushSnapshots(ctx.WebSocket, func() dashboardSnapshot {
+		rooms := w.ListRooms()
+		return dashboardSnapshot{Server: serverStats(rooms), Rooms: rooms}
+	})
+	return nil
+}
+
+// AdminRoomWebsocket pushes the detail of one room, and an error once the
+// room is gone.
+func AdminRoomWebsocket(ctx *hub.Ctx) error {
+	uuid := ctx.Param("uuid")
+	pushSnapshots(ctx.WebSocket, func() dashboardSnapshot {
+		snapshot := dashboardSnapshot{Server: serverStats(w.ListRooms())}
+		room, err := w.LookupRoom(uuid)
+		if err != nil {
+			snapshot.Error = err.Error()
+			return snapshot
+		}
+		detail := room.Detail()
+		snapshot.Room = &detail
+		return snapshot
+	})
+	return nil
+}
+
+func pushSnapshots(c *websocket.Conn, snapshot func() dashboardSnapshot) {
+	defer c.Close()
+
+	// Drain control frames so a closing browser is noticed.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.WriteJSON(snapshot()); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func serverStats(rooms []w.RoomSummary) ServerStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := ServerStats{
+		Uptime:     time.Since(started).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapMB:     float64(mem.HeapAlloc) / (1 << 20),
+		SysMB:      float64(mem.Sys) / (1 << 20),
+		GCRuns:     mem.NumGC,
+		CPUs:       runtime.NumCPU(),
+		Rooms:      len(rooms),
+		Draining:   w.Draining(),
+	}
+	for _, room := range rooms {
+		stats.Participants += room.Participants
+		stats.Viewers += room.Viewers
+		stats.ChatClients += room.ChatClients
+	}
+	return stats
+}
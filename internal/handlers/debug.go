@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"pinzoom/pkg/hub"
+	"runtime/pprof"
+	"strconv"
+)
+
+// Goroutines dumps the stacks of all goroutines. With ?room=<uuid> only the
+// goroutines labelled with that room are kept, which covers the websocket
+// sessions, PeerConnections and chat hub of the room.
+func Goroutines(ctx *hub.Ctx) error {
+	var dump bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&dump, 1); err != nil {
+		return err
+	}
+
+	out := dump.Bytes()
+	if room := ctx.Request.URL.Query().Get("room"); room != "" {
+		label := []byte(`"room":` + strconv.Quote(room))
+		var filtered bytes.Buffer
+		for _, record := range bytes.Split(out, []byte("\n\n")) {
+			if bytes.Contains(record, label) {
+				filtered.Write(record)
+				filtered.WriteString("\n\n")
+			}
+		}
+		out = filtered.Bytes()
+	}
+
+	ctx.Response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ctx.Response.WriteHeader(http.StatusOK)
+	_, err := ctx.Response.Write(out)
+	return err
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/files"
+	"pinzoom/pkg/hub"
+	w "pinzoom/pkg/webrtc"
+	"strconv"
+	"strings"
+)
+
+// Uploads stores the files shared in room chats, nil when uploads are off.
+var Uploads *files.Files
+
+// fileRoom looks up the live room of a file request and checks the client
+// is a member: it opened the room page, joined with a token or was
+// admitted to the call. Downloads from ended rooms go through
+// roomAttachment.
+func fileRoom(ctx *hub.Ctx) (*w.Room, bool) {
+	if Uploads == nil {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil, false
+	}
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil, false
+	}
+	withRoom(ctx, room)
+	if !hasAccessKey(ctx, room) && auth.Token(ctx.Request) == "" &&
+		!room.CheckAdmission(ctx.Request.URL.Query().Get("admission")) {
+		ctx.Log.Info("File access refused to a client outside the room")
+		http.Error(ctx.Response, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	return room, true
+}
+
+// uploadAddr is where the chat of a room page uploads files, empty when
+// uploads are off.
+func uploadAddr(room, token string) string {
+	if Uploads == nil {
+		return ""
+	}
+	return "/room/" + room + "/files" + token
+}
+
+// chatAttachment describes an uploaded file to chat clients.
+func chatAttachment(a *files.Attachment) *chat.Attachment {
+	url := "/room/" + a.Room + "/files/" + a.ID
+	attachment := &chat.Attachment{
+		ID:   a.ID,
+		Name: a.Name,
+		Type: a.Type,
+		Size: a.Size,
+		URL:  url,
+	}
+	if a.Thumbnail {
+		attachment.Thumbnail = url + "/thumbnail"
+	}
+	return attachment
+}
+
+// ChatAttachment resolves the files chat clients attach to messages. A
+// client may only share what it uploaded to the room of the chat.
+func ChatAttachment(room, id, sender string) (*chat.Attachment, error) {
+	a, err := Uploads.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if a.Room != room || a.Uploader != sender {
+		return nil, files.ErrNotFound
+	}
+	return chatAttachment(a), nil
+}
+
+// RoomUpload stores the multipart "file" field of the request for the
+// room and returns the attachment to reference from a chat message.
+func RoomUpload(ctx *hub.Ctx) error {
+	room, ok := fileRoom(ctx)
+	if !ok {
+		return nil
+	}
+	// Sharing a file is posting to the chat: muted members, a disabled
+	// chat and the rate limit refuse it.
+	member := chatMember(ctx, room, ctx.Request.URL.Query().Get("admission"))
+	if reason := room.Hub.AllowUpload(member); reason != "" {
+		ctx.Log.WithField("reason", reason).Info("Upload refused")
+		status := http.StatusForbidden
+		if reason == chat.OffenseRate {
+			status = http.StatusTooManyRequests
+		}
+		return writeJSON(ctx, status, adminError{Error: "upload refused: " + reason})
+	}
+	// Leave room for the multipart headers around the file.
+	ctx.Request.Body = http.MaxBytesReader(ctx.Response, ctx.Request.Body, Uploads.MaxSize()+64<<10)
+	reader, err := ctx.Request.MultipartReader()
+	if err != nil {
+		http.Error(ctx.Response, "expected a multipart form", http.StatusBadRequest)
+		return nil
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return writeUploadError(ctx, err)
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		a, err := Uploads.Upload(room.ID, member.ID, uploadOwner(member), part.FileName(), part)
+		part.Close()
+		if err != nil {
+			return writeUploadError(ctx, err)
+		}
+		ctx.Log.WithField("file", a.ID).WithField("size", a.Size).Info("File uploaded")
+		return writeJSON(ctx, http.StatusCreated, chatAttachment(a))
+	}
+}
+
+// uploadOwner keys the upload quota of a member by its identity, hashed so
+// the stored metadata doesn't give it away.
+func uploadOwner(member chat.Member) string {
+	key := member.Identity
+	if key == "" {
+		key = "id:" + member.ID
+	}
+	sum := sha256.Sum256([]byte("upload:" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func writeUploadError(ctx *hub.Ctx, err error) error {
+	var tooLarge *http.MaxBytesError
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, files.ErrTooLarge) || errors.As(err, &tooLarge):
+		status, err = http.StatusRequestEntityTooLarge, files.ErrTooLarge
+	case errors.Is(err, files.ErrQuota):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, files.ErrType):
+		status = http.StatusUnsupportedMediaType
+	case errors.Is(err, files.ErrEmpty):
+		status = http.StatusBadRequest
+	case errors.Is(err, io.EOF):
+		status, err = http.StatusBadRequest, errors.New("missing file field")
+	default:
+		ctx.Log.Errorf("failed to store upload, err=%v", err)
+	}
+	return writeJSON(ctx, status, adminError{Error: err.Error()})
+}
+
+// RoomFile downloads a file shared in the room.
+func RoomFile(ctx *hub.Ctx) error {
+	a, ok := roomAttachment(ctx)
+	if !ok {
+		return nil
+	}
+	return serveAttachment(ctx, a)
+}
+
+// AdminFile downloads a file shared in any room, live or ended.
+func AdminFile(ctx *hub.Ctx) error {
+	if Uploads == nil {
+		return writeJSON(ctx, http.StatusNotFound, adminError{Error: "uploads are disabled"})
+	}
+	a, err := Uploads.Get(ctx.Param("id"))
+	if err == nil && a.Room != ctx.Param("uuid") {
+		err = files.ErrNotFound
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, files.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		return writeJSON(ctx, status, adminError{Error: err.Error()})
+	}
+	return serveAttachment(ctx, a)
+}
+
+// serveAttachment shows images inline, everything else is downloaded.
+func serveAttachment(ctx *hub.Ctx, a *files.Attachment) error {
+	disposition := "attachment"
+	if strings.HasPrefix(a.Type, "image/") {
+		disposition = "inline"
+	}
+	ctx.Response.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	ctx.Response.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	return serveFile(ctx, a.Type, Uploads.Open, a.ID)
+}
+
+// RoomFileThumbnail serves the JPEG preview of an image shared in the room.
+func RoomFileThumbnail(ctx *hub.Ctx) error {
+	a, ok := roomAttachment(ctx)
+	if !ok {
+		return nil
+	}
+	if !a.Thumbnail {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil
+	}
+	return serveFile(ctx, "image/jpeg", Uploads.OpenThumbnail, a.ID)
+}
+
+// roomAttachment looks up the attachment of a download. Members of a live
+// room get its files; once the room ended, so do holders of a join token
+// for it, which Authorize checked.
+func roomAttachment(ctx *hub.Ctx) (*files.Attachment, bool) {
+	roomID := ctx.Param("uuid")
+	if _, err := w.LookupRoom(roomID); err == nil || auth.Token(ctx.Request) == "" || Uploads == nil {
+		if _, ok := fileRoom(ctx); !ok {
+			return nil, false
+		}
+	}
+	a, err := Uploads.Get(ctx.Param("id"))
+	if err == nil && a.Room != roomID {
+		err = files.ErrNotFound
+	}
+	if err != nil {
+		if !errors.Is(err, files.ErrNotFound) {
+			ctx.Log.Errorf("failed to read attachment, err=%v", err)
+		}
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil, false
+	}
+	return a, true
+}
+
+func serveFile(ctx *hub.Ctx, typ string, open func(string) (io.ReadCloser, error), id string) error {
+	rc, err := open(id)
+	if err != nil {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil
+	}
+	defer rc.Close()
+	header := ctx.Response.Header()
+	header.Set("Content-Type", typ)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "sandbox")
+	header.Set("Cache-Control", "private, max-age=86400")
+	if _, err := io.Copy(ctx.Response, rc); err != nil {
+		return fmt.Errorf("error sending file %s, err=%v", id, err)
+	}
+	return nil
+}
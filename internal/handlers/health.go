@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"pinzoom/pkg/hub"
+	"time"
+)
+
+// ReadinessCheck reports why the server cannot take traffic, nil when it can.
+type ReadinessCheck struct {
+	Name  string
+	Check func(context.Context) error
+}
+
+// ReadinessChecks are run in order by Readyz.
+var ReadinessChecks []ReadinessCheck
+
+// Healthz reports that the process is alive and serving requests.
+func Healthz(ctx *hub.Ctx) error {
+	ctx.Response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ctx.Response.WriteHeader(http.StatusOK)
+	_, err := ctx.Response.Write([]byte("ok\n"))
+	return err
+}
+
+// Readyz runs every readiness check and answers 503 if any of them fails.
+func Readyz(ctx *hub.Ctx) error {
+	checkCtx, cancel := context.WithTimeout(ctx.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	status, ready := http.StatusOK, "ready"
+	checks := make(map[string]string, len(ReadinessChecks))
+	for _, c := range ReadinessChecks {
+		if err := c.Check(checkCtx); err != nil {
+			status, ready = http.StatusServiceUnavailable, "not ready"
+			checks[c.Name] = err.Error()
+			continue
+		}
+		checks[c.Name] = "ok"
+	}
+	return writeJSON(ctx, status, map[string]interface{}{
+		"status": ready,
+		"checks": checks,
+	})
+}
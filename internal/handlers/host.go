@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/hub"
+	w "pinzoom/pkg/webrtc"
+)
+
+// hostCookiePrefix names the cookie carrying a host key of a room, keyed
+// by stream ID like the access cookie.
+const hostCookiePrefix = "pz_host_"
+
+// setHostKey stores a host key in the browser of its holder.
+func setHostKey(ctx *hub.Ctx, room *w.Room, key string) {
+	http.SetCookie(ctx.Response, &http.Cookie{
+		Name:     hostCookiePrefix + room.StreamID,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   os.Getenv("ENVIRONMENT") == "PRODUCTION",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// hostKey returns the host key a request carries for room, if it is valid.
+func hostKey(ctx *hub.Ctx, room *w.Room) string {
+	cookie, err := ctx.Request.Cookie(hostCookiePrefix + room.StreamID)
+	if err != nil || !room.CheckHostKey(cookie.Value) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// hostClaims adds the moderate grant to the claims of a host.
+func hostClaims(claims *auth.Claims) *auth.Claims {
+	if claims.Has(auth.GrantModerate) {
+		return claims
+	}
+	host := *claims
+	host.Grants = append(append([]auth.Grant{}, claims.Grants...), auth.GrantModerate)
+	return &host
+}
+
+// RoomHost stores the host key a participant got when it was made co-host,
+// so it stays host when it reloads the page.
+func RoomHost(ctx *hub.Ctx) error {
+	room, err := w.LookupRoom(ctx.Param("uuid"))
+	if err != nil {
+		http.NotFound(ctx.Response, ctx.Request)
+		return nil
+	}
+	key := ctx.Request.PostFormValue("key")
+	if !room.CheckHostKey(key) {
+		http.Error(ctx.Response, "invalid host key", http.StatusForbidden)
+		return nil
+	}
+	setHostKey(ctx, room, key)
+	ctx.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,12 @@
+package handlers
+
+import (
+	"encoding/json"
+	"pinzoom/pkg/hub"
+)
+
+func writeJSON(ctx *hub.Ctx, status int, v interface{}) error {
+	ctx.Response.Header().Set("Content-Type", "application/json")
+	ctx.Response.WriteHeader(status)
+	return json.NewEncoder(ctx.Response).Encode(v)
+}
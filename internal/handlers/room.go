@@ -1,98 +1,131 @@
 package handlers
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
-	"html/template"
 	"net/http"
 	"os"
-	"pinzoom/pkg/chat"
+	"pinzoom/pkg/auth"
 	"pinzoom/pkg/hub"
+	"pinzoom/pkg/logger"
 	w "pinzoom/pkg/webrtc"
+	"runtime/pprof"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/pion/webrtc/v3"
-	"github.com/sirupsen/logrus"
 )
 
+var log = logger.For("handlers")
+
+// RoomCreate redirects to a new room and makes its creator the host. A
+// password posted from the welcome page protects the room and the lobby
+// option makes newcomers wait for the host.
 func RoomCreate(ctx *hub.Ctx) error {
 	roomID := uuid.New().String()
+	_, _, room := createOrGetRoom(roomID)
+	if room == nil {
+		http.Error(ctx.Response, "Server is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
+	if password := ctx.Request.PostFormValue("password"); password != "" {
+		if err := room.SetPassword(password); err != nil {
+			http.Error(ctx.Response, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+	if ctx.Request.PostFormValue("lobby") != "" {
+		room.SetLobby(true)
+	}
+	setHostKey(ctx, room, room.NewHostKey())
+	grantAccess(ctx, room)
 	ctx.Redirect(fmt.Sprintf("/room/%s", roomID))
 	return nil
 }
 
 func Room(ctx *hub.Ctx) error {
-	ctx.Response.Header().Set("Content-Type", "text/html; charset=utf-8")
 	uuidFromParam := ctx.Param("uuid")
 	if uuidFromParam == "" {
-		logrus.Error("UUID parameter is missing in Room request")
+		ctx.Log.Error("UUID parameter is missing in Room request")
 		return fmt.Errorf("UUID parameter missing")
 	}
-	logrus.Infof("Room requested with UUID: %s", uuidFromParam)
 
 	wsProto := "ws"
 	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
 		wsProto = "wss"
 	}
 
-	uuidFromParam, suuid, room := createOrGetRoom(uuidFromParam)
+	uuidFromParam, _, room := createOrGetRoom(uuidFromParam)
+	if room == nil && w.Draining() {
+		http.Error(ctx.Response, "Server is shutting down", http.StatusServiceUnavailable)
+		return nil
+	}
 	if room == nil {
 		return fmt.Errorf("failed to create or retrieve room with UUID: %s", uuidFromParam)
 	}
+	withRoom(ctx, room)
+	ctx.Log.Info("Room requested")
+	grantAccess(ctx, room)
+	ensureIdentity(ctx)
+
+	// In lobby mode the stream link is sent once the participant is
+	// admitted, so nobody waiting can watch the call through the stream.
+	// It carries a viewer grant, which lets only its holders watch and
+	// chat on the stream.
+	canModerate := auth.FromContext(ctx.Request.Context()).Has(auth.GrantModerate)
+	streamLink := ""
+	if !room.Lobby() || canModerate {
+		streamLink = fmt.Sprintf("%s://%s%s", getProtocol(ctx.Request), ctx.Host(), room.StreamPath())
+	}
 
+	token := tokenQuery(ctx)
 	data := struct {
 		RoomWebsocketAddr   string
 		RoomLink            string
 		ChatWebsocketAddr   string
 		ViewerWebsocketAddr string
+		UploadAddr          string
 		StreamLink          string
 		Type                string
+		CanModerate         bool
+		Locked              bool
+		Lobby               bool
+		ChatEnabled         bool
 	}{
-		RoomWebsocketAddr:   fmt.Sprintf("%s://%s/room/%s/websocket", wsProto, ctx.Host(), uuidFromParam),
+		RoomWebsocketAddr:   fmt.Sprintf("%s://%s/room/%s/websocket%s", wsProto, ctx.Host(), uuidFromParam, token),
 		RoomLink:            fmt.Sprintf("%s://%s/room/%s", getProtocol(ctx.Request), ctx.Host(), uuidFromParam),
-		ChatWebsocketAddr:   fmt.Sprintf("%s://%s/room/%s/chat/websocket", wsProto, ctx.Host(), uuidFromParam),
-		ViewerWebsocketAddr: fmt.Sprintf("%s://%s/room/%s/viewer/websocket", wsProto, ctx.Host(), uuidFromParam),
-		StreamLink:          fmt.Sprintf("%s://%s/stream/%s", getProtocol(ctx.Request), ctx.Host(), suuid),
+		ChatWebsocketAddr:   fmt.Sprintf("%s://%s/room/%s/chat/websocket%s", wsProto, ctx.Host(), uuidFromParam, token),
+		ViewerWebsocketAddr: fmt.Sprintf("%s://%s/room/%s/viewer/websocket%s", wsProto, ctx.Host(), uuidFromParam, token),
+		UploadAddr:          uploadAddr(uuidFromParam, token),
+		StreamLink:          streamLink,
 		Type:                "room",
+		CanModerate:         canModerate,
+		Locked:              room.Locked(),
+		Lobby:               room.Lobby(),
+		ChatEnabled:         room.ChatEnabled(),
 	}
 
-	tmpl, err := template.ParseFiles(
-		"views/peer.html",
-		"views/layouts/main.html",
-		"./views/partials/head.html",
-		"./views/partials/header.html",
-		"./views/partials/chat.html",
-	)
-	if err != nil {
-		logrus.Errorf("Template parsing error: %v", err)
-		return fmt.Errorf("error parsing template: %v", err)
-	}
-
-	if err = tmpl.ExecuteTemplate(ctx.Response, "main", data); err != nil {
-		logrus.Errorf("Template execution error: %v", err)
-		return fmt.Errorf("error executing template: %v", err)
-	}
-	return nil
+	return renderPage(ctx, "peer", data)
 }
 
 func RoomWebsocket(ctx *hub.Ctx) error {
 	if ctx.WebSocket == nil {
-		logrus.Error("WebSocket connection not found in RoomWebsocket")
+		ctx.Log.Error("WebSocket connection not found in RoomWebsocket")
 		return fmt.Errorf("WebSocket connection not found")
 	}
 	uuidFromParam := ctx.Param("uuid")
 	if uuidFromParam == "" {
-		logrus.Error("UUID parameter missing in RoomWebsocket")
+		ctx.Log.Error("UUID parameter missing in RoomWebsocket")
 		return fmt.Errorf("UUID parameter missing")
 	}
 
 	_, _, room := createOrGetRoom(uuidFromParam)
 	if room == nil {
-		logrus.Errorf("Room with UUID %s not found", uuidFromParam)
+		ctx.Log.Errorf("Room with UUID %s not found", uuidFromParam)
 		return fmt.Errorf("room with UUID %s not found", uuidFromParam)
 	}
+	withRoom(ctx, room)
 	return w.RoomConn(ctx, room.Peers)
 }
 
@@ -110,26 +143,25 @@ func createOrGetRoom(uuid string) (string, string, *w.Room) {
 		}
 		return uuid, suuid, room
 	}
-
-	hub := chat.NewHub()
-	p := &w.Peers{TrackLocals: make(map[string]*webrtc.TrackLocalStaticRTP)}
-	room := &w.Room{
-		Peers: p,
-		Hub:   hub,
+	if w.Draining() {
+		return uuid, suuid, nil
 	}
 
+	room := w.NewRoom(uuid, suuid)
 	w.Rooms[uuid] = room
 	w.Streams[suuid] = room
 
-	go hub.Run()
-	logrus.Infof("Room and stream created with UUID: %s, SUID: %s", uuid, suuid)
+	go pprof.Do(context.Background(), roomLabels(room), func(context.Context) {
+		room.Hub.Run()
+	})
+	log.WithFields(room.Fields()).Info("Room and stream created")
 	return uuid, suuid, room
 }
 
 func RoomViewerWebsocket(ctx *hub.Ctx) error {
 	uuid := ctx.Param("uuid")
 	if uuid == "" {
-		logrus.Error("UUID parameter missing in RoomViewerWebsocket")
+		ctx.Log.Error("UUID parameter missing in RoomViewerWebsocket")
 		return fmt.Errorf("UUID parameter missing")
 	}
 
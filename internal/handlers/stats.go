@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"net/http"
+	"pinzoom/pkg/hub"
+	w "pinzoom/pkg/webrtc"
+)
+
+// Stats returns the call quality summary of every participant by room.
+func Stats(ctx *hub.Ctx) error {
+	return writeJSON(ctx, http.StatusOK, w.Stats.Rooms())
+}
+
+// RoomStats returns the call quality of a room's participants together with
+// the samples of the rolling window.
+func RoomStats(ctx *hub.Ctx) error {
+	return writeJSON(ctx, http.StatusOK, w.Stats.Room(ctx.Param("uuid")))
+}
@@ -2,8 +2,7 @@ package handlers
 
 import (
 	"fmt"
-	"html/template"
-	"log"
+	"net/url"
 	"os"
 	"pinzoom/pkg/hub"
 	w "pinzoom/pkg/webrtc"
@@ -15,7 +14,7 @@ import (
 func Stream(ctx *hub.Ctx) error {
 	suuid := ctx.Param("suuid")
 	if suuid == "" {
-		log.Println("No suuid parameter provided")
+		ctx.Log.Error("No suuid parameter provided")
 		return fmt.Errorf("missing suuid parameter")
 	}
 
@@ -25,51 +24,54 @@ func Stream(ctx *hub.Ctx) error {
 	}
 
 	w.RoomsLock.Lock()
-	_, streamExists := w.Streams[suuid]
+	stream, streamExists := w.Streams[suuid]
 	w.RoomsLock.Unlock()
 
-	tmpl, err := template.ParseFiles("views/stream.html", "views/layouts/main.html")
-	if err != nil {
-		log.Printf("Error parsing template: %v", err)
-		return fmt.Errorf("template parsing error: %v", err)
-	}
-
 	data := map[string]interface{}{
 		"Type": "stream",
 	}
 
 	if streamExists {
-		data["StreamWebsocketAddr"] = fmt.Sprintf("%s://%s/stream/%s/websocket", wsProto, ctx.Host(), suuid)
-		data["ChatWebsocketAddr"] = fmt.Sprintf("%s://%s/stream/%s/chat/websocket", wsProto, ctx.Host(), suuid)
-		data["ViewerWebsocketAddr"] = fmt.Sprintf("%s://%s/stream/%s/viewer/websocket", wsProto, ctx.Host(), suuid)
+		grantAccess(ctx, stream)
+		ensureIdentity(ctx)
+		token := tokenQuery(ctx)
+		// Viewers of a room in lobby mode carry the grant of their link
+		// along.
+		if grant := ctx.Request.URL.Query().Get("viewer"); grant != "" {
+			sep := "?"
+			if token != "" {
+				sep = "&"
+			}
+			token += sep + "viewer=" + url.QueryEscape(grant)
+		}
+		data["StreamWebsocketAddr"] = fmt.Sprintf("%s://%s/stream/%s/websocket%s", wsProto, ctx.Host(), suuid, token)
+		data["ChatWebsocketAddr"] = fmt.Sprintf("%s://%s/stream/%s/chat/websocket%s", wsProto, ctx.Host(), suuid, token)
+		data["ViewerWebsocketAddr"] = fmt.Sprintf("%s://%s/stream/%s/viewer/websocket%s", wsProto, ctx.Host(), suuid, token)
 	} else {
 		data["NoStream"] = "true"
 		data["Leave"] = "true"
 	}
 
-	if err = tmpl.ExecuteTemplate(ctx.Response, "main", data); err != nil {
-		log.Printf("Error executing template: %v", err)
-		return fmt.Errorf("template execution error: %v", err)
-	}
-	return nil
+	return renderPage(ctx, "stream", data)
 }
 
 func StreamWebsocket(ctx *hub.Ctx) error {
 	if ctx.WebSocket == nil {
-		log.Println("WebSocket connection not found")
+		ctx.Log.Error("WebSocket connection not found")
 		return fmt.Errorf("WebSocket connection not found")
 	}
 
 	suuid := ctx.Param("suuid")
 	if suuid == "" {
-		log.Println("No suuid parameter provided")
+		ctx.Log.Error("No suuid parameter provided")
 		return fmt.Errorf("missing suuid parameter")
 	}
 
 	w.RoomsLock.Lock()
 	if stream, ok := w.Streams[suuid]; ok {
 		w.RoomsLock.Unlock()
-		w.StreamConn(ctx.WebSocket, stream.Peers)
+		withRoom(ctx, stream)
+		w.StreamConn(ctx, stream.Peers)
 		return nil
 	}
 	w.RoomsLock.Unlock()
@@ -78,13 +80,13 @@ func StreamWebsocket(ctx *hub.Ctx) error {
 
 func StreamViewerWebsocket(ctx *hub.Ctx) error {
 	if ctx.WebSocket == nil {
-		log.Println("WebSocket connection not found")
+		ctx.Log.Error("WebSocket connection not found")
 		return fmt.Errorf("WebSocket connection not found")
 	}
 
 	suuid := ctx.Param("suuid")
 	if suuid == "" {
-		log.Println("No suuid parameter provided")
+		ctx.Log.Error("No suuid parameter provided")
 		return fmt.Errorf("missing suuid parameter")
 	}
 
@@ -92,16 +94,18 @@ func StreamViewerWebsocket(ctx *hub.Ctx) error {
 	stream, ok := w.Streams[suuid]
 	w.RoomsLock.Unlock()
 	if !ok {
-		log.Printf("Stream with suuid %s not found", suuid)
+		ctx.Log.Errorf("Stream with suuid %s not found", suuid)
 		return fmt.Errorf("stream with suuid %s not found", suuid)
 	}
 
-	log.Printf("Starting viewer connection for stream %s", suuid)
-	viewerConn(ctx.WebSocket, stream.Peers)
+	withRoom(ctx, stream)
+	ctx.Log.Debug("Starting viewer connection for stream")
+	viewerConn(ctx, stream.Peers)
 	return nil
 }
 
-func viewerConn(c *websocket.Conn, p *w.Peers) {
+func viewerConn(ctx *hub.Ctx, p *w.Peers) {
+	c := ctx.WebSocket
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 	defer c.Close()
@@ -111,11 +115,11 @@ func viewerConn(c *websocket.Conn, p *w.Peers) {
 		case <-ticker.C:
 			writer, err := c.NextWriter(websocket.TextMessage)
 			if err != nil {
-				log.Printf("Error creating WebSocket writer: %v", err)
+				ctx.Log.Debugf("Error creating WebSocket writer: %v", err)
 				return
 			}
 			if _, err := writer.Write([]byte(fmt.Sprintf("%d", len(p.Connections)))); err != nil {
-				log.Printf("Error writing to WebSocket: %v", err)
+				ctx.Log.Errorf("Error writing to WebSocket: %v", err)
 				writer.Close()
 				return
 			}
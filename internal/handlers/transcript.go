@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/hub"
+	"time"
+)
+
+// RoomChatTranscript exports the recorded chat of a room for its hosts,
+// with attachment links on this server. It works after the meeting for
+// hosts by join token; hosts by host key lose it with the room.
+func RoomChatTranscript(ctx *hub.Ctx) error {
+	if !auth.FromContext(ctx.Request.Context()).Has(auth.GrantModerate) {
+		http.Error(ctx.Response, "only hosts can export the chat", http.StatusForbidden)
+		return nil
+	}
+	return writeTranscript(ctx, fmt.Sprintf("%s://%s", getProtocol(ctx.Request), ctx.Host()))
+}
+
+// AdminChatTranscript exports the recorded chat of any room. Attachment
+// links are prefixed with ?base=, the public address of the node.
+func AdminChatTranscript(ctx *hub.Ctx) error {
+	return writeTranscript(ctx, ctx.Request.URL.Query().Get("base"))
+}
+
+// writeTranscript serves the transcript selected by ?format= (json,
+// markdown or html, default markdown) and the RFC 3339 times ?from= and
+// ?to= as a download.
+func writeTranscript(ctx *hub.Ctx, baseURL string) error {
+	query := ctx.Request.URL.Query()
+	opts := chat.TranscriptOptions{Format: chat.FormatMarkdown, BaseURL: baseURL}
+	var err error
+	if s := query.Get("format"); s != "" {
+		if opts.Format, err = chat.ParseFormat(s); err != nil {
+			return writeJSON(ctx, http.StatusBadRequest, adminError{Error: err.Error()})
+		}
+	}
+	for name, t := range map[string]*time.Time{"from": &opts.From, "to": &opts.To} {
+		if s := query.Get(name); s != "" {
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				return writeJSON(ctx, http.StatusBadRequest, adminError{Error: fmt.Sprintf("%s must be an RFC 3339 time", name)})
+			}
+		}
+	}
+
+	// Render first, so a store error is still answered with a status.
+	room := ctx.Param("uuid")
+	var buf bytes.Buffer
+	if err := chat.WriteTranscript(&buf, room, opts); err != nil {
+		return writeAdminError(ctx, err)
+	}
+	header := ctx.Response.Header()
+	header.Set("Content-Type", chat.ContentType(opts.Format))
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "chat-" + room + "." + chat.Extension(opts.Format),
+	}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	_, err = buf.WriteTo(ctx.Response)
+	return err
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"pinzoom/pkg/hub"
+	"pinzoom/pkg/render"
+)
+
+// Views is the template registry shared by all page handlers.
+var Views *render.Registry
+
+func renderPage(ctx *hub.Ctx, page string, data interface{}) error {
+	return renderPageStatus(ctx, http.StatusOK, page, data)
+}
+
+func renderPageStatus(ctx *hub.Ctx, status int, page string, data interface{}) error {
+	ctx.Response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	ctx.Response.WriteHeader(status)
+	if err := Views.Render(ctx.Response, page, data); err != nil {
+		return fmt.Errorf("error rendering page %s, err=%v", page, err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/logger"
+	"pinzoom/pkg/router"
+	"pinzoom/pkg/tracing"
+	"strings"
+)
+
+// Validate parses the serve flags from args and checks them without
+// starting anything.
+func Validate(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	return validate()
+}
+
+func validate() error {
+	if *joinKey == "" {
+		*joinKey = os.Getenv("PINZOOM_JOIN_KEY")
+	}
+
+	var errs []error
+	if err := logger.Setup(*logFormat, *logLevel, *logLevels); err != nil {
+		errs = append(errs, fmt.Errorf("logging: %v", err))
+	}
+
+	switch *traceExporter {
+	case tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	case tracing.ExporterFile:
+		if *traceEndpoint == "" {
+			errs = append(errs, errors.New("-trace-exporter=file requires -trace-endpoint"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown trace exporter %q", *traceExporter))
+	}
+	if *traceSample < 0 || *traceSample > 1 {
+		errs = append(errs, fmt.Errorf("-trace-sample must be between 0 and 1, got %v", *traceSample))
+	}
+
+	if *drain <= 0 {
+		errs = append(errs, fmt.Errorf("-drain must be positive, got %s", *drain))
+	}
+	if (*cert == "") != (*key == "") {
+		errs = append(errs, errors.New("-cert and -key must be set together"))
+	} else if *cert != "" {
+		if _, err := tls.LoadX509KeyPair(*cert, *key); err != nil {
+			errs = append(errs, fmt.Errorf("error loading certificate, err=%v", err))
+		}
+	}
+
+	if *joinKey != "" && len(*joinKey) < auth.MinKeyLength {
+		errs = append(errs, fmt.Errorf("-join-key must be at least %d bytes", auth.MinKeyLength))
+	}
+	if *joinRequired && *joinKey == "" {
+		errs = append(errs, errors.New("-join-required requires -join-key"))
+	}
+
+	if *chatHistory < 0 {
+		errs = append(errs, fmt.Errorf("-chat-history must not be negative, got %d", *chatHistory))
+	}
+	if *chatHistoryAge <= 0 {
+		errs = append(errs, fmt.Errorf("-chat-history-age must be positive, got %s", *chatHistoryAge))
+	}
+	if *chatRetention < 0 {
+		errs = append(errs, fmt.Errorf("-chat-retention must not be negative, got %s", *chatRetention))
+	}
+	if *chatRate < 0 || *chatIPRate < 0 {
+		errs = append(errs, errors.New("-chat-rate and -chat-ip-rate must not be negative"))
+	}
+	if (*chatRate > 0 && *chatBurst < 1) || (*chatIPRate > 0 && *chatIPBurst < 1) {
+		errs = append(errs, errors.New("-chat-burst and -chat-ip-burst must be at least 1"))
+	}
+	if *chatStrikes < 0 {
+		errs = append(errs, fmt.Errorf("-chat-strikes must not be negative, got %d", *chatStrikes))
+	}
+	if *chatFilterAction != chat.FilterBlock && *chatFilterAction != chat.FilterFlag {
+		errs = append(errs, fmt.Errorf("unknown chat filter action %q, want block or flag", *chatFilterAction))
+	}
+	if *uploadMax <= 0 {
+		errs = append(errs, fmt.Errorf("-upload-max must be positive, got %d", *uploadMax))
+	}
+	if *uploadRoomQuota < 0 || *uploadOwnerQuota < 0 {
+		errs = append(errs, errors.New("-upload-room-quota and -upload-user-quota must not be negative"))
+	}
+	for _, t := range strings.Split(*uploadTypes, ",") {
+		if _, _, err := mime.ParseMediaType(strings.TrimSpace(t)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -upload-types entry %q, err=%v", t, err))
+		}
+	}
+
+	if *adminAddr == "" {
+		if *adminDebug {
+			errs = append(errs, errors.New("-admin-debug requires -admin-addr"))
+		}
+	} else if !strings.HasPrefix(*adminAddr, router.UnixPrefix) {
+		if _, _, err := net.SplitHostPort(*adminAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -admin-addr, err=%v", err))
+		}
+	}
+	if *adminPassword != "" && *adminUser == "" {
+		errs = append(errs, errors.New("-admin-password requires -admin-user"))
+	}
+	return errors.Join(errs...)
+}
@@ -2,79 +2,372 @@ package server
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"pinzoom/assets"
 	"pinzoom/internal/handlers"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/files"
+	"pinzoom/pkg/logger"
+	"pinzoom/pkg/metrics"
+	"pinzoom/pkg/render"
 	"pinzoom/pkg/router"
+	"pinzoom/pkg/tracing"
 	"pinzoom/pkg/webrtc"
+	"pinzoom/views"
+	"strings"
 	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 var (
-	cert = flag.String("cert", "", "")
-	key  = flag.String("key", "", "")
+	cert  = flag.String("cert", "", "")
+	key   = flag.String("key", "", "")
+	dev   = flag.Bool("dev", false, "serve views and assets from disk and reload templates on every request")
+	drain = flag.Duration("drain", 30*time.Second, "how long to wait for calls to end on shutdown")
+
+	adminAddr     = flag.String("admin-addr", "127.0.0.1:9090", "address of the admin listener serving metrics and the admin API, unix:<path> for a Unix socket, empty to disable")
+	adminToken    = flag.String("admin-token", "", "bearer token for the admin listener")
+	adminUser     = flag.String("admin-user", "", "basic auth user for the admin listener, empty to disable auth")
+	adminPassword = flag.String("admin-password", "", "basic auth password for the admin listener")
+	adminDebug    = flag.Bool("admin-debug", false, "serve pprof profiles and goroutine dumps on the admin listener")
+
+	joinKey      = flag.String("join-key", "", "HS256 key verifying join tokens, defaults to $PINZOOM_JOIN_KEY")
+	joinRequired = flag.Bool("join-required", false, "refuse rooms, streams and chat without a valid join token")
+
+	chatHistory    = flag.Int("chat-history", chat.DefaultHistorySize, "chat messages kept per room and replayed to new clients, 0 to disable")
+	chatHistoryAge = flag.Duration("chat-history-age", chat.DefaultHistoryAge, "how long chat messages are kept for replay")
+	chatStore      = flag.String("chat-store", "", "bbolt file recording the chat of every room, empty to keep it in memory only")
+	chatRetention  = flag.Duration("chat-retention", 30*24*time.Hour, "how long recorded chat is kept, 0 to keep it forever")
+
+	chatRate         = flag.Float64("chat-rate", chat.DefaultLimits.Rate, "chat messages per second a client may send, 0 for no limit")
+	chatBurst        = flag.Int("chat-burst", chat.DefaultLimits.Burst, "chat messages a client may send in a burst")
+	chatIPRate       = flag.Float64("chat-ip-rate", chat.DefaultLimits.IPRate, "chat messages per second all clients of an address may send, 0 for no limit; clients behind a proxy share its address")
+	chatIPBurst      = flag.Int("chat-ip-burst", chat.DefaultLimits.IPBurst, "chat messages all clients of an address may send in a burst")
+	chatStrikes      = flag.Int("chat-strikes", chat.DefaultLimits.Strikes, "warnings a chat client gets for spam or filtered messages before it is disconnected")
+	chatFilterWords  = flag.String("chat-filter-words", "", "comma separated words the chat filter matches")
+	chatFilterLinks  = flag.Bool("chat-filter-links", false, "make the chat filter match links")
+	chatFilterAction = flag.String("chat-filter-action", chat.FilterBlock, "what the chat filter does with matching messages, block or flag")
+
+	uploadDir        = flag.String("upload-dir", "", "directory storing files shared in chat, empty to disable uploads")
+	uploadMax        = flag.Int64("upload-max", files.DefaultMaxSize, "largest file accepted in chat, in bytes")
+	uploadTypes      = flag.String("upload-types", files.DefaultTypes, "comma separated MIME types accepted in chat")
+	uploadRoomQuota  = flag.Int64("upload-room-quota", files.DefaultRoomQuota, "bytes of files a room may store, 0 for no limit")
+	uploadOwnerQuota = flag.Int64("upload-user-quota", files.DefaultOwnerQuota, "bytes of files one person may store per room, 0 for no limit")
+
+	logFormat = flag.String("log-format", "text", "log format, text or json")
+	logLevel  = flag.String("log-level", "info", "default log level")
+	logLevels = flag.String("log-levels", "", "per subsystem log levels, e.g. router=debug,webrtc=warn,chat=info")
+
+	traceExporter = flag.String("trace-exporter", "none", "trace exporter: none, otlp, stdout or file")
+	traceEndpoint = flag.String("trace-endpoint", "", "OTLP/HTTP collector URL for the otlp exporter, output path for the file exporter")
+	traceSample   = flag.Float64("trace-sample", 1, "fraction of traces to sample")
 )
 
-func Run(ctx context.Context) error {
+var log = logger.For("server")
+
+// ErrDrainTimeout is returned by Run when calls were still running after the
+// drain period and had to be cut off.
+var ErrDrainTimeout = errors.New("drain period expired before all calls ended")
+
+// Run parses the serve flags from args and serves until ctx is cancelled.
+func Run(ctx context.Context, args []string) error {
 	if err := os.Setenv("ENVIRONMENT", "PRODUCTION"); err != nil {
 		return err
 	}
-	flag.Parse()
+	if err := Validate(args); err != nil {
+		return err
+	}
+	auth.Configure([]byte(*joinKey), *joinRequired)
+	chat.Configure(*chatHistory, *chatHistoryAge)
+	chat.ConfigureLimits(chat.Limits{
+		Rate:    *chatRate,
+		Burst:   *chatBurst,
+		IPRate:  *chatIPRate,
+		IPBurst: *chatIPBurst,
+		Strikes: *chatStrikes,
+	})
+	chat.ConfigureFilter(chat.Filter{
+		Words:  strings.Split(*chatFilterWords, ","),
+		Links:  *chatFilterLinks,
+		Action: *chatFilterAction,
+	})
+	store, err := chat.OpenStore(*chatStore)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Errorf("failed to close chat store, err=%v", err)
+		}
+	}()
+	chat.UseStore(store)
+
+	var uploads *files.Files
+	if *uploadDir != "" {
+		storage, err := files.NewDiskStorage(*uploadDir)
+		if err != nil {
+			return err
+		}
+		uploads = files.New(storage, *uploadMax, strings.Split(*uploadTypes, ","), files.Quota{
+			Room:  *uploadRoomQuota,
+			Owner: *uploadOwnerQuota,
+		})
+		handlers.Uploads = uploads
+		chat.UseAttachments(handlers.ChatAttachment)
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, *traceExporter, *traceEndpoint, *traceSample)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("failed to flush traces, err=%v", err)
+		}
+	}()
+
+	viewsFS, assetsFS := fs.FS(views.FS), fs.FS(assets.FS)
+	if *dev {
+		viewsFS, assetsFS = os.DirFS("views"), os.DirFS("assets")
+	}
+
+	static, err := router.NewAssets(assetsFS, *dev)
+	if err != nil {
+		return err
+	}
+	registry, err := render.New(viewsFS, *dev, static.FuncMap())
+	if err != nil {
+		return err
+	}
+	handlers.Views = registry
 
 	app := router.NewRouter()
 	app.Use(router.CORSMiddleware)
 	app.Use(router.ErrorMiddleware)
+	app.Use(router.MetricsMiddleware)
+	app.Use(router.LoggingMiddleware)
+	app.Use(router.TracingMiddleware)
 
+	app.Get("/healthz", handlers.Healthz)
+	app.Get("/readyz", handlers.Readyz)
 	app.Get("/", handlers.Welcome)
 	app.Get("/room/create", handlers.RoomCreate)
-	app.Get("/room/:uuid", handlers.Room)
-	app.Get("/room/:uuid/websocket", router.WebSocketHandler(router.WebSocketHandler{
+	app.Post("/room/create", handlers.RoomCreate)
+	app.Get("/room/:uuid", handlers.Authorize(auth.GrantPublish, handlers.Room))
+	app.Post("/room/:uuid/password", handlers.RoomPassword)
+	app.Post("/room/:uuid/host", handlers.RoomHost)
+	app.Get("/room/:uuid/websocket", handlers.Authorize(auth.GrantPublish, router.WebSocketHandler(router.WebSocketHandler{
 		Handler: handlers.RoomWebsocket,
-	}).ToHandlerFunc())
-	app.Get("/room/:uuid/chat", handlers.RoomChat)
-	app.Get("/room/:uuid/chat/websocket", router.WebSocketHandler(router.WebSocketHandler{
+	}).ToHandlerFunc()))
+	app.Get("/room/:uuid/chat", handlers.Authorize(auth.GrantChat, handlers.RoomChat))
+	app.Get("/room/:uuid/chat/transcript", handlers.Authorize(auth.GrantChat, handlers.RoomChatTranscript))
+	app.Get("/room/:uuid/chat/websocket", handlers.Authorize(auth.GrantChat, handlers.Admitted(router.WebSocketHandler(router.WebSocketHandler{
 		Handler:          handlers.RoomChatWebsocket,
 		HandshakeTimeout: 10 * time.Second,
-	}).ToHandlerFunc())
-	app.Get("/room/:uuid/viewer/websocket", router.WebSocketHandler(router.WebSocketHandler{
+	}).ToHandlerFunc())))
+	app.Post("/room/:uuid/files", handlers.Authorize(auth.GrantChat, handlers.Admitted(handlers.RoomUpload)))
+	app.Get("/room/:uuid/files/:id", handlers.Authorize(auth.GrantChat, handlers.Admitted(handlers.RoomFile)))
+	app.Get("/room/:uuid/files/:id/thumbnail", handlers.Authorize(auth.GrantChat, handlers.Admitted(handlers.RoomFileThumbnail)))
+	app.Get("/room/:uuid/viewer/websocket", handlers.Authorize(auth.GrantSubscribe, router.WebSocketHandler(router.WebSocketHandler{
 		Handler: handlers.RoomViewerWebsocket,
-	}).ToHandlerFunc())
-	app.Get("/stream/:suuid", router.WebSocketHandler(router.WebSocketHandler{
-		Handler: handlers.Stream,
-	}).ToHandlerFunc())
-	app.Get("/stream/:suuid/websocket", router.WebSocketHandler(router.WebSocketHandler{
+	}).ToHandlerFunc()))
+	app.Get("/stream/:suuid", handlers.Authorize(auth.GrantSubscribe, handlers.Stream))
+	app.Post("/stream/:suuid/password", handlers.StreamPassword)
+	app.Get("/stream/:suuid/websocket", handlers.Authorize(auth.GrantSubscribe, handlers.StreamAdmitted(router.WebSocketHandler(router.WebSocketHandler{
 		Handler:          handlers.StreamWebsocket,
 		HandshakeTimeout: 10 * time.Second,
-	}).ToHandlerFunc())
-	app.Get("/stream/:suuid/chat/websocket", router.WebSocketHandler(router.WebSocketHandler{
+	}).ToHandlerFunc())))
+	app.Get("/stream/:suuid/chat/websocket", handlers.Authorize(auth.GrantChat, handlers.StreamAdmitted(router.WebSocketHandler(router.WebSocketHandler{
 		Handler: handlers.StreamChatWebsocket,
-	}).ToHandlerFunc())
-	app.Get("/stream/:suuid/viewer/websocket", router.WebSocketHandler(router.WebSocketHandler{
+	}).ToHandlerFunc())))
+	app.Get("/stream/:suuid/viewer/websocket", handlers.Authorize(auth.GrantSubscribe, router.WebSocketHandler(router.WebSocketHandler{
 		Handler: handlers.StreamViewerWebsocket,
-	}).ToHandlerFunc())
-	app.Static("./assets")
+	}).ToHandlerFunc()))
+	app.Static(static)
+
+	// Listeners are closed on return as well, so a Unix socket is removed
+	// before the process exits.
+	listener, err := router.Listen(":8080")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	var admin *router.Router
+	var adminListener net.Listener
+	if *adminAddr != "" {
+		if adminListener, err = router.Listen(*adminAddr); err != nil {
+			return err
+		}
+		defer adminListener.Close()
+		admin = adminRouter(static)
+	}
+
+	handlers.ReadinessChecks = []handlers.ReadinessCheck{
+		{Name: "listener", Check: func(context.Context) error {
+			if !app.Listening() {
+				return errors.New("not accepting connections")
+			}
+			return nil
+		}},
+		{Name: "draining", Check: func(context.Context) error {
+			if webrtc.Draining() {
+				return webrtc.ErrDraining
+			}
+			return nil
+		}},
+		{Name: "turn", Check: webrtc.TURNStatus},
+	}
 
 	webrtc.Rooms = make(map[string]*webrtc.Room)
 	webrtc.Streams = make(map[string]*webrtc.Room)
-	go dispatchKeyFrames()
+	go dispatchKeyFrames(ctx)
+	if *chatRetention > 0 {
+		go pruneChat(ctx, store, uploads, *chatRetention)
+	}
+	go webrtc.Stats.Run(ctx)
+	go webrtc.MonitorTURN(ctx, webrtc.TURNCheckInterval)
 
 	go func() {
-		if err := app.ListenAndServe(":8080"); err != nil {
-			logrus.Error(err)
+		if err := app.ServeListener(ctx, listener); err != nil {
+			log.Error(err)
 		}
 	}()
+	// The admin listener outlives ctx so metrics and /readyz, which answers
+	// 503 by then, stay reachable until the drain has finished.
+	adminCtx, stopAdmin := context.WithCancel(context.Background())
+	defer stopAdmin()
+	if admin != nil {
+		go func() {
+			if err := admin.ServeListener(adminCtx, adminListener); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
 
 	<-ctx.Done()
 
+	return shutdown(*drain)
+}
+
+// adminRouter serves metrics, stats and, when credentials are set, the room
+// management API and, unless only a bearer token is set, the dashboard,
+// plus pprof and goroutine dumps when -admin-debug is set.
+func adminRouter(static *router.Assets) *router.Router {
+	admin := router.NewRouter()
+	admin.Use(router.SameOriginMiddleware)
+	admin.Use(router.ErrorMiddleware)
+	admin.Use(router.AuthMiddleware(*adminToken, *adminUser, *adminPassword))
+	admin.Get("/healthz", handlers.Healthz)
+	admin.Get("/readyz", handlers.Readyz)
+	admin.Get("/metrics", router.HTTPHandler(metrics.Handler()))
+	admin.Get("/api/stats", handlers.Stats)
+	admin.Get("/api/stats/:uuid", handlers.RoomStats)
+
+	// A Unix socket is only reachable by its owner, which stands in for
+	// credentials.
+	if *adminToken != "" || *adminUser != "" || strings.HasPrefix(*adminAddr, router.UnixPrefix) {
+		admin.Get("/api/rooms", handlers.AdminRooms)
+		admin.Get("/api/rooms/:uuid", handlers.AdminRoom)
+		admin.Delete("/api/rooms/:uuid", handlers.AdminCloseRoom)
+		admin.Post("/api/rooms/:uuid/settings", handlers.AdminRoomSettings)
+		admin.Delete("/api/rooms/:uuid/participants/:participant", handlers.AdminKick)
+		admin.Post("/api/rooms/:uuid/messages", handlers.AdminBroadcast)
+		admin.Get("/api/rooms/:uuid/chat", handlers.AdminChatHistory)
+		admin.Delete("/api/rooms/:uuid/chat/:message", handlers.AdminDeleteMessage)
+		admin.Get("/api/rooms/:uuid/chat/transcript", handlers.AdminChatTranscript)
+		admin.Get("/api/rooms/:uuid/files/:id", handlers.AdminFile)
+
+		// Browsers can't send a bearer token, so the dashboard needs basic
+		// auth, or no credentials at all on a Unix socket.
+		if *adminUser != "" || *adminToken == "" {
+			admin.Get("/admin", handlers.AdminDashboard)
+			admin.Get("/admin/websocket", router.WebSocketHandler(router.WebSocketHandler{
+				Handler: handlers.AdminWebsocket,
+			}).ToHandlerFunc())
+			admin.Get("/admin/rooms/:uuid", handlers.AdminRoomPage)
+			admin.Get("/admin/rooms/:uuid/websocket", router.WebSocketHandler(router.WebSocketHandler{
+				Handler: handlers.AdminRoomWebsocket,
+			}).ToHandlerFunc())
+			admin.Static(static)
+		} else {
+			log.Warn("Admin dashboard disabled, browsers can't send -admin-token, set -admin-user and -admin-password to enable it")
+		}
+	} else {
+		log.Warn("Room management API and dashboard disabled, set -admin-token or -admin-user or listen on a Unix socket to enable them")
+	}
+
+	if *adminDebug {
+		admin.Get("/debug/goroutines", handlers.Goroutines)
+		admin.Get("/debug/pprof/", router.HTTPHandler(http.HandlerFunc(pprof.Index)))
+		admin.Get("/debug/pprof/cmdline", router.HTTPHandler(http.HandlerFunc(pprof.Cmdline)))
+		admin.Get("/debug/pprof/profile", router.HTTPHandler(http.HandlerFunc(pprof.Profile)))
+		admin.Get("/debug/pprof/symbol", router.HTTPHandler(http.HandlerFunc(pprof.Symbol)))
+		admin.Get("/debug/pprof/trace", router.HTTPHandler(http.HandlerFunc(pprof.Trace)))
+		admin.Get("/debug/pprof/:profile", router.HTTPHandler(http.HandlerFunc(pprof.Index)))
+	}
+	return admin
+}
+
+// shutdown lets running calls end within the drain period, then closes all
+// PeerConnections and chat hubs.
+func shutdown(timeout time.Duration) error {
+	log.Infof("Draining rooms for up to %s", timeout)
+	drained := webrtc.Drain(timeout)
+	webrtc.Shutdown()
+	if !drained {
+		return ErrDrainTimeout
+	}
 	return nil
 }
 
-func dispatchKeyFrames() {
-	for range time.NewTicker(time.Second * 3).C {
-		for _, room := range webrtc.Rooms {
-			room.Peers.DispatchKeyFrame()
+// pruneChat deletes recorded chat and shared files older than retention,
+// at start and then hourly.
+func pruneChat(ctx context.Context, store chat.Store, uploads *files.Files, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		before := time.Now().Add(-retention)
+		n, err := store.Prune(before)
+		if err != nil {
+			log.Errorf("failed to prune chat store, err=%v", err)
+		} else if n > 0 {
+			log.Infof("Pruned %d chat messages older than %s", n, retention)
+		}
+		if uploads != nil {
+			n, err := uploads.Prune(before)
+			if err != nil {
+				log.Errorf("failed to prune uploaded files, err=%v", err)
+			} else if n > 0 {
+				log.Infof("Pruned %d uploaded files older than %s", n, retention)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func dispatchKeyFrames(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			webrtc.RoomsLock.RLock()
+			for _, room := range webrtc.Rooms {
+				room.Peers.DispatchKeyFrame()
+			}
+			webrtc.RoomsLock.RUnlock()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -0,0 +1,161 @@
+// Package auth verifies the join tokens that grant access to rooms. Tokens
+// are HS256 JWTs signed with the key shared between pinzoom and the backend
+// that decides who joins what.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Grant is a permission carried by a join token.
+type Grant string
+
+const (
+	GrantPublish   Grant = "publish"
+	GrantSubscribe Grant = "subscribe"
+	GrantChat      Grant = "chat"
+	GrantModerate  Grant = "moderate"
+)
+
+// MinKeyLength is the shortest signing key accepted, as HS256 is only as
+// strong as its key.
+const MinKeyLength = 32
+
+var (
+	ErrNoKey         = errors.New("no join token signing key configured")
+	ErrTokenRequired = errors.New("join token required")
+	ErrInvalidToken  = errors.New("invalid join token")
+	ErrWrongRoom     = errors.New("join token is for another room")
+	ErrMissingGrant  = errors.New("join token does not grant this")
+)
+
+// Claims of a join token. The subject is the identity of the user in the
+// embedding product.
+type Claims struct {
+	Name   string  `json:"name,omitempty"`
+	Room   string  `json:"room"`
+	Grants []Grant `json:"grants"`
+	jwt.RegisteredClaims
+}
+
+// Has reports whether the claims carry grant.
+func (c *Claims) Has(grant Grant) bool {
+	for _, g := range c.Grants {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	mu       sync.RWMutex
+	key      []byte
+	required bool
+)
+
+// Configure sets the signing key and whether requests without a token are
+// refused. Without a required token, anonymous users may publish, subscribe
+// and chat, as before tokens existed.
+func Configure(signingKey []byte, require bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	key, required = signingKey, require
+}
+
+// Sign issues a token for claims with the configured key.
+func Sign(claims Claims) (string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return SignWith(key, claims)
+}
+
+// SignWith issues a token for claims with the given key.
+func SignWith(signingKey []byte, claims Claims) (string, error) {
+	if len(signingKey) == 0 {
+		return "", ErrNoKey
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString(signingKey)
+}
+
+// Parse verifies the signature and expiry of a token.
+func Parse(token string) (*Claims, error) {
+	mu.RLock()
+	signingKey := key
+	mu.RUnlock()
+	if len(signingKey) == 0 {
+		return nil, ErrNoKey
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return signingKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithExpirationRequired(), jwt.WithLeeway(30*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+// Authorize checks the token of a request, taken from the token query
+// parameter (browsers can't set headers on websockets) or a bearer
+// Authorization header, against a room and the grant the request needs.
+func Authorize(r *http.Request, room string, grant Grant) (*Claims, error) {
+	token := Token(r)
+	if token == "" {
+		mu.RLock()
+		require := required
+		mu.RUnlock()
+		if require {
+			return nil, ErrTokenRequired
+		}
+		return &Claims{Room: room, Grants: []Grant{GrantPublish, GrantSubscribe, GrantChat}}, nil
+	}
+
+	claims, err := Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Room != room {
+		return nil, ErrWrongRoom
+	}
+	if !claims.Has(grant) {
+		return nil, ErrMissingGrant
+	}
+	return claims, nil
+}
+
+// Token returns the join token sent with a request, if any.
+func Token(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return bearer
+	}
+	return ""
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a context carrying the claims a request was
+// authorized with.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims stored by WithClaims, or empty claims.
+func FromContext(ctx context.Context) *Claims {
+	if claims, ok := ctx.Value(claimsKey{}).(*Claims); ok {
+		return claims
+	}
+	return &Claims{}
+}
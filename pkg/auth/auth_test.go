@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	testKey  = []byte(strings.Repeat("k", MinKeyLength))
+	otherKey = []byte(strings.Repeat("o", MinKeyLength))
+)
+
+// configure sets the signing key for the length of a test.
+func configure(t *testing.T, signingKey []byte, require bool) {
+	Configure(signingKey, require)
+	t.Cleanup(func() { Configure(nil, false) })
+}
+
+func claimsFor(room string, expires time.Duration, grants ...Grant) Claims {
+	return Claims{
+		Room:   room,
+		Grants: grants,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "user",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
+		},
+	}
+}
+
+func mustSign(t *testing.T, signingKey []byte, claims Claims) string {
+	t.Helper()
+	token, err := SignWith(signingKey, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestParse(t *testing.T) {
+	configure(t, testKey, false)
+	valid := claimsFor("room", time.Minute, GrantChat)
+	noExpiry := valid
+	noExpiry.ExpiresAt = nil
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, &valid).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs512, err := jwt.NewWithClaims(jwt.SigningMethodHS512, &valid).SignedString(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := mustSign(t, testKey, valid)
+	other := mustSign(t, testKey, claimsFor("other", time.Minute, GrantModerate))
+	tampered := other[:strings.LastIndex(other, ".")] + token[strings.LastIndex(token, "."):]
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", token, nil},
+		{"within leeway", mustSign(t, testKey, claimsFor("room", -10*time.Second)), nil},
+		{"other key", mustSign(t, otherKey, valid), ErrInvalidToken},
+		{"tampered", tampered, ErrInvalidToken},
+		{"expired", mustSign(t, testKey, claimsFor("room", -time.Minute)), ErrInvalidToken},
+		{"no expiry", mustSign(t, testKey, noExpiry), ErrInvalidToken},
+		{"alg none", none, ErrInvalidToken},
+		{"other method", hs512, ErrInvalidToken},
+		{"garbage", "not.a.token", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Parse(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Parse = %v, want %v", err, tt.want)
+			}
+			if err == nil && (claims.Room != "room" || claims.Subject != "user") {
+				t.Errorf("Parse = %+v, want the signed claims", claims)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	chat := mustSign(t, testKey, claimsFor("room", time.Minute, GrantChat, GrantSubscribe))
+	tests := []struct {
+		name     string
+		key      []byte
+		required bool
+		token    string
+		room     string
+		grant    Grant
+		want     error
+	}{
+		{name: "token", key: testKey, token: chat, room: "room", grant: GrantChat},
+		{name: "other room", key: testKey, token: chat, room: "other", grant: GrantChat, want: ErrWrongRoom},
+		{name: "missing grant", key: testKey, token: chat, room: "room", grant: GrantPublish, want: ErrMissingGrant},
+		{name: "invalid token", key: otherKey, token: chat, room: "room", grant: GrantChat, want: ErrInvalidToken},
+		{name: "token without key", token: chat, room: "room", grant: GrantChat, want: ErrNoKey},
+		{name: "anonymous", key: testKey, room: "room", grant: GrantPublish},
+		{name: "anonymous without key", room: "room", grant: GrantChat},
+		{name: "anonymous moderator", key: testKey, room: "room", grant: GrantModerate},
+		{name: "token required", key: testKey, required: true, room: "room", grant: GrantChat, want: ErrTokenRequired},
+		{name: "required token", key: testKey, required: true, token: chat, room: "room", grant: GrantChat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configure(t, tt.key, tt.required)
+			r := httptest.NewRequest(http.MethodGet, "/room/room", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			claims, err := Authorize(r, tt.room, tt.grant)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Authorize = %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if claims.Room != tt.room {
+				t.Errorf("claims room = %q, want %q", claims.Room, tt.room)
+			}
+			// Anonymous users may take part but never moderate.
+			if tt.token == "" && (claims.Has(GrantModerate) || claims.Subject != "" ||
+				!claims.Has(GrantPublish) || !claims.Has(GrantSubscribe) || !claims.Has(GrantChat)) {
+				t.Errorf("anonymous claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   string
+	}{
+		{"none", "/", "", ""},
+		{"query", "/?token=q", "", "q"},
+		{"bearer", "/", "Bearer b", "b"},
+		{"query first", "/?token=q", "Bearer b", "q"},
+		{"other scheme", "/", "Basic b", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := Token(r); got != tt.want {
+				t.Errorf("Token = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	configure(t, nil, false)
+	if _, err := Sign(claimsFor("room", time.Minute)); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Sign without key = %v, want %v", err, ErrNoKey)
+	}
+	configure(t, testKey, false)
+	token, err := Sign(claimsFor("room", time.Minute, GrantChat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := Parse(token); err != nil || !claims.Has(GrantChat) || claims.Has(GrantModerate) {
+		t.Errorf("Parse(Sign) = %+v, %v", claims, err)
+	}
+}
@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"pinzoom/pkg/logger"
+	"sync"
+	"time"
+)
+
+// DefaultWriteBuffer is how many writes an AsyncStore queues before
+// Append and Update wait for the disk.
+const DefaultWriteBuffer = 1024
+
+// AsyncStore writes appends and updates to a Store in the background, so a
+// hub loop never waits on the disk. Get sees queued writes, List and Prune
+// wait until the writes queued before them are done.
+type AsyncStore struct {
+	store Store
+	queue chan write
+	done  chan struct{}
+
+	// closeMu keeps Close from closing the queue under a waiting enqueue.
+	closeMu sync.RWMutex
+	closed  bool
+
+	mu      sync.RWMutex
+	pending map[pendingKey]*Message
+}
+
+type write struct {
+	room    string
+	message *Message
+	update  bool
+	// flushed is closed once the writes queued before it are done.
+	flushed chan struct{}
+}
+
+type pendingKey struct {
+	room, id string
+}
+
+// NewAsyncStore starts writing to s with room for buffer queued writes.
+func NewAsyncStore(s Store, buffer int) *AsyncStore {
+	a := &AsyncStore{
+		store:   s,
+		queue:   make(chan write, buffer),
+		done:    make(chan struct{}),
+		pending: make(map[pendingKey]*Message),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncStore) run() {
+	defer close(a.done)
+	for w := range a.queue {
+		if w.flushed != nil {
+			close(w.flushed)
+			continue
+		}
+		var err error
+		if w.update {
+			err = a.store.Update(w.room, w.message)
+		} else {
+			err = a.store.Append(w.room, w.message)
+		}
+		if err != nil {
+			log.WithField(logger.FieldRoom, w.room).Errorf("failed to store chat message, err=%v", err)
+		}
+
+		key := pendingKey{w.room, w.message.ID}
+		a.mu.Lock()
+		if a.pending[key] == w.message {
+			delete(a.pending, key)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// enqueue hands a write to the writer. It only waits when the queue is
+// full.
+func (a *AsyncStore) enqueue(w write) error {
+	a.closeMu.RLock()
+	defer a.closeMu.RUnlock()
+	if a.closed {
+		return ErrStoreClosed
+	}
+	a.queue <- w
+	return nil
+}
+
+func (a *AsyncStore) queueMessage(room string, m *Message, update bool) error {
+	// The message is pending before it is queued, so the writer never
+	// finishes it before it shows up here.
+	key := pendingKey{room, m.ID}
+	a.mu.Lock()
+	a.pending[key] = m
+	a.mu.Unlock()
+	if err := a.enqueue(write{room: room, message: m, update: update}); err != nil {
+		a.mu.Lock()
+		delete(a.pending, key)
+		a.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (a *AsyncStore) Append(room string, m *Message) error {
+	return a.queueMessage(room, m, false)
+}
+
+// Update queues the new version of a message. An update of a message that
+// is not recorded is only reported in the log.
+func (a *AsyncStore) Update(room string, m *Message) error {
+	return a.queueMessage(room, m, true)
+}
+
+func (a *AsyncStore) Get(room, id string) (*Message, error) {
+	a.mu.RLock()
+	m, ok := a.pending[pendingKey{room, id}]
+	a.mu.RUnlock()
+	if ok {
+		return m, nil
+	}
+	return a.store.Get(room, id)
+}
+
+func (a *AsyncStore) List(room string, q Query) ([]*Message, error) {
+	if err := a.Flush(); err != nil {
+		return nil, err
+	}
+	return a.store.List(room, q)
+}
+
+func (a *AsyncStore) Prune(t time.Time) (int, error) {
+	if err := a.Flush(); err != nil {
+		return 0, err
+	}
+	return a.store.Prune(t)
+}
+
+// Flush waits until the writes queued so far are done.
+func (a *AsyncStore) Flush() error {
+	flushed := make(chan struct{})
+	if err := a.enqueue(write{flushed: flushed}); err != nil {
+		return err
+	}
+	<-flushed
+	return nil
+}
+
+// Close writes what is queued and closes the underlying store.
+func (a *AsyncStore) Close() error {
+	a.closeMu.Lock()
+	if a.closed {
+		a.closeMu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.queue)
+	a.closeMu.Unlock()
+	<-a.done
+	return a.store.Close()
+}
@@ -0,0 +1,39 @@
+package chat
+
+// Attachment is a file shared in a message. The file itself is uploaded
+// over HTTP first; the message only references it.
+type Attachment struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// URL downloads the file and Thumbnail, when set, a small JPEG
+	// preview of an image.
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// AttachmentLookup resolves the attachment a client of room refers to,
+// checking the client uploaded it there.
+type AttachmentLookup func(room, id, sender string) (*Attachment, error)
+
+var attachments AttachmentLookup
+
+// UseAttachments lets chat clients reference files resolved by lookup.
+// Without it, messages with attachments are rejected.
+func UseAttachments(lookup AttachmentLookup) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	attachments = lookup
+}
+
+// attachment resolves the attachment ID a client sent.
+func (c *Client) attachment(id string) (*Attachment, error) {
+	configMu.RLock()
+	lookup := attachments
+	configMu.RUnlock()
+	if lookup == nil {
+		return nil, ErrNoAttachments
+	}
+	return lookup(c.Hub.room, id, c.ID)
+}
@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// roomsBucket holds a bucket per room, keyed by message ID. IDs are time
+// ordered, so the cursor order is the chat order.
+var roomsBucket = []byte("rooms")
+
+// BoltStore keeps the messages in a bbolt file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the store at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening chat store %s, err=%v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roomsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing chat store %s, err=%v", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Append(room string, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(roomsBucket).CreateBucketIfNotExists([]byte(room))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(m.ID), data)
+	})
+}
+
+func (s *BoltStore) Get(room, id string) (*Message, error) {
+	var m *Message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(roomsBucket).Bucket([]byte(room))
+		if b == nil {
+			return ErrMessageNotFound
+		}
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrMessageNotFound
+		}
+		var err error
+		m, err = decodeMessage(data)
+		return err
+	})
+	return m, err
+}
+
+func (s *BoltStore) Update(room string, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(roomsBucket).Bucket([]byte(room))
+		if b == nil || b.Get([]byte(m.ID)) == nil {
+			return ErrMessageNotFound
+		}
+		return b.Put([]byte(m.ID), data)
+	})
+}
+
+func (s *BoltStore) List(room string, q Query) ([]*Message, error) {
+	messages := []*Message{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(roomsBucket).Bucket([]byte(room))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		full := func() bool { return q.Limit > 0 && len(messages) >= q.Limit }
+
+		if q.After != "" {
+			k, v := c.Seek([]byte(q.After))
+			if k != nil && string(k) == q.After {
+				k, v = c.Next()
+			}
+			for ; k != nil && !full(); k, v = c.Next() {
+				if q.Before != "" && string(k) >= q.Before {
+					break
+				}
+				m, err := decodeMessage(v)
+				if err != nil {
+					return err
+				}
+				messages = append(messages, m)
+			}
+			return nil
+		}
+
+		k, v := c.Last()
+		if q.Before != "" {
+			if k, v = c.Seek([]byte(q.Before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && !full(); k, v = c.Prev() {
+			m, err := decodeMessage(v)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, m)
+		}
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+		return nil
+	})
+	return messages, err
+}
+
+func (s *BoltStore) Prune(t time.Time) (int, error) {
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Buckets must not change while they are iterated, so collect
+		// the keys first.
+		rooms := tx.Bucket(roomsBucket)
+		var names [][]byte
+		if err := rooms.ForEach(func(room, _ []byte) error {
+			names = append(names, room)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, room := range names {
+			b := rooms.Bucket(room)
+			var expired [][]byte
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				m, err := decodeMessage(v)
+				if err != nil {
+					return err
+				}
+				if !m.Time.Before(t) {
+					break
+				}
+				expired = append(expired, k)
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			pruned += len(expired)
+			if k, _ := b.Cursor().First(); k == nil {
+				if err := rooms.DeleteBucket(room); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func decodeMessage(data []byte) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error decoding chat message, err=%v", err)
+	}
+	return &m, nil
+}
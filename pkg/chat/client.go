@@ -1,51 +1,202 @@
 package chat
 
 import (
-	"bytes"
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"pinzoom/pkg/hub"
+	"pinzoom/pkg/logger"
+	"pinzoom/pkg/metrics"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 4096
+	// maxBodyLength bounds the runes of a message body.
+	maxBodyLength = 512
 )
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-)
+// Member is who a chat client speaks for.
+type Member struct {
+	// ID is the public participant ID messages are sent under and Name
+	// the display name, empty for anonymous clients.
+	ID   string
+	Name string
+	// Identity is the private identity of the person behind the client,
+	// shared by all its tabs. Direct messages reach every client of the
+	// identity they are sent to.
+	Identity string
+	// Participant is set for participants of the call, whom anyone may
+	// message directly; other clients only get direct messages from
+	// moderators.
+	Participant bool
+	// Moderator tells whether the client may moderate the chat. It is
+	// asked on every request, as hosts change during a call.
+	Moderator func() bool
+}
 
 type Client struct {
+	Member
 	Hub  *Hub
 	Conn *websocket.Conn
-	Send chan []byte
+	Send chan *Message
+
+	// after is the newest message ID or revision the client has seen
+	// before it reconnected; only newer messages and changes are
+	// replayed.
+	after string
+	// author is the author key of the member in the room of the hub.
+	author  string
+	limiter *limiter
+	// kicked is set when the client is disconnected for its offenses; the
+	// write pump then closes the connection once the notice is out.
+	kicked bool
+	log    *logrus.Entry
+}
+
+func (m Member) isModerator() bool {
+	return m.Moderator != nil && m.Moderator()
+}
+
+// authorKey is the public key of an identity in a room. It tells that
+// messages and reactions came from the same person across reconnects,
+// without giving the identity away or matching it across rooms.
+func authorKey(room, identity string) string {
+	sum := sha256.Sum256([]byte("author:" + room + ":" + identity))
+	return hex.EncodeToString(sum[:16])
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.Hub.unregister <- c
-		c.Conn.Close()
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.quit:
+		}
+		if !c.kicked {
+			c.Conn.Close()
+		}
 	}()
 	c.Conn.SetReadLimit(maxMessageSize)
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		_, raw, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.log.Errorf("chat websocket closed unexpectedly, err=%v", err)
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.Hub.broadcast <- message
+		var in incoming
+		err = json.Unmarshal(raw, &in)
+		now := time.Now()
+		if err == nil && isSignal(in.Type) {
+			if c.limiter.signals.take(now) {
+				c.signal(in)
+			}
+			continue
+		}
+		if offense := c.limiter.allow(now); offense != "" {
+			if c.offend(offense, now) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			c.log.Debugf("dropped malformed chat message, err=%v", err)
+			continue
+		}
+		if in.Type != "" && in.Type != TypeText {
+			if c.request(in, now) {
+				return
+			}
+			continue
+		}
+		body := strings.TrimSpace(in.Body)
+		if body == "" && in.Attachment == "" {
+			continue
+		}
+		if runes := []rune(body); len(runes) > maxBodyLength {
+			body = string(runes[:maxBodyLength])
+		}
+
+		message := NewMessage(TypeText, body)
+		if in.Parent != "" {
+			if _, err := c.Hub.store.Get(c.Hub.room, in.Parent); err != nil {
+				c.Hub.sendTo(c, event(EventRejected, ReasonInvalid))
+				continue
+			}
+			message.Parent = in.Parent
+		}
+		if in.Attachment != "" {
+			if message.Attachment, err = c.attachment(in.Attachment); err != nil {
+				c.log.Debugf("refused chat attachment %s, err=%v", in.Attachment, err)
+				c.Hub.sendTo(c, event(EventRejected, ReasonInvalid))
+				continue
+			}
+		}
+		if !c.isModerator() && body != "" {
+			if c.limiter.duplicate(body, now) {
+				if c.offend(OffenseDuplicate, now) {
+					return
+				}
+				continue
+			}
+			switch filtered(body) {
+			case FilterBlock:
+				if c.offend(OffenseFilter, now) {
+					return
+				}
+				continue
+			case FilterFlag:
+				message.Flagged = true
+				metrics.ChatModeration.WithLabelValues("flagged", OffenseFilter).Inc()
+			}
+		}
+		if reason := c.Hub.admit(c); reason != "" {
+			c.Hub.sendTo(c, event(EventRejected, reason))
+			continue
+		}
+
+		message.Sender = c.ID
+		message.Name = c.Name
+		message.Author = c.author
+		metrics.ChatMessages.Inc()
+		if in.To != "" {
+			message.To = in.To
+			message.from = c
+			message.fromModerator = c.isModerator()
+		}
+		c.Hub.Broadcast(message)
+	}
+}
+
+// offend refuses a message for an offense and warns the client, or
+// disconnects it once its warnings are used up and reports true.
+func (c *Client) offend(offense string, now time.Time) bool {
+	metrics.ChatModeration.WithLabelValues("blocked", offense).Inc()
+	if !c.limiter.strike(now) {
+		metrics.ChatModeration.WithLabelValues("warned", offense).Inc()
+		c.Hub.sendTo(c, event(EventWarning, offense))
+		return false
 	}
+	metrics.ChatModeration.WithLabelValues("disconnected", offense).Inc()
+	c.log.WithField("offense", offense).Warn("chat client disconnected for its offenses")
+	ban(c.Identity, offense)
+	c.Hub.sendTo(c, event(EventDisconnected, offense))
+	c.kicked = true
+	return true
 }
+
+// writePump sends every message as its own websocket message, so bodies
+// may contain anything, newlines included.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -57,19 +208,10 @@ func (c *Client) writePump() {
 		case message, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.Send)
-			}
-			if err := w.Close(); err != nil {
+			if err := c.Conn.WriteJSON(message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -80,9 +222,48 @@ func (c *Client) writePump() {
 		}
 	}
 }
-func PeerChatConn(c *websocket.Conn, hub *Hub) {
-	client := &Client{Hub: hub, Conn: c, Send: make(chan []byte, 256)}
-	client.Hub.register <- client
-	go client.writePump()
+
+// PeerChatConn serves the chat websocket of ctx for member. The client
+// first gets the history of the hub, or with ?after=<message ID or
+// revision> only the messages and changes it missed.
+func PeerChatConn(ctx *hub.Ctx, h *Hub, member Member) {
+	c := ctx.WebSocket
+	if member.Identity == "" {
+		member.Identity = "anonymous:" + member.ID
+	}
+	if offense, ok := banned(member.Identity); ok {
+		ctx.Log.Info("refused chat client of a disconnected offender")
+		c.WriteJSON(event(EventDisconnected, offense))
+		c.Close()
+		return
+	}
+	ip := remoteIP(ctx.Request.RemoteAddr)
+	client := &Client{
+		Member:  member,
+		Hub:     h,
+		Conn:    c,
+		Send:    make(chan *Message, h.sendBuffer()),
+		after:   ctx.Request.URL.Query().Get("after"),
+		author:  authorKey(h.room, member.Identity),
+		limiter: newLimiter(ip),
+		log:     logger.Into("chat", ctx.Log).WithField(logger.FieldParticipant, member.ID),
+	}
+	select {
+	case client.Hub.register <- client:
+	case <-client.Hub.quit:
+		c.Close()
+		return
+	}
+	client.log.Info("chat client connected")
+	written := make(chan struct{})
+	go func() {
+		client.writePump()
+		close(written)
+	}()
 	client.readPump()
+	// The connection is closed when we return, so let a kicked client get
+	// its notice first.
+	if client.kicked {
+		<-written
+	}
 }
@@ -0,0 +1,47 @@
+package chat
+
+// direct delivers a direct message to the clients of its recipient and its
+// sender, and keeps it in the history for them. Anyone may write to a
+// participant of the call, only moderators to other clients.
+func (h *Hub) direct(m *Message) {
+	sender := m.from
+	m.from = nil
+	reject := func(reason string) {
+		if h.clients[sender] {
+			select {
+			case sender.Send <- event(EventRejected, reason):
+			default:
+			}
+		}
+	}
+
+	var recipient *Client
+	for client := range h.clients {
+		if client.ID == m.To {
+			recipient = client
+			break
+		}
+	}
+	if recipient == nil {
+		reject(ReasonUnknownRecipient)
+		return
+	}
+	if !recipient.Participant && !m.fromModerator {
+		reject(ReasonForbidden)
+		return
+	}
+
+	m.fromIdentity, m.toIdentity = sender.Identity, recipient.Identity
+	h.history.add(m)
+	for client := range h.clients {
+		if !m.visibleTo(client) {
+			continue
+		}
+		select {
+		case client.Send <- m:
+		default:
+			close(client.Send)
+			delete(h.clients, client)
+		}
+	}
+}
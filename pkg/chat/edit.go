@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"pinzoom/pkg/logger"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// EditWindow is how long senders may edit their messages.
+	EditWindow = 15 * time.Minute
+	// maxReactions bounds the distinct emoji reacted to a message.
+	maxReactions = 20
+	// maxEmojiLength bounds the runes of one reaction, enough for emoji
+	// joined into one.
+	maxEmojiLength = 8
+)
+
+// change is a request of a client to change a message. The hub applies
+// changes one at a time, so concurrent reactions are not lost.
+type change struct {
+	client  *Client
+	typ     MessageType
+	id      string
+	body    string
+	flagged bool
+	// stored is the message as the store had it when the client asked,
+	// looked up before the change reaches the hub; the hub prefers the
+	// version in its history.
+	stored *Message
+}
+
+// request handles anything but text sent by c: changes to messages go to
+// the hub, the rest is moderation. It reports true when c was disconnected
+// for an offense.
+func (c *Client) request(in incoming, now time.Time) bool {
+	ch := change{client: c, typ: in.Type, id: in.Data}
+	switch in.Type {
+	case RequestDelete:
+		if c.isModerator() {
+			c.Hub.moderate(c, in)
+			return false
+		}
+	case RequestEdit:
+		ch.body = strings.TrimSpace(in.Body)
+		if runes := []rune(ch.body); len(runes) > maxBodyLength {
+			ch.body = string(runes[:maxBodyLength])
+		}
+		if !c.isModerator() && ch.body != "" {
+			switch filtered(ch.body) {
+			case FilterBlock:
+				return c.offend(OffenseFilter, now)
+			case FilterFlag:
+				ch.flagged = true
+			}
+		}
+	case RequestReact, RequestUnreact:
+		ch.body = in.Body
+		if !validEmoji(ch.body) {
+			c.Hub.sendTo(c, event(EventRejected, ReasonInvalid))
+			return false
+		}
+	default:
+		c.Hub.moderate(c, in)
+		return false
+	}
+	if reason := c.Hub.silenced(c); reason != "" {
+		c.Hub.sendTo(c, event(EventRejected, reason))
+		return false
+	}
+	ch.stored, _ = c.Hub.store.Get(c.Hub.room, ch.id)
+	select {
+	case c.Hub.changes <- ch:
+	case <-c.Hub.quit:
+	}
+	return false
+}
+
+// validEmoji accepts a short run of symbols without letters, digits or
+// spaces of their own, as reactions are meant to be emoji.
+func validEmoji(s string) bool {
+	if s == "" || !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxEmojiLength {
+		return false
+	}
+	symbol := false
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		if r >= utf8.RuneSelf && !unicode.IsLetter(r) {
+			symbol = true
+		}
+	}
+	return symbol
+}
+
+// apply changes a message for a client. Only recorded messages can be
+// changed, so direct messages cannot. It runs in the hub loop, so it takes
+// the message from the history, or as the client looked it up, and never
+// waits on the store.
+func (h *Hub) apply(ch change) {
+	reject := func(reason string) {
+		if h.clients[ch.client] {
+			select {
+			case ch.client.Send <- event(EventRejected, reason):
+			default:
+			}
+		}
+	}
+	m := h.history.get(ch.id)
+	if m == nil {
+		m = ch.stored
+	}
+	if m == nil || m.Type != TypeText || m.To != "" {
+		reject(ReasonInvalid)
+		return
+	}
+	if (ch.typ == RequestEdit || ch.typ == RequestDelete) && !m.sentBy(ch.client) {
+		reject(ReasonForbidden)
+		return
+	}
+
+	// Stored messages are shared with the history and clients, so they
+	// are copied rather than changed.
+	updated := *m
+	switch ch.typ {
+	case RequestDelete:
+		h.update(tombstone(m))
+		return
+	case RequestEdit:
+		if time.Since(m.Time) > EditWindow {
+			reject(ReasonExpired)
+			return
+		}
+		if ch.body == "" && m.Attachment == nil {
+			reject(ReasonInvalid)
+			return
+		}
+		now := time.Now().UTC()
+		updated.Body = ch.body
+		updated.Edited = &now
+		updated.Flagged = ch.flagged
+	case RequestReact, RequestUnreact:
+		updated.Reactions = react(m.Reactions, ch.body, ch.client.author, ch.typ == RequestReact)
+		if updated.Reactions == nil && m.Reactions == nil {
+			return
+		}
+		if len(updated.Reactions) > maxReactions {
+			reject(ReasonInvalid)
+			return
+		}
+	}
+	h.update(&updated)
+}
+
+// react returns a copy of reactions with author added to or removed from
+// those of emoji.
+func react(reactions map[string][]string, emoji, author string, add bool) map[string][]string {
+	out := make(map[string][]string, len(reactions)+1)
+	for e, participants := range reactions {
+		out[e] = participants
+	}
+	var kept []string
+	for _, a := range out[emoji] {
+		if a != author {
+			kept = append(kept, a)
+		}
+	}
+	if add {
+		kept = append(kept, author)
+	}
+	if len(kept) == 0 {
+		delete(out, emoji)
+	} else {
+		out[emoji] = kept
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// tombstone replaces a deleted message. It keeps the ID, sender, time and
+// thread of the message but not its content.
+func tombstone(m *Message) *Message {
+	return &Message{
+		ID:     m.ID,
+		Type:   TypeDeleted,
+		Sender: m.Sender,
+		Name:   m.Name,
+		Author: m.Author,
+		Time:   m.Time,
+		Parent: m.Parent,
+	}
+}
+
+// sentBy reports whether c speaks for the sender of m. Messages recorded
+// before they had an author only belong to the client that sent them.
+func (m *Message) sentBy(c *Client) bool {
+	if m.Author == "" {
+		return m.Sender == c.ID
+	}
+	return m.Author == c.author
+}
+
+// update replaces a recorded message in the history and the store and
+// sends the new version to every client under a new revision. Clients
+// replace the message they show with the same ID.
+func (h *Hub) update(m *Message) {
+	m.Revision = newID()
+	h.history.replace(m)
+	if err := h.store.Update(h.room, m); err != nil {
+		log.WithField(logger.FieldRoom, h.room).Errorf("failed to update chat message, err=%v", err)
+	}
+	h.send(m)
+}
@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Filter actions.
+const (
+	// FilterBlock refuses matching messages as an offense.
+	FilterBlock = "block"
+	// FilterFlag relays matching messages marked as flagged.
+	FilterFlag = "flag"
+)
+
+// Filter matches messages containing any of Words, or links when Links is
+// set, and blocks or flags them as Action says.
+type Filter struct {
+	Words  []string
+	Links  bool
+	Action string
+}
+
+var (
+	filter  Filter
+	linkRe  = regexp.MustCompile(`(?i)\b(https?://|www\.)\S`)
+	wordSet map[string]bool
+)
+
+// ConfigureFilter sets the word and link filter of chat messages.
+func ConfigureFilter(f Filter) {
+	words := make(map[string]bool, len(f.Words))
+	for _, w := range f.Words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			words[w] = true
+		}
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	filter, wordSet = f, words
+}
+
+// filtered returns the filter action for body, or "" when it matches
+// nothing.
+func filtered(body string) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if filter.Links && linkRe.MatchString(body) {
+		return filter.Action
+	}
+	if len(wordSet) == 0 {
+		return ""
+	}
+	words := strings.FieldsFunc(strings.ToLower(body), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if wordSet[w] {
+			return filter.Action
+		}
+	}
+	return ""
+}
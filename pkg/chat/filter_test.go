@@ -0,0 +1,33 @@
+package chat
+
+import "testing"
+
+func TestFiltered(t *testing.T) {
+	t.Cleanup(func() { ConfigureFilter(Filter{}) })
+
+	tests := []struct {
+		name   string
+		filter Filter
+		body   string
+		want   string
+	}{
+		{"no filter", Filter{}, "darn https://example.com", ""},
+		{"word", Filter{Words: []string{"darn"}, Action: FilterBlock}, "oh darn it", FilterBlock},
+		{"word case", Filter{Words: []string{" Darn "}, Action: FilterBlock}, "DARN!", FilterBlock},
+		{"word in word", Filter{Words: []string{"darn"}, Action: FilterBlock}, "darnation", ""},
+		{"word with punctuation", Filter{Words: []string{"darn"}, Action: FilterFlag}, "well,darn.", FilterFlag},
+		{"blank word", Filter{Words: []string{" "}, Action: FilterBlock}, "anything", ""},
+		{"link", Filter{Links: true, Action: FilterFlag}, "see https://example.com", FilterFlag},
+		{"www link", Filter{Links: true, Action: FilterBlock}, "at WWW.example.com", FilterBlock},
+		{"bare scheme", Filter{Links: true, Action: FilterBlock}, "https:// alone", ""},
+		{"links off", Filter{Words: []string{"darn"}, Action: FilterBlock}, "https://example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ConfigureFilter(tt.filter)
+			if got := filtered(tt.body); got != tt.want {
+				t.Errorf("filtered(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of the history each hub keeps for clients joining late.
+const (
+	DefaultHistorySize = 100
+	DefaultHistoryAge  = time.Hour
+)
+
+var (
+	configMu    sync.RWMutex
+	historySize = DefaultHistorySize
+	historyAge  = DefaultHistoryAge
+	store       = Store(NewMemoryStore(DefaultMemoryLimit))
+)
+
+// Configure sets how many messages, and for how long, new hubs keep for
+// replay. A size of zero turns the history off.
+func Configure(size int, age time.Duration) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	historySize, historyAge = size, age
+}
+
+func historyLimits() (int, time.Duration) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return historySize, historyAge
+}
+
+// history is a ring buffer of the latest messages of a hub, bounded by
+// count and age. It is only used from the hub loop.
+type history struct {
+	age  time.Duration
+	buf  []*Message
+	head int
+	n    int
+	// changed keeps the latest changes to messages that already left the
+	// buffer, oldest first and as many as the buffer holds, so clients
+	// that reconnect still learn about them.
+	changed []*Message
+}
+
+func newHistory(size int, age time.Duration) *history {
+	return &history{age: age, buf: make([]*Message, size)}
+}
+
+// load fills the history with messages recorded before, oldest first.
+func (h *history) load(messages []*Message) {
+	for _, m := range messages {
+		h.add(m)
+	}
+}
+
+func (h *history) add(m *Message) {
+	if len(h.buf) == 0 {
+		return
+	}
+	tail := (h.head + h.n) % len(h.buf)
+	h.buf[tail] = m
+	if h.n < len(h.buf) {
+		h.n++
+	} else {
+		h.head = (h.head + 1) % len(h.buf)
+	}
+}
+
+// replace swaps the kept message with the ID of m for m, or keeps m as a
+// change to a message no longer kept.
+func (h *history) replace(m *Message) {
+	if len(h.buf) == 0 {
+		return
+	}
+	for i := 0; i < h.n; i++ {
+		j := (h.head + i) % len(h.buf)
+		if h.buf[j].ID == m.ID {
+			h.buf[j] = m
+			return
+		}
+	}
+	for i, c := range h.changed {
+		if c.ID == m.ID {
+			h.changed = append(h.changed[:i], h.changed[i+1:]...)
+			break
+		}
+	}
+	if len(h.changed) == len(h.buf) {
+		h.changed[0] = nil
+		h.changed = h.changed[1:]
+	}
+	h.changed = append(h.changed, m)
+}
+
+// get returns the latest version of the kept or changed message with ID
+// id, or nil.
+func (h *history) get(id string) *Message {
+	for i := 0; i < h.n; i++ {
+		if m := h.buf[(h.head+i)%len(h.buf)]; m.ID == id {
+			return m
+		}
+	}
+	for _, m := range h.changed {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// expire drops the messages older than the age limit.
+func (h *history) expire(now time.Time) {
+	cutoff := now.Add(-h.age)
+	for h.n > 0 && h.buf[h.head].Time.Before(cutoff) {
+		h.buf[h.head] = nil
+		h.head = (h.head + 1) % len(h.buf)
+		h.n--
+	}
+}
+
+// since returns the kept messages c may see that were created or changed
+// after the message ID or revision after, oldest first, or all of them
+// when after is empty. IDs and revisions are time ordered, so this works
+// even when that message was already dropped.
+func (h *history) since(c *Client, after string) []*Message {
+	h.expire(time.Now())
+	var messages []*Message
+	if after != "" {
+		for _, m := range h.changed {
+			if m.Revision > after && m.visibleTo(c) {
+				messages = append(messages, m)
+			}
+		}
+	}
+	for i := 0; i < h.n; i++ {
+		m := h.buf[(h.head+i)%len(h.buf)]
+		if (after == "" || m.ID > after || m.Revision > after) && m.visibleTo(c) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
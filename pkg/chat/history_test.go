@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistorySince(t *testing.T) {
+	h := newHistory(3, time.Hour)
+	var messages []*Message
+	for i := 0; i < 5; i++ {
+		m := NewMessage(TypeText, "")
+		messages = append(messages, m)
+		h.add(m)
+	}
+	id := func(i int) string { return messages[i].ID }
+	cursor := newID()
+
+	// The first message already left the buffer, the third is still kept.
+	for _, i := range []int{0, 2} {
+		h.replace(&Message{ID: id(i), Type: TypeDeleted, Time: messages[i].Time, Revision: newID()})
+	}
+
+	c := &Client{}
+	tests := []struct {
+		after string
+		want  []string
+	}{
+		{"", []string{id(2), id(3), id(4)}},
+		{id(3), []string{id(0), id(2), id(4)}},
+		{cursor, []string{id(0), id(2)}},
+	}
+	for _, tt := range tests {
+		if got := ids(h.since(c, tt.after)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("since(%q) = %v, want %v", tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestReactOncePerAuthor(t *testing.T) {
+	reactions := react(nil, "👍", "a", true)
+	reactions = react(reactions, "👍", "a", true)
+	reactions = react(reactions, "👍", "b", true)
+	if got, want := reactions["👍"], []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reactions = %v, want %v", got, want)
+	}
+	if reactions = react(reactions, "👍", "a", false); !reflect.DeepEqual(reactions["👍"], []string{"b"}) {
+		t.Errorf("reactions after unreact = %v, want [b]", reactions["👍"])
+	}
+}
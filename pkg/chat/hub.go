@@ -1,19 +1,62 @@
 package chat
 
+import (
+	"pinzoom/pkg/logger"
+	"sync"
+	"sync/atomic"
+)
+
+var log = logger.For("chat")
+
 type Hub struct {
+	// OnModerate is called after a moderator acted from the chat, with the
+	// actor's ID, the action, its target and a detail. Set it before Run.
+	OnModerate func(actor, action, target, detail string)
+
+	room       string
+	store      Store
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan *Message
+	private    chan privateMessage
+	changes    chan change
+	signals    chan signal
 	register   chan *Client
 	unregister chan *Client
+	size       atomic.Int32
+	disabled   atomic.Bool
+	history    *history
+	moderation moderation
+	presence   presence
+
+	quit      chan struct{}
+	closeOnce sync.Once
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
+// NewHub creates the hub of a room. It records messages in the configured
+// store and picks up the history the room left there before.
+func NewHub(room string) *Hub {
+	size, age := historyLimits()
+	h := &Hub{
+		room:       room,
+		store:      currentStore(),
+		broadcast:  make(chan *Message, 256),
+		private:    make(chan privateMessage),
+		changes:    make(chan change),
+		signals:    make(chan signal),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		history:    newHistory(size, age),
+		quit:       make(chan struct{}),
+	}
+	if size > 0 {
+		messages, err := h.store.List(room, Query{Limit: size})
+		if err != nil {
+			log.WithField(logger.FieldRoom, room).Errorf("failed to load chat history, err=%v", err)
+		}
+		h.history.load(messages)
 	}
+	return h
 }
 
 func (h *Hub) Run() {
@@ -21,20 +64,117 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			h.moderation.track(client)
+			// Replay what the client missed. Send has room for a full
+			// history, see sendBuffer.
+			for _, message := range h.history.since(client, client.after) {
+				client.Send <- message
+			}
+			for _, message := range h.state(client) {
+				client.Send <- message
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
+				h.stopTyping(client)
 				delete(h.clients, client)
 				close(client.Send)
+				h.pruneReads()
 			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
+		case p := <-h.private:
+			if h.clients[p.client] {
 				select {
-				case client.Send <- message:
+				case p.client.Send <- p.message:
 				default:
-					close(client.Send)
-					delete(h.clients, client)
 				}
 			}
+		case message := <-h.broadcast:
+			switch {
+			case message.To != "":
+				h.direct(message)
+			case message.Type == TypeDeleted:
+				h.update(message)
+			default:
+				h.record(message)
+				h.send(message)
+			}
+		case ch := <-h.changes:
+			h.apply(ch)
+		case s := <-h.signals:
+			h.applySignal(s)
+		case <-h.quit:
+			for client := range h.clients {
+				close(client.Send)
+				delete(h.clients, client)
+			}
+			h.size.Store(0)
+			return
 		}
+		h.size.Store(int32(len(h.clients)))
 	}
 }
+
+// record keeps a message in the history and the store.
+func (h *Hub) record(message *Message) {
+	h.history.add(message)
+	if err := h.store.Append(h.room, message); err != nil {
+		log.WithField(logger.FieldRoom, h.room).Errorf("failed to store chat message, err=%v", err)
+	}
+}
+
+// send fans a message out to every client, dropping those too slow to
+// keep up.
+func (h *Hub) send(message *Message) {
+	for client := range h.clients {
+		select {
+		case client.Send <- message:
+		default:
+			close(client.Send)
+			delete(h.clients, client)
+		}
+	}
+}
+
+// sendBuffer is the capacity of the send channel of clients, enough for
+// a full history and the changes kept beside it.
+func (h *Hub) sendBuffer() int {
+	return 2*len(h.history.buf) + 256
+}
+
+// ClientCount returns the number of connected chat clients.
+func (h *Hub) ClientCount() int {
+	return int(h.size.Load())
+}
+
+// Broadcast sends a message to every client of the hub. It is a no-op once
+// the hub is closed.
+func (h *Hub) Broadcast(message *Message) {
+	select {
+	case h.broadcast <- message:
+	case <-h.quit:
+	}
+}
+
+// SetDisabled stops or resumes relaying the messages clients post and tells
+// the clients. System messages sent with Broadcast still go out.
+func (h *Hub) SetDisabled(disabled bool) {
+	if h.disabled.Swap(disabled) == disabled {
+		return
+	}
+	event := EventEnabled
+	if disabled {
+		event = EventDisabled
+	}
+	h.Broadcast(NewMessage(TypeEvent, event))
+}
+
+// Disabled reports whether client messages are dropped.
+func (h *Hub) Disabled() bool {
+	return h.disabled.Load()
+}
+
+// Close disconnects all clients and stops Run.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.quit)
+	})
+}
@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+// loopStore fails the test when the hub loop reads from it.
+type loopStore struct {
+	Store
+	t *testing.T
+}
+
+func (s loopStore) Get(room, id string) (*Message, error) {
+	s.t.Errorf("Get(%q, %q) called from the hub loop", room, id)
+	return s.Store.Get(room, id)
+}
+
+func TestApplyWithoutStoreReads(t *testing.T) {
+	h := &Hub{
+		room:    "room",
+		store:   loopStore{Store: NewMemoryStore(0), t: t},
+		clients: make(map[*Client]bool),
+		history: newHistory(1, time.Hour),
+	}
+	c := &Client{Member: Member{ID: "p"}, Hub: h, Send: make(chan *Message, 16), author: "a"}
+	h.clients[c] = true
+
+	older := NewMessage(TypeText, "older")
+	older.Author = "a"
+	kept := NewMessage(TypeText, "kept")
+	for _, m := range []*Message{older, kept} {
+		h.record(m)
+	}
+
+	// The older message left the history, so only the client's lookup
+	// knows it; the change then keeps it with the history.
+	h.apply(change{client: c, typ: RequestReact, id: older.ID, body: "👍", stored: older})
+	h.apply(change{client: c, typ: RequestEdit, id: older.ID, body: "edited"})
+	h.apply(change{client: c, typ: RequestReact, id: kept.ID, body: "👍"})
+
+	if m := h.history.get(older.ID); m == nil || m.Body != "edited" || len(m.Reactions["👍"]) != 1 {
+		t.Errorf("older message = %+v, want it edited with one reaction", m)
+	}
+	if m := h.history.get(kept.ID); m == nil || len(m.Reactions["👍"]) != 1 {
+		t.Errorf("kept message = %+v, want one reaction", m)
+	}
+	if !h.readable(c, older.ID, nil) || h.readable(c, "missing", nil) {
+		t.Error("readable does not follow the history")
+	}
+}
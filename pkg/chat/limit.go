@@ -0,0 +1,231 @@
+package chat
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// duplicateWindow is how long a client may not repeat a message.
+	duplicateWindow = 30 * time.Second
+	// strikeWindow is how long an offense counts towards a disconnect.
+	strikeWindow = time.Minute
+	// offenderCooldown is how long a disconnected offender may not
+	// reconnect.
+	offenderCooldown = time.Minute
+	// signalRate and signalBurst bound the typing and read requests of a
+	// client, which do not count against the message limits.
+	signalRate  = 2
+	signalBurst = 10
+)
+
+// Limits bound how fast chat clients may send. A rate of zero turns its
+// limit off.
+type Limits struct {
+	// Rate and Burst are the messages per second and the burst a client
+	// may send.
+	Rate  float64
+	Burst int
+	// IPRate and IPBurst bound all clients of an address together. Clients
+	// behind a proxy share its address, so this is off by default.
+	IPRate  float64
+	IPBurst int
+	// Strikes is how many offenses a client is warned for; the next one
+	// disconnects it.
+	Strikes int
+}
+
+// DefaultLimits are the limits of clients when none are configured.
+var DefaultLimits = Limits{Rate: 1, Burst: 5, IPRate: 0, IPBurst: 20, Strikes: 3}
+
+var limits = DefaultLimits
+
+// ConfigureLimits sets the limits of chat clients connecting from now on.
+func ConfigureLimits(l Limits) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	limits = l
+}
+
+func currentLimits() Limits {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return limits
+}
+
+// bucket is a token bucket refilled at rate tokens per second up to burst.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take spends a token, or reports false when the bucket is empty.
+func (b *bucket) take(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	// Callers read the clock before a new bucket is made, so now may be
+	// a little before last.
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket refilled, so it can be forgotten.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// addresses holds the shared bucket of every client address.
+var addresses = struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}{
+	buckets: make(map[string]*bucket),
+}
+
+// offenders holds the member identities disconnected for an offense that
+// may not reconnect yet.
+var offenders = struct {
+	mu         sync.Mutex
+	identities map[string]offender
+}{
+	identities: make(map[string]offender),
+}
+
+// offender is a member disconnected for an offense.
+type offender struct {
+	offense string
+	until   time.Time
+}
+
+// takeIP spends a token of the bucket of ip.
+func takeIP(ip string, l Limits, now time.Time) bool {
+	if l.IPRate <= 0 {
+		return true
+	}
+	addresses.mu.Lock()
+	defer addresses.mu.Unlock()
+	b, ok := addresses.buckets[ip]
+	if !ok {
+		b = newBucket(l.IPRate, l.IPBurst)
+		addresses.buckets[ip] = b
+	}
+
+	// Forget addresses that went quiet, so the map doesn't grow without
+	// bound.
+	if len(addresses.buckets) > 1024 {
+		for k, other := range addresses.buckets {
+			if other != b && other.full(now) {
+				delete(addresses.buckets, k)
+			}
+		}
+	}
+	return b.take(now)
+}
+
+// ban keeps a member identity from reconnecting for the offender cooldown.
+func ban(identity, offense string) {
+	offenders.mu.Lock()
+	defer offenders.mu.Unlock()
+	now := time.Now()
+	offenders.identities[identity] = offender{offense: offense, until: now.Add(offenderCooldown)}
+	for k, o := range offenders.identities {
+		if now.After(o.until) {
+			delete(offenders.identities, k)
+		}
+	}
+}
+
+// banned returns the offense identity was disconnected for lately, if any.
+func banned(identity string) (string, bool) {
+	offenders.mu.Lock()
+	defer offenders.mu.Unlock()
+	o, ok := offenders.identities[identity]
+	if !ok || time.Now().After(o.until) {
+		return "", false
+	}
+	return o.offense, true
+}
+
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// limiter tracks the rate, recent messages and offenses of a client. It is
+// only used from the read pump of the client.
+type limiter struct {
+	limits  Limits
+	ip      string
+	bucket  *bucket
+	signals *bucket
+	recent  map[string]time.Time
+	strikes int
+	struck  time.Time
+}
+
+func newLimiter(ip string) *limiter {
+	l := currentLimits()
+	return &limiter{
+		limits:  l,
+		ip:      ip,
+		bucket:  newBucket(l.Rate, l.Burst),
+		signals: newBucket(signalRate, signalBurst),
+		recent:  make(map[string]time.Time),
+	}
+}
+
+// allow tells why a message may not be sent now, or returns "".
+func (l *limiter) allow(now time.Time) string {
+	if !l.bucket.take(now) {
+		return OffenseRate
+	}
+	if !takeIP(l.ip, l.limits, now) {
+		return OffenseIPRate
+	}
+	return ""
+}
+
+// duplicate reports whether the client sent body lately, and remembers it.
+func (l *limiter) duplicate(body string, now time.Time) bool {
+	key := strings.ToLower(strings.Join(strings.Fields(body), " "))
+	for k, sent := range l.recent {
+		if now.Sub(sent) > duplicateWindow {
+			delete(l.recent, k)
+		}
+	}
+	if _, ok := l.recent[key]; ok {
+		return true
+	}
+	l.recent[key] = now
+	return false
+}
+
+// strike counts an offense and reports whether the client used up its
+// warnings.
+func (l *limiter) strike(now time.Time) bool {
+	if now.Sub(l.struck) > strikeWindow {
+		l.strikes = 0
+	}
+	l.strikes++
+	l.struck = now
+	return l.strikes > l.limits.Strikes
+}
@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := &bucket{rate: 2, burst: 3, tokens: 3, last: now}
+
+	tests := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		// Half a second at two per second refills one token.
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		// A long pause refills no more than the burst.
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, tt := range tests {
+		if got := b.take(now.Add(tt.after)); got != tt.want {
+			t.Errorf("take %d after %v = %v, want %v", i, tt.after, got, tt.want)
+		}
+	}
+	if b.full(now.Add(time.Hour)) || !b.full(now.Add(time.Hour+2*time.Second)) {
+		t.Error("full does not follow the refill")
+	}
+
+	off := newBucket(0, 0)
+	for i := 0; i < 10; i++ {
+		if !off.take(now) {
+			t.Fatal("a bucket without rate refused a token")
+		}
+	}
+}
+
+func TestStrike(t *testing.T) {
+	now := time.Now()
+	l := &limiter{limits: Limits{Strikes: 2}}
+
+	tests := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, false},
+		{time.Second, false},
+		{2 * time.Second, true},
+		// Offenses older than the strike window are forgiven.
+		{2*time.Second + strikeWindow + time.Second, false},
+		{3*time.Second + strikeWindow + time.Second, false},
+		{4*time.Second + strikeWindow + time.Second, true},
+	}
+	for i, tt := range tests {
+		if got := l.strike(now.Add(tt.after)); got != tt.want {
+			t.Errorf("strike %d after %v = %v, want %v", i, tt.after, got, tt.want)
+		}
+	}
+
+	strict := &limiter{limits: Limits{Strikes: 0}}
+	if !strict.strike(now) {
+		t.Error("a limiter without warnings did not disconnect on the first offense")
+	}
+}
+
+func TestTakeIP(t *testing.T) {
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if !takeIP("192.0.2.1", Limits{IPBurst: 1}, now) {
+			t.Fatal("the address limit is on without a rate")
+		}
+	}
+	if _, ok := addresses.buckets["192.0.2.1"]; ok {
+		t.Error("an address is tracked without a rate")
+	}
+
+	l := Limits{IPRate: 1, IPBurst: 2}
+	t.Cleanup(func() {
+		addresses.mu.Lock()
+		delete(addresses.buckets, "192.0.2.2")
+		delete(addresses.buckets, "192.0.2.3")
+		addresses.mu.Unlock()
+	})
+	for i, want := range []bool{true, true, false} {
+		if got := takeIP("192.0.2.2", l, now); got != want {
+			t.Errorf("take %d = %v, want %v", i, got, want)
+		}
+	}
+	if !takeIP("192.0.2.3", l, now) {
+		t.Error("another address shares the bucket")
+	}
+	if !takeIP("192.0.2.2", l, now.Add(2*time.Second)) {
+		t.Error("the address bucket did not refill")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+	l := &limiter{
+		limits: Limits{Rate: 1, Burst: 1},
+		ip:     "192.0.2.4",
+		bucket: newBucket(1, 1),
+	}
+	if offense := l.allow(now); offense != "" {
+		t.Errorf("allow = %q, want none", offense)
+	}
+	if offense := l.allow(now); offense != OffenseRate {
+		t.Errorf("allow = %q, want %q", offense, OffenseRate)
+	}
+
+	l = &limiter{
+		limits: Limits{IPRate: 1, IPBurst: 1},
+		ip:     "192.0.2.4",
+		bucket: newBucket(0, 0),
+	}
+	t.Cleanup(func() {
+		addresses.mu.Lock()
+		delete(addresses.buckets, "192.0.2.4")
+		addresses.mu.Unlock()
+	})
+	l.allow(now)
+	if offense := l.allow(now); offense != OffenseIPRate {
+		t.Errorf("allow = %q, want %q", offense, OffenseIPRate)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	now := time.Now()
+	l := &limiter{recent: make(map[string]time.Time)}
+	tests := []struct {
+		body  string
+		after time.Duration
+		want  bool
+	}{
+		{"hello  world", 0, false},
+		{"Hello world ", time.Second, true},
+		{"hello there", time.Second, false},
+		{"hello world", duplicateWindow + time.Second, false},
+	}
+	for _, tt := range tests {
+		if got := l.duplicate(tt.body, now.Add(tt.after)); got != tt.want {
+			t.Errorf("duplicate(%q) after %v = %v, want %v", tt.body, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestBan(t *testing.T) {
+	t.Cleanup(func() {
+		offenders.mu.Lock()
+		delete(offenders.identities, "browser:a")
+		delete(offenders.identities, "browser:old")
+		offenders.mu.Unlock()
+	})
+	offenders.mu.Lock()
+	offenders.identities["browser:old"] = offender{offense: OffenseRate, until: time.Now().Add(-time.Second)}
+	offenders.mu.Unlock()
+
+	if _, ok := banned("browser:old"); ok {
+		t.Error("an offender is banned after the cooldown")
+	}
+	ban("browser:a", OffenseDuplicate)
+	if offense, ok := banned("browser:a"); !ok || offense != OffenseDuplicate {
+		t.Errorf("banned = %q, %v, want %q", offense, ok, OffenseDuplicate)
+	}
+	if _, ok := banned("browser:b"); ok {
+		t.Error("another identity is banned")
+	}
+
+	offenders.mu.Lock()
+	_, kept := offenders.identities["browser:old"]
+	until := offenders.identities["browser:a"].until
+	offenders.mu.Unlock()
+	if kept {
+		t.Error("ban kept an offender past the cooldown")
+	}
+	if d := time.Until(until); d <= 0 || d > offenderCooldown {
+		t.Errorf("ban lasts %v, want up to %v", d, offenderCooldown)
+	}
+}
+
+func TestOffend(t *testing.T) {
+	t.Cleanup(func() {
+		offenders.mu.Lock()
+		delete(offenders.identities, "browser:offender")
+		offenders.mu.Unlock()
+	})
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	h := &Hub{private: make(chan privateMessage, 8), quit: make(chan struct{})}
+	c := &Client{
+		Member:  Member{ID: "p", Identity: "browser:offender"},
+		Hub:     h,
+		limiter: &limiter{limits: Limits{Strikes: 2}},
+		log:     logrus.NewEntry(log),
+	}
+
+	now := time.Now()
+	for i, want := range []string{EventWarning, EventWarning, EventDisconnected} {
+		disconnected := c.offend(OffenseFilter, now.Add(time.Duration(i)*time.Second))
+		m := (<-h.private).message
+		if m.Body != want || m.Data != OffenseFilter || disconnected != (want == EventDisconnected) {
+			t.Errorf("offense %d = %s %s, disconnected %v, want %s", i, m.Body, m.Data, disconnected, want)
+		}
+	}
+	if !c.kicked {
+		t.Error("the client is not kicked")
+	}
+	if offense, ok := banned("browser:offender"); !ok || offense != OffenseFilter {
+		t.Errorf("banned = %q, %v, want %q", offense, ok, OffenseFilter)
+	}
+}
@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryLimit is how many messages a MemoryStore keeps in total.
+const DefaultMemoryLimit = 100_000
+
+// MemoryStore keeps the messages in memory. It is the store when no path
+// is configured, so history survives the room but not the process. Past
+// its limit it drops the oldest messages.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	rooms  map[string][]*Message
+	count  int
+	limit  int
+	closed bool
+}
+
+// NewMemoryStore creates a store keeping up to limit messages, or any
+// number with a limit of zero.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{rooms: make(map[string][]*Message), limit: limit}
+}
+
+func (s *MemoryStore) Append(room string, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	// Clients stamp messages before the hub orders them, so keep the
+	// slice sorted by ID rather than by arrival.
+	messages := s.rooms[room]
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].ID > m.ID })
+	messages = append(messages, nil)
+	copy(messages[i+1:], messages[i:])
+	messages[i] = m
+	s.rooms[room] = messages
+	s.count++
+	for s.limit > 0 && s.count > s.limit {
+		s.dropOldest()
+	}
+	return nil
+}
+
+// dropOldest deletes the oldest message of all rooms.
+func (s *MemoryStore) dropOldest() {
+	oldest := ""
+	for room, messages := range s.rooms {
+		if oldest == "" || messages[0].ID < s.rooms[oldest][0].ID {
+			oldest = room
+		}
+	}
+	if messages := s.rooms[oldest]; len(messages) == 1 {
+		delete(s.rooms, oldest)
+	} else {
+		// Lists are copies, so the shared array may be cut in place.
+		messages[0] = nil
+		s.rooms[oldest] = messages[1:]
+	}
+	s.count--
+}
+
+func (s *MemoryStore) Get(room, id string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	if i, ok := s.find(room, id); ok {
+		return s.rooms[room][i], nil
+	}
+	return nil, ErrMessageNotFound
+}
+
+func (s *MemoryStore) Update(room string, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	i, ok := s.find(room, m.ID)
+	if !ok {
+		return ErrMessageNotFound
+	}
+	s.rooms[room][i] = m
+	return nil
+}
+
+func (s *MemoryStore) find(room, id string) (int, bool) {
+	messages := s.rooms[room]
+	i := sort.Search(len(messages), func(i int) bool { return messages[i].ID >= id })
+	return i, i < len(messages) && messages[i].ID == id
+}
+
+func (s *MemoryStore) List(room string, q Query) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	return page(s.rooms[room], q), nil
+}
+
+func (s *MemoryStore) Prune(t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for room, messages := range s.rooms {
+		n := 0
+		for n < len(messages) && messages[n].Time.Before(t) {
+			n++
+		}
+		pruned += n
+		s.count -= n
+		if n == len(messages) {
+			delete(s.rooms, room)
+		} else if n > 0 {
+			s.rooms[room] = append([]*Message{}, messages[n:]...)
+		}
+	}
+	return pruned, nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.rooms = nil
+	s.count = 0
+	return nil
+}
@@ -0,0 +1,212 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MessageType tells clients how to show a message.
+type MessageType string
+
+const (
+	// TypeText is a message a participant wrote.
+	TypeText MessageType = "text"
+	// TypeSystem is a notice from the server or an admin.
+	TypeSystem MessageType = "system"
+	// TypeEvent reports a change in the chat, such as a client joining.
+	// Body names the event and Data carries its argument.
+	TypeEvent MessageType = "event"
+	// TypeDeleted is the tombstone of a message a moderator deleted. It
+	// keeps the ID, sender and time of the message but not its body.
+	TypeDeleted MessageType = "deleted"
+)
+
+// Events carried in the body of TypeEvent messages.
+const (
+	EventDisabled = "chat-disabled"
+	EventEnabled  = "chat-enabled"
+	// EventMuted and EventUnmuted name the participant in Data.
+	EventMuted   = "chat-muted"
+	EventUnmuted = "chat-unmuted"
+	// EventSlowMode carries the minimum seconds between two messages of a
+	// participant in Data, 0 when slow mode is off.
+	EventSlowMode = "slow-mode"
+	// EventSelf is sent to a client when it connects; Data is the ID its
+	// messages are sent under and Author its author key.
+	EventSelf = "self"
+	// EventRole is sent to a client when it connects; Data is RoleModerator
+	// or RoleMember.
+	EventRole = "role"
+	// EventRejected is sent to a client only, when its message or request
+	// was refused; Data is one of the Reason constants.
+	EventRejected = "rejected"
+	// EventWarning is sent to a client only, when its message was refused
+	// as an offense; Data is one of the Offense constants. Once its
+	// warnings are used up the client gets EventDisconnected instead and
+	// is disconnected.
+	EventWarning      = "warning"
+	EventDisconnected = "disconnected"
+	// EventTyping and EventTypingStopped tell who started or stopped
+	// typing in Sender and Name. Clients drop an indicator that was not
+	// repeated within TypingTimeout.
+	EventTyping        = "typing"
+	EventTypingStopped = "typing-stopped"
+	// EventReads carries read markers in Reads: those of the members in
+	// the chat when a client connects, the one that moved afterwards.
+	EventReads = "reads"
+)
+
+// Offenses of EventWarning and EventDisconnected.
+const (
+	OffenseRate      = "rate"
+	OffenseIPRate    = "ip-rate"
+	OffenseDuplicate = "duplicate"
+	OffenseFilter    = "filter"
+)
+
+// Roles of chat clients.
+const (
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Reasons of EventRejected.
+const (
+	ReasonDisabled  = "disabled"
+	ReasonMuted     = "muted"
+	ReasonSlowMode  = "slow-mode"
+	ReasonForbidden = "forbidden"
+	ReasonInvalid   = "invalid"
+	// ReasonUnknownRecipient refuses a direct message to a participant
+	// that is not in the chat.
+	ReasonUnknownRecipient = "unknown-recipient"
+	// ReasonExpired refuses an edit after EditWindow.
+	ReasonExpired = "expired"
+)
+
+// Requests clients send instead of text. Data names the target.
+const (
+	// RequestDelete takes the message with the ID in Data back. Senders
+	// may delete their own messages, moderators any message.
+	RequestDelete MessageType = "delete"
+	// RequestEdit replaces the body of the sender's own message with the
+	// ID in Data by Body, within EditWindow.
+	RequestEdit MessageType = "edit"
+	// RequestReact and RequestUnreact add and remove the emoji in Body as
+	// a reaction to the message with the ID in Data.
+	RequestReact   MessageType = "react"
+	RequestUnreact MessageType = "unreact"
+	// RequestTyping and RequestTypingStopped report the client typing a
+	// message. RequestTyping is repeated while the client keeps typing.
+	RequestTyping        MessageType = "typing"
+	RequestTypingStopped MessageType = "typing-stopped"
+	// RequestRead marks the messages up to the ID in Data read.
+	RequestRead MessageType = "read"
+	// The requests below are for moderators only. RequestMute and
+	// RequestUnmute take the participant ID in Data.
+	RequestMute   MessageType = "mute"
+	RequestUnmute MessageType = "unmute"
+	// RequestSlowMode takes the interval in seconds in Data, 0 to turn
+	// it off.
+	RequestSlowMode MessageType = "slow-mode"
+	RequestDisable  MessageType = "disable"
+	RequestEnable   MessageType = "enable"
+)
+
+// Message is the envelope of everything sent over the chat websocket, one
+// JSON object per websocket message.
+type Message struct {
+	ID     string      `json:"id"`
+	Type   MessageType `json:"type"`
+	Sender string      `json:"sender,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Time   time.Time   `json:"time"`
+	Body   string      `json:"body"`
+	Data   string      `json:"data,omitempty"`
+	// Author is the author key of the sender, the same for all its
+	// connections to the room; see authorKey.
+	Author string `json:"author,omitempty"`
+	// Revision is the ID of the last change to a recorded message. It is
+	// drawn from the same sequence as message IDs, so the newest ID or
+	// revision a client saw tells what it missed.
+	Revision string `json:"revision,omitempty"`
+	// Flagged marks a message the filter let through for moderators to
+	// review.
+	Flagged bool `json:"flagged,omitempty"`
+	// To is the participant a direct message is for. Direct messages only
+	// reach the clients of the sender and the recipient and are not
+	// recorded in the store.
+	To string `json:"to,omitempty"`
+	// Attachment is a file shared with the message, whose body may then be
+	// empty.
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// Parent is the message this one replies to in a thread.
+	Parent string `json:"parent,omitempty"`
+	// Edited is when the sender last changed the body.
+	Edited *time.Time `json:"edited,omitempty"`
+	// Reactions lists the author keys of those that reacted with each
+	// emoji.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// Reads maps author keys to the last message their member read.
+	Reads map[string]string `json:"reads,omitempty"`
+
+	// from and fromModerator route a direct message in the hub, which
+	// then keeps the identities it may be shown to.
+	from          *Client
+	fromModerator bool
+	fromIdentity  string
+	toIdentity    string
+}
+
+// visibleTo reports whether c may see the message.
+func (m *Message) visibleTo(c *Client) bool {
+	return m.To == "" || c.Identity == m.toIdentity || c.Identity == m.fromIdentity
+}
+
+// incoming is what clients send. Only the body, or the argument of a
+// request, is taken from them; the rest of the envelope is filled in by the
+// server.
+type incoming struct {
+	Type MessageType `json:"type"`
+	Body string      `json:"body"`
+	Data string      `json:"data"`
+	// To sends a text message only to the given participant.
+	To string `json:"to"`
+	// Attachment is the ID of a file the client uploaded to the room.
+	Attachment string `json:"attachment"`
+	// Parent is the ID of the message a text message replies to.
+	Parent string `json:"parent"`
+}
+
+// NewMessage stamps a message with an ID and the server time. IDs are
+// UUIDv7, so they sort in the order messages were created.
+func NewMessage(typ MessageType, body string) *Message {
+	return &Message{
+		ID:   newID(),
+		Type: typ,
+		Time: time.Now().UTC(),
+		Body: body,
+	}
+}
+
+// newID returns a UUIDv7, which sorts after the IDs returned before.
+func newID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		id = uuid.New()
+	}
+	return id.String()
+}
+
+// event creates an event message with its argument.
+func event(name, data string) *Message {
+	m := NewMessage(TypeEvent, name)
+	m.Data = data
+	return m
+}
+
+// System creates a system notice.
+func System(body string) *Message {
+	return NewMessage(TypeSystem, body)
+}
@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxSlowMode bounds the slow mode interval.
+const MaxSlowMode = time.Hour
+
+var ErrNotText = errors.New("only text messages can be deleted")
+
+// moderation holds who is muted from the chat and the slow mode interval.
+// Both apply per member identity, so reloading or opening another socket
+// does not shake them off; members without an identity go by their ID.
+type moderation struct {
+	mu    sync.Mutex
+	muted map[string]bool
+	slow  time.Duration
+	last  map[string]time.Time
+	// identities maps the IDs of connected clients to their identity.
+	identities map[string]string
+	// uploads limits how fast each member shares files.
+	uploads map[string]*bucket
+}
+
+// memberKey is the key moderation state of a member is kept under.
+func memberKey(m Member) string {
+	if m.Identity != "" {
+		return m.Identity
+	}
+	return "id:" + m.ID
+}
+
+// track remembers the identity behind the ID of a connecting client, for
+// the life of the hub so the member stays muted under a new ID. A mute
+// issued before the identity was known moves over to it.
+func (m *moderation) track(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.identities == nil {
+		m.identities = make(map[string]string)
+	}
+	key := memberKey(c.Member)
+	m.identities[c.ID] = key
+	if byID := "id:" + c.ID; byID != key && m.muted[byID] {
+		delete(m.muted, byID)
+		m.muted[key] = true
+	}
+}
+
+// keyOf returns the key of the member behind a participant ID. It must be
+// called with mu held.
+func (m *moderation) keyOf(participant string) string {
+	if key, ok := m.identities[participant]; ok {
+		return key
+	}
+	return "id:" + participant
+}
+
+// privateMessage is sent to one client only and not recorded.
+type privateMessage struct {
+	client  *Client
+	message *Message
+}
+
+// sendTo sends a message to one client of the hub.
+func (h *Hub) sendTo(c *Client, message *Message) {
+	select {
+	case h.private <- privateMessage{client: c, message: message}:
+	case <-h.quit:
+	}
+}
+
+// Delete takes a message back. Clients get a tombstone with its ID, which
+// also replaces the message in the history and the store. It is called
+// from client read pumps and the admin API, never from the hub loop, so
+// the store lookup does not hold the hub up.
+func (h *Hub) Delete(id string) (*Message, error) {
+	m, err := h.store.Get(h.room, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != TypeText {
+		return nil, ErrNotText
+	}
+	h.Broadcast(tombstone(m))
+	return m, nil
+}
+
+// Mute stops or resumes relaying the messages of a participant, and of
+// every other client of the same member.
+func (h *Hub) Mute(participant string, muted bool) {
+	h.moderation.mu.Lock()
+	if h.moderation.muted == nil {
+		h.moderation.muted = make(map[string]bool)
+	}
+	key := h.moderation.keyOf(participant)
+	changed := h.moderation.muted[key] != muted
+	if muted {
+		h.moderation.muted[key] = true
+	} else {
+		delete(h.moderation.muted, key)
+	}
+	h.moderation.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	name := EventUnmuted
+	if muted {
+		name = EventMuted
+	}
+	h.Broadcast(event(name, participant))
+}
+
+// Muted reports whether a participant is muted from the chat.
+func (h *Hub) Muted(participant string) bool {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+	return h.moderation.muted[h.moderation.keyOf(participant)]
+}
+
+func (h *Hub) mutedMember(m Member) bool {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+	return h.moderation.muted[memberKey(m)]
+}
+
+// SetSlowMode makes every participant wait interval between two messages,
+// or lifts the limit with 0. Moderators are exempt.
+func (h *Hub) SetSlowMode(interval time.Duration) {
+	interval = min(max(interval, 0), MaxSlowMode).Truncate(time.Second)
+	h.moderation.mu.Lock()
+	changed := h.moderation.slow != interval
+	h.moderation.slow = interval
+	h.moderation.mu.Unlock()
+
+	if changed {
+		h.Broadcast(event(EventSlowMode, strconv.Itoa(int(interval.Seconds()))))
+	}
+}
+
+// SlowMode returns the slow mode interval, 0 when it is off.
+func (h *Hub) SlowMode() time.Duration {
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+	return h.moderation.slow
+}
+
+// admit tells why a message of c is refused, or returns "" and counts it
+// for slow mode.
+func (h *Hub) admit(c *Client) string {
+	if reason := h.silenced(c); reason != "" || c.isModerator() {
+		return reason
+	}
+
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+	if h.moderation.slow > 0 {
+		now, key := time.Now(), memberKey(c.Member)
+		if now.Sub(h.moderation.last[key]) < h.moderation.slow {
+			return ReasonSlowMode
+		}
+		if h.moderation.last == nil {
+			h.moderation.last = make(map[string]time.Time)
+		}
+		h.moderation.last[key] = now
+	}
+	return ""
+}
+
+// silenced tells why c may not post or change messages at all, or
+// returns "".
+func (h *Hub) silenced(c *Client) string {
+	return h.Silenced(c.Member)
+}
+
+// Silenced tells why a member may not post to the chat at all, or
+// returns "".
+func (h *Hub) Silenced(m Member) string {
+	if h.Disabled() {
+		return ReasonDisabled
+	}
+	if !m.isModerator() && h.mutedMember(m) {
+		return ReasonMuted
+	}
+	return ""
+}
+
+// AllowUpload tells why a member may not share a file now, or returns "".
+// Past Silenced, uploads are limited per member at the message rate of
+// the chat, returning OffenseRate; moderators are exempt.
+func (h *Hub) AllowUpload(m Member) string {
+	if reason := h.Silenced(m); reason != "" || m.isModerator() {
+		return reason
+	}
+	l := currentLimits()
+	h.moderation.mu.Lock()
+	defer h.moderation.mu.Unlock()
+	if h.moderation.uploads == nil {
+		h.moderation.uploads = make(map[string]*bucket)
+	}
+	key := memberKey(m)
+	b, ok := h.moderation.uploads[key]
+	if !ok {
+		b = newBucket(l.Rate, l.Burst)
+		h.moderation.uploads[key] = b
+	}
+	if !b.take(time.Now()) {
+		return OffenseRate
+	}
+	return ""
+}
+
+// moderate applies a request of c and reports what it did through
+// OnModerate.
+func (h *Hub) moderate(c *Client, in incoming) {
+	if !c.isModerator() {
+		h.sendTo(c, event(EventRejected, ReasonForbidden))
+		return
+	}
+
+	var action, target, detail string
+	switch in.Type {
+	case RequestDelete:
+		m, err := h.Delete(in.Data)
+		if err != nil {
+			c.log.Debugf("failed to delete chat message %s, err=%v", in.Data, err)
+			h.sendTo(c, event(EventRejected, ReasonInvalid))
+			return
+		}
+		action, target, detail = "delete", m.ID, m.Sender
+	case RequestMute, RequestUnmute:
+		if in.Data == "" {
+			h.sendTo(c, event(EventRejected, ReasonInvalid))
+			return
+		}
+		h.Mute(in.Data, in.Type == RequestMute)
+		action, target = "chat-"+string(in.Type), in.Data
+	case RequestSlowMode:
+		seconds, err := strconv.Atoi(in.Data)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > MaxSlowMode {
+			h.sendTo(c, event(EventRejected, ReasonInvalid))
+			return
+		}
+		h.SetSlowMode(time.Duration(seconds) * time.Second)
+		action, detail = "slow-mode", strconv.Itoa(seconds)
+	case RequestDisable, RequestEnable:
+		h.SetDisabled(in.Type == RequestDisable)
+		action, detail = "chat", strconv.FormatBool(in.Type == RequestEnable)
+	default:
+		h.sendTo(c, event(EventRejected, ReasonInvalid))
+		return
+	}
+	if h.OnModerate != nil {
+		h.OnModerate(c.ID, action, target, detail)
+	}
+}
+
+// state tells a joining client its role, the moderation in force and the
+// read markers, as the events may have left the history already.
+func (h *Hub) state(c *Client) []*Message {
+	role := RoleMember
+	if c.isModerator() {
+		role = RoleModerator
+	}
+	self := event(EventSelf, c.ID)
+	self.Author = c.author
+	messages := []*Message{self, event(EventRole, role)}
+	if h.Disabled() {
+		messages = append(messages, event(EventDisabled, ""))
+	}
+	if slow := h.SlowMode(); slow > 0 {
+		messages = append(messages, event(EventSlowMode, strconv.Itoa(int(slow.Seconds()))))
+	}
+	if h.mutedMember(c.Member) {
+		messages = append(messages, event(EventMuted, c.ID))
+	}
+	if reads := h.readsEvent(); reads != nil {
+		messages = append(messages, reads)
+	}
+	return messages
+}
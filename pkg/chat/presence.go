@@ -0,0 +1,174 @@
+package chat
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// TypingInterval is how often a client's typing is relayed at most,
+	// and how often clients repeat RequestTyping while typing.
+	TypingInterval = 3 * time.Second
+	// TypingTimeout is how long clients show someone typing without
+	// hearing from them again.
+	TypingTimeout = 2 * TypingInterval
+	// maxMarkerLength bounds the message IDs taken as read markers.
+	maxMarkerLength = 64
+	// maxReads bounds the read markers kept; those of members that left
+	// are dropped oldest first beyond it.
+	maxReads = 1000
+)
+
+// presence holds who is typing and how far everyone has read. It is only
+// touched by Run, and nothing of it is recorded.
+type presence struct {
+	typing map[*Client]time.Time
+	// reads maps author keys to their read marker, so it survives
+	// reconnects.
+	reads map[string]string
+}
+
+// signal is a typing or read request of a client, applied by Run.
+type signal struct {
+	client *Client
+	in     incoming
+	// stored is the message a read marker names as the store has it, for
+	// when it left the history.
+	stored *Message
+}
+
+func isSignal(typ MessageType) bool {
+	return typ == RequestTyping || typ == RequestTypingStopped || typ == RequestRead
+}
+
+// signal hands a typing or read request of c to the hub. Signals bypass
+// the message rate limits; the read pump bounds them with a bucket of
+// their own and the hub throttles typing further.
+func (c *Client) signal(in incoming) {
+	s := signal{client: c, in: in}
+	if in.Type == RequestRead && in.Data != "" && len(in.Data) <= maxMarkerLength {
+		s.stored, _ = c.Hub.store.Get(c.Hub.room, in.Data)
+	}
+	select {
+	case c.Hub.signals <- s:
+	case <-c.Hub.quit:
+	}
+}
+
+// applySignal relays typing at most once per TypingInterval per client
+// and read markers only when they move forward to a message c may see.
+func (h *Hub) applySignal(s signal) {
+	c := s.client
+	if !h.clients[c] {
+		return
+	}
+	switch s.in.Type {
+	case RequestTyping:
+		if h.silenced(c) != "" {
+			return
+		}
+		now := time.Now()
+		if last, ok := h.presence.typing[c]; ok && now.Sub(last) < TypingInterval {
+			return
+		}
+		if h.presence.typing == nil {
+			h.presence.typing = make(map[*Client]time.Time)
+		}
+		h.presence.typing[c] = now
+		h.relay(c, typing(c, EventTyping))
+	case RequestTypingStopped:
+		h.stopTyping(c)
+	case RequestRead:
+		id := s.in.Data
+		if id == "" || len(id) > maxMarkerLength || id <= h.presence.reads[c.author] || !h.readable(c, id, s.stored) {
+			return
+		}
+		if h.presence.reads == nil {
+			h.presence.reads = make(map[string]string)
+		}
+		h.presence.reads[c.author] = id
+		m := event(EventReads, "")
+		m.Reads = map[string]string{c.author: id}
+		h.relay(nil, m)
+	}
+}
+
+// stopTyping tells the others c stopped typing, if it was.
+func (h *Hub) stopTyping(c *Client) {
+	if _, ok := h.presence.typing[c]; !ok {
+		return
+	}
+	delete(h.presence.typing, c)
+	h.relay(c, typing(c, EventTypingStopped))
+}
+
+func typing(c *Client, name string) *Message {
+	m := event(name, "")
+	m.Sender = c.ID
+	m.Name = c.Name
+	return m
+}
+
+// relay sends an ephemeral message to every client other than except,
+// without recording it. Clients too slow to take it just miss it.
+func (h *Hub) relay(except *Client, m *Message) {
+	for client := range h.clients {
+		if client == except {
+			continue
+		}
+		select {
+		case client.Send <- m:
+		default:
+		}
+	}
+}
+
+// readable reports whether id names a message c may see, kept in the
+// history or, as stored, recorded in the store.
+func (h *Hub) readable(c *Client, id string, stored *Message) bool {
+	if m := h.history.get(id); m != nil {
+		return m.visibleTo(c)
+	}
+	return stored != nil && stored.To == ""
+}
+
+// readsEvent returns the read markers of the members in the chat for a
+// joining client, or nil.
+func (h *Hub) readsEvent() *Message {
+	reads := make(map[string]string)
+	for client := range h.clients {
+		if id, ok := h.presence.reads[client.author]; ok {
+			reads[client.author] = id
+		}
+	}
+	if len(reads) == 0 {
+		return nil
+	}
+	m := event(EventReads, "")
+	m.Reads = reads
+	return m
+}
+
+// pruneReads drops the oldest markers of members that left once there are
+// more than maxReads.
+func (h *Hub) pruneReads() {
+	if len(h.presence.reads) <= maxReads {
+		return
+	}
+	present := make(map[string]bool, len(h.clients))
+	for client := range h.clients {
+		present[client.author] = true
+	}
+	var left []string
+	for author := range h.presence.reads {
+		if !present[author] {
+			left = append(left, author)
+		}
+	}
+	sort.Slice(left, func(i, j int) bool {
+		return h.presence.reads[left[i]] < h.presence.reads[left[j]]
+	})
+	for _, author := range left[:min(len(left), len(h.presence.reads)-maxReads)] {
+		delete(h.presence.reads, author)
+	}
+}
@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrStoreClosed is returned by a Store used after Close.
+	ErrStoreClosed     = errors.New("chat store closed")
+	ErrMessageNotFound = errors.New("chat message not found")
+	ErrNoAttachments   = errors.New("chat attachments are not enabled")
+)
+
+// Store records the chat messages of every room so they outlive the hub
+// and the process.
+type Store interface {
+	// Append records a message of a room.
+	Append(room string, m *Message) error
+	// Get returns the message of a room with the given ID.
+	Get(room, id string) (*Message, error)
+	// Update replaces a recorded message by the one with the same ID.
+	Update(room string, m *Message) error
+	// List returns messages of a room, oldest first, see Query.
+	List(room string, q Query) ([]*Message, error)
+	// Prune deletes the messages sent before t and reports how many.
+	Prune(t time.Time) (int, error)
+	Close() error
+}
+
+// Query selects a page of messages by message ID. With After set, List
+// returns the oldest messages after it; otherwise the newest messages
+// before Before, or the newest of all without it. A Limit of zero lists
+// everything.
+type Query struct {
+	After  string
+	Before string
+	Limit  int
+}
+
+// OpenStore opens the bbolt store at path, written in the background, or
+// an in-memory store when path is empty.
+func OpenStore(path string) (Store, error) {
+	if path == "" {
+		return NewMemoryStore(DefaultMemoryLimit), nil
+	}
+	s, err := NewBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncStore(s, DefaultWriteBuffer), nil
+}
+
+// UseStore makes hubs created from now on write through s.
+func UseStore(s Store) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	store = s
+}
+
+func currentStore() Store {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return store
+}
+
+// History pages through the recorded messages of a room.
+func History(room string, q Query) ([]*Message, error) {
+	return currentStore().List(room, q)
+}
+
+// page cuts the messages matching q out of sorted, which is ordered by ID.
+func page(sorted []*Message, q Query) []*Message {
+	start, end := 0, len(sorted)
+	for start < end && q.After != "" && sorted[start].ID <= q.After {
+		start++
+	}
+	for end > start && q.Before != "" && sorted[end-1].ID >= q.Before {
+		end--
+	}
+	if q.Limit > 0 && end-start > q.Limit {
+		if q.After != "" {
+			end = start + q.Limit
+		} else {
+			start = end - q.Limit
+		}
+	}
+	return append([]*Message{}, sorted[start:end]...)
+}
@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var queryTests = []struct {
+	name string
+	q    Query
+	want []string
+}{
+	{"all", Query{}, []string{"1", "2", "3", "4", "5"}},
+	{"newest", Query{Limit: 2}, []string{"4", "5"}},
+	{"after", Query{After: "2"}, []string{"3", "4", "5"}},
+	{"after with limit", Query{After: "2", Limit: 2}, []string{"3", "4"}},
+	{"after unknown", Query{After: "25"}, []string{"3", "4", "5"}},
+	{"after last", Query{After: "5"}, []string{}},
+	{"before", Query{Before: "4"}, []string{"1", "2", "3"}},
+	{"before with limit", Query{Before: "4", Limit: 2}, []string{"2", "3"}},
+	{"before unknown", Query{Before: "35"}, []string{"1", "2", "3"}},
+	{"before first", Query{Before: "1"}, []string{}},
+	{"before past end", Query{Before: "9", Limit: 1}, []string{"5"}},
+	{"between", Query{After: "1", Before: "5"}, []string{"2", "3", "4"}},
+	{"between with limit", Query{After: "1", Before: "5", Limit: 2}, []string{"2", "3"}},
+}
+
+func testMessages() []*Message {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var messages []*Message
+	for i, id := range []string{"1", "2", "3", "4", "5"} {
+		messages = append(messages, &Message{ID: id, Type: TypeText, Body: id, Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	return messages
+}
+
+func ids(messages []*Message) []string {
+	ids := []string{}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestPage(t *testing.T) {
+	messages := testMessages()
+	for _, tt := range queryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(page(messages, tt.q)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("page(%+v) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoltStoreList(t *testing.T) {
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Append out of order, the store orders by ID.
+	messages := testMessages()
+	for _, i := range []int{2, 0, 4, 1, 3} {
+		if err := s.Append("room", messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append("other", &Message{ID: "3", Type: TypeText}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range queryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List("room", tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids(got), tt.want) {
+				t.Errorf("List(%+v) = %v, want %v", tt.q, ids(got), tt.want)
+			}
+		})
+	}
+
+	got, err := s.List("missing", Query{})
+	if err != nil || len(got) != 0 {
+		t.Errorf("List of a missing room = %v, %v, want no messages", ids(got), err)
+	}
+}
+
+func TestMemoryStoreLimit(t *testing.T) {
+	s := NewMemoryStore(3)
+	for _, m := range testMessages() {
+		if err := s.Append("room", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _ := s.List("room", Query{})
+	if want := []string{"3", "4", "5"}; !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("List = %v, want %v", ids(got), want)
+	}
+}
+
+func TestAsyncStore(t *testing.T) {
+	s := NewAsyncStore(NewMemoryStore(0), 1)
+	messages := testMessages()
+	for _, m := range messages {
+		if err := s.Append("room", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edited := *messages[1]
+	edited.Body = "edited"
+	if err := s.Update("room", &edited); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := s.Get("room", "2"); err != nil || m.Body != "edited" {
+		t.Errorf("Get = %v, %v, want the edited message", m, err)
+	}
+	got, err := s.List("room", Query{After: "3"})
+	if err != nil || !reflect.DeepEqual(ids(got), []string{"4", "5"}) {
+		t.Errorf("List = %v, %v, want [4 5]", ids(got), err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append("room", &Message{ID: "6"}); err != ErrStoreClosed {
+		t.Errorf("Append after Close = %v, want %v", err, ErrStoreClosed)
+	}
+}
@@ -0,0 +1,308 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transcript formats.
+const (
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+var ErrUnknownFormat = errors.New("unknown transcript format, want json, markdown or html")
+
+// TranscriptOptions selects what a transcript covers and how it is
+// written.
+type TranscriptOptions struct {
+	Format string
+	// From and To bound the messages by server time, To excluded. Zero
+	// times leave that side open.
+	From time.Time
+	To   time.Time
+	// BaseURL is prefixed to the attachment links, which are relative to
+	// the server otherwise.
+	BaseURL string
+}
+
+// ParseFormat accepts the transcript formats with "md" for Markdown.
+func ParseFormat(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case FormatJSON:
+		return FormatJSON, nil
+	case FormatMarkdown, "md":
+		return FormatMarkdown, nil
+	case FormatHTML:
+		return FormatHTML, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, s)
+}
+
+// ContentType is the MIME type of a transcript format.
+func ContentType(format string) string {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// Extension is the file extension of a transcript format.
+func Extension(format string) string {
+	if format == FormatMarkdown {
+		return "md"
+	}
+	return format
+}
+
+// transcriptEntry is a message as it ends up in a transcript.
+type transcriptEntry struct {
+	ID         string         `json:"id"`
+	Time       time.Time      `json:"time"`
+	Type       MessageType    `json:"type"`
+	Sender     string         `json:"sender,omitempty"`
+	Name       string         `json:"name"`
+	Body       string         `json:"body"`
+	Edited     *time.Time     `json:"edited,omitempty"`
+	Parent     string         `json:"parent,omitempty"`
+	ParentName string         `json:"-"`
+	ParentBody string         `json:"-"`
+	Attachment *Attachment    `json:"attachment,omitempty"`
+	Reactions  map[string]int `json:"reactions,omitempty"`
+}
+
+type transcript struct {
+	Room     string            `json:"room"`
+	Exported time.Time         `json:"exported"`
+	From     *time.Time        `json:"from,omitempty"`
+	To       *time.Time        `json:"to,omitempty"`
+	Messages []transcriptEntry `json:"messages"`
+}
+
+// WriteTranscript writes the recorded chat of a room as a document. The
+// store holds every message in its final state, so edits and deletions
+// are applied: deleted messages are left out, as are events, which only
+// mattered live. Direct messages are never recorded and so never
+// exported.
+func WriteTranscript(w io.Writer, room string, opts TranscriptOptions) error {
+	messages, err := currentStore().List(room, Query{})
+	if err != nil {
+		return err
+	}
+	t := transcript{Room: room, Exported: time.Now().UTC(), Messages: []transcriptEntry{}}
+	if !opts.From.IsZero() {
+		from := opts.From.UTC()
+		t.From = &from
+	}
+	if !opts.To.IsZero() {
+		to := opts.To.UTC()
+		t.To = &to
+	}
+
+	byID := make(map[string]*Message, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+	}
+	for _, m := range messages {
+		if m.Type != TypeText && m.Type != TypeSystem {
+			continue
+		}
+		if (t.From != nil && m.Time.Before(*t.From)) || (t.To != nil && !m.Time.Before(*t.To)) {
+			continue
+		}
+		t.Messages = append(t.Messages, newTranscriptEntry(m, byID, opts.BaseURL))
+	}
+
+	switch opts.Format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	case FormatMarkdown:
+		return writeMarkdown(w, &t)
+	case FormatHTML:
+		return htmlTranscript.Execute(w, &t)
+	}
+	return ErrUnknownFormat
+}
+
+func newTranscriptEntry(m *Message, byID map[string]*Message, baseURL string) transcriptEntry {
+	e := transcriptEntry{
+		ID:     m.ID,
+		Time:   m.Time.UTC(),
+		Type:   m.Type,
+		Sender: m.Sender,
+		Name:   displayName(m),
+		Body:   m.Body,
+		Edited: m.Edited,
+		Parent: m.Parent,
+	}
+	if m.Parent != "" {
+		if parent, ok := byID[m.Parent]; ok && parent.Type == TypeText {
+			e.ParentName, e.ParentBody = displayName(parent), snippet(parent.Body)
+		} else {
+			e.ParentName, e.ParentBody = "", "a deleted message"
+		}
+	}
+	if m.Attachment != nil {
+		// Messages are shared with the store, so the link is set on a copy.
+		a := *m.Attachment
+		a.URL = baseURL + a.URL
+		if a.Thumbnail != "" {
+			a.Thumbnail = baseURL + a.Thumbnail
+		}
+		e.Attachment = &a
+	}
+	if len(m.Reactions) > 0 {
+		e.Reactions = make(map[string]int, len(m.Reactions))
+		for emoji, participants := range m.Reactions {
+			e.Reactions[emoji] = len(participants)
+		}
+	}
+	return e
+}
+
+// displayName names the sender of a message the way chat clients do.
+func displayName(m *Message) string {
+	switch {
+	case m.Type == TypeSystem:
+		return "System"
+	case m.Name != "":
+		return m.Name
+	case len(m.Sender) >= 4:
+		return "Guest " + m.Sender[:4]
+	}
+	return "Guest"
+}
+
+func snippet(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	if runes := []rune(body); len(runes) > 60 {
+		return string(runes[:60]) + "…"
+	}
+	return body
+}
+
+// SortedReactions lists the reactions of an entry as "👍 2" in a stable
+// order.
+func (e transcriptEntry) SortedReactions() []string {
+	out := make([]string, 0, len(e.Reactions))
+	for emoji, n := range e.Reactions {
+		out = append(out, fmt.Sprintf("%s %d", emoji, n))
+	}
+	sort.Strings(out)
+	return out
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`, "~", `\~`, "&", `\&`,
+)
+
+// markdownLineStart matches the list items and heading underlines a line
+// of a body would start.
+var markdownLineStart = regexp.MustCompile(`^([ \t]*\d*)([-+=.)])`)
+
+// markdownBody escapes a body, whose continuation lines stay in the same
+// paragraph.
+func markdownBody(body string) string {
+	lines := strings.Split(markdownEscaper.Replace(body), "\n")
+	for i := 1; i < len(lines); i++ {
+		lines[i] = markdownLineStart.ReplaceAllString(lines[i], `$1\$2`)
+	}
+	return strings.Join(lines, "  \n")
+}
+
+func writeMarkdown(w io.Writer, t *transcript) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Chat transcript of room %s\n\n", t.Room)
+	fmt.Fprintf(&b, "Exported %s", t.Exported.Format(time.RFC3339))
+	if t.From != nil {
+		fmt.Fprintf(&b, ", from %s", t.From.Format(time.RFC3339))
+	}
+	if t.To != nil {
+		fmt.Fprintf(&b, ", until %s", t.To.Format(time.RFC3339))
+	}
+	b.WriteString(". Times are UTC.\n")
+
+	day := ""
+	for _, e := range t.Messages {
+		if d := e.Time.Format("2006-01-02"); d != day {
+			day = d
+			fmt.Fprintf(&b, "\n## %s\n\n", day)
+		}
+		fmt.Fprintf(&b, "**%s** **%s**: ", e.Time.Format("15:04:05"), markdownEscaper.Replace(e.Name))
+		b.WriteString(markdownBody(e.Body))
+		if e.Edited != nil {
+			fmt.Fprintf(&b, " _(edited %s)_", e.Edited.UTC().Format("15:04:05"))
+		}
+		b.WriteString("  \n")
+		if e.Parent != "" {
+			if e.ParentName != "" {
+				fmt.Fprintf(&b, "↪ in reply to **%s**: %s  \n", markdownEscaper.Replace(e.ParentName), markdownEscaper.Replace(e.ParentBody))
+			} else {
+				fmt.Fprintf(&b, "↪ in reply to %s  \n", e.ParentBody)
+			}
+		}
+		if a := e.Attachment; a != nil {
+			fmt.Fprintf(&b, "📎 [%s](<%s>) (%s, %d bytes)  \n", markdownEscaper.Replace(a.Name), a.URL, a.Type, a.Size)
+		}
+		if len(e.Reactions) > 0 {
+			fmt.Fprintf(&b, "Reactions: %s  \n", strings.Join(e.SortedReactions(), ", "))
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var htmlTranscript = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Chat transcript of room {{ .Room }}</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; color: #363636; }
+.message { margin: 0.75em 0; }
+.time, .meta { color: #7a7a7a; font-size: 0.85em; }
+.system { color: #3e8ed0; }
+.body { white-space: pre-wrap; }
+img { display: block; max-width: 320px; margin-top: 0.25em; }
+</style>
+</head>
+<body>
+<h1>Chat transcript of room {{ .Room }}</h1>
+<p class="meta">Exported {{ .Exported.Format "2006-01-02 15:04:05" }} UTC
+{{- with .From }}, from {{ .Format "2006-01-02 15:04:05" }}{{ end }}
+{{- with .To }}, until {{ .Format "2006-01-02 15:04:05" }}{{ end }}. Times are UTC.</p>
+{{- range .Messages }}
+<div class="message{{ if eq .Type "system" }} system{{ end }}" id="msg-{{ .ID }}">
+{{- if .Parent }}
+<div class="meta">&#8618; in reply to {{ if .ParentName }}<a href="#msg-{{ .Parent }}"><strong>{{ .ParentName }}</strong></a>: {{ end }}{{ .ParentBody }}</div>
+{{- end }}
+<span class="time" title="{{ .Time.Format "2006-01-02 15:04:05" }}">{{ .Time.Format "15:04:05" }}</span>
+<strong>{{ .Name }}</strong>: <span class="body">{{ .Body }}</span>
+{{- with .Edited }} <span class="meta">(edited {{ .UTC.Format "15:04:05" }})</span>{{ end }}
+{{- with .Attachment }}
+<div><a href="{{ .URL }}">&#128206; {{ .Name }}</a> <span class="meta">({{ .Type }}, {{ .Size }} bytes)</span>
+{{- if .Thumbnail }}<a href="{{ .URL }}"><img src="{{ .Thumbnail }}" alt="{{ .Name }}"></a>{{ end }}</div>
+{{- end }}
+{{- with .SortedReactions }}
+<div class="meta">{{ range $i, $r := . }}{{ if $i }}, {{ end }}{{ $r }}{{ end }}</div>
+{{- end }}
+</div>
+{{- end }}
+</body>
+</html>
+`))
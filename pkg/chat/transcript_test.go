@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// exportedTime matches the export time, the only part of a transcript that
+// changes from run to run.
+var exportedTime = regexp.MustCompile(`("exported": |Exported )("[^"]*"|[0-9-]+[T ][0-9:]+Z?)`)
+
+// transcriptMessages is a chat with hostile bodies, an edit, a reply, an
+// attachment, reactions, a deleted message and an event.
+func transcriptMessages() []*Message {
+	start := time.Date(2026, 1, 1, 23, 59, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	edited := at(2 * time.Minute)
+	return []*Message{
+		{ID: "01", Type: TypeText, Time: at(-time.Hour), Sender: "early-sender", Body: "before the range"},
+		{ID: "02", Type: TypeSystem, Time: at(0), Body: "Alice joined"},
+		{ID: "03", Type: TypeText, Time: at(time.Second), Sender: "abcdef", Name: "<b>Alice</b> *",
+			Body: "<script>alert(1)</script> [x](javascript:alert(1)) ![i](http://x/i.png) `code` ```fence``` &amp; a_b|c~d # h"},
+		{ID: "04", Type: TypeText, Time: at(time.Minute), Sender: "bob123", Body: "multi\n- item\n1. one\n===\n---\n  # heading\n> quote",
+			Edited: &edited, Reactions: map[string][]string{"👍": {"a", "b"}, "🎉": {"c"}}},
+		{ID: "05", Type: TypeDeleted, Time: at(90 * time.Second)},
+		{ID: "06", Type: TypeText, Time: at(2 * time.Minute), Sender: "carol9", Name: "Carol", Parent: "03", Body: "reply"},
+		{ID: "07", Type: TypeText, Time: at(3 * time.Minute), Sender: "carol9", Name: "Carol", Parent: "05", Body: "reply to deleted"},
+		{ID: "08", Type: TypeEvent, Time: at(3 * time.Minute), Body: EventTyping},
+		{ID: "09", Type: TypeText, Time: at(4 * time.Minute), Sender: "dan", Name: "Dan",
+			Attachment: &Attachment{ID: "f1", Name: "<evil>](x).png", Type: "image/png", Size: 42,
+				URL: "/files/f1", Thumbnail: "/files/f1/thumbnail"}},
+		{ID: "10", Type: TypeText, Time: at(30 * time.Minute), Sender: "late-sender", Body: "at the end of the range"},
+	}
+}
+
+func TestWriteTranscript(t *testing.T) {
+	previous := currentStore()
+	t.Cleanup(func() { UseStore(previous) })
+	s := NewMemoryStore(0)
+	for _, m := range transcriptMessages() {
+		if err := s.Append("room", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	UseStore(s)
+
+	start := time.Date(2026, 1, 1, 23, 59, 0, 0, time.UTC)
+	for _, format := range []string{FormatJSON, FormatMarkdown, FormatHTML} {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			err := WriteTranscript(&b, "room", TranscriptOptions{
+				Format:  format,
+				From:    start,
+				To:      start.Add(30 * time.Minute),
+				BaseURL: "https://pinzoom.example",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := exportedTime.ReplaceAll(b.Bytes(), []byte("${1}EXPORTED"))
+
+			golden := filepath.Join("testdata", "transcript."+Extension(format))
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("transcript differs from %s:\n%s", golden, got)
+			}
+		})
+	}
+
+	if err := WriteTranscript(&bytes.Buffer{}, "room", TranscriptOptions{Format: "pdf"}); err != ErrUnknownFormat {
+		t.Errorf("unknown format = %v, want %v", err, ErrUnknownFormat)
+	}
+}
@@ -0,0 +1,272 @@
+// Package files keeps the documents and images shared in room chats.
+package files
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Defaults of the upload limits.
+const (
+	DefaultMaxSize    = 10 << 20
+	DefaultTypes      = "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain"
+	DefaultRoomQuota  = 200 << 20
+	DefaultOwnerQuota = 50 << 20
+)
+
+// maxNameLength bounds the file names kept with attachments.
+const maxNameLength = 255
+
+var (
+	ErrTooLarge = errors.New("file is too large")
+	ErrType     = errors.New("file type is not allowed")
+	ErrEmpty    = errors.New("file is empty")
+	ErrQuota    = errors.New("upload quota exceeded")
+)
+
+// Quota bounds the bytes stored per room and per uploading person. Zero
+// leaves a bound off.
+type Quota struct {
+	Room  int64
+	Owner int64
+}
+
+// Attachment describes a file uploaded to a room.
+type Attachment struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// Uploader is the chat ID of the client that uploaded the file; only
+	// it may post the file into the chat.
+	Uploader string `json:"uploader"`
+	// Owner is an opaque key of the person behind the upload, whose
+	// quota it counts against.
+	Owner     string    `json:"owner"`
+	Thumbnail bool      `json:"thumbnail"`
+	Time      time.Time `json:"time"`
+}
+
+// Files stores attachments with their metadata and thumbnails in a
+// Storage, under the keys <id>, <id>.json and <id>.thumb.
+type Files struct {
+	storage Storage
+	maxSize int64
+	types   map[string]bool
+	quota   Quota
+
+	// usage counts the bytes stored per room and per room and owner
+	// since the process started.
+	mu    sync.Mutex
+	usage map[string]int64
+}
+
+// New creates the attachment store. Uploads are refused above maxSize
+// bytes, when their sniffed MIME type is not in types or past quota.
+func New(storage Storage, maxSize int64, types []string, quota Quota) *Files {
+	f := &Files{
+		storage: storage,
+		maxSize: maxSize,
+		types:   make(map[string]bool),
+		quota:   quota,
+		usage:   make(map[string]int64),
+	}
+	for _, t := range types {
+		if t = strings.TrimSpace(t); t != "" {
+			f.types[t] = true
+		}
+	}
+	return f
+}
+
+// MaxSize is the largest upload accepted, in bytes.
+func (f *Files) MaxSize() int64 {
+	return f.maxSize
+}
+
+// Upload stores the content of r as an attachment of room, uploaded by the
+// chat client uploader on behalf of owner, with a thumbnail when it is an
+// image.
+func (f *Files) Upload(room, uploader, owner, name string, r io.Reader) (*Attachment, error) {
+	if !f.charge(room, owner, 0) {
+		return nil, ErrQuota
+	}
+
+	// The type is sniffed from the content, the client's word for it is
+	// not trusted.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrEmpty
+	}
+	head = head[:n]
+	typ, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !f.types[typ] {
+		return nil, fmt.Errorf("%w: %s", ErrType, typ)
+	}
+
+	a := &Attachment{
+		ID:       uuid.NewString(),
+		Room:     room,
+		Name:     cleanName(name),
+		Type:     typ,
+		Uploader: uploader,
+		Owner:    owner,
+		Time:     time.Now().UTC(),
+	}
+	limited := io.LimitReader(io.MultiReader(bytes.NewReader(head), r), f.maxSize+1)
+	if a.Size, err = f.storage.Put(a.ID, limited); err != nil {
+		f.storage.Delete(a.ID)
+		return nil, fmt.Errorf("error storing upload, err=%v", err)
+	}
+	if a.Size > f.maxSize {
+		f.storage.Delete(a.ID)
+		return nil, ErrTooLarge
+	}
+	if !f.charge(room, owner, a.Size) {
+		f.storage.Delete(a.ID)
+		return nil, ErrQuota
+	}
+
+	if thumbnailable(typ) {
+		a.Thumbnail = f.makeThumbnail(a.ID) == nil
+	}
+	if err := f.putMeta(a); err != nil {
+		f.delete(a.ID)
+		f.release(a)
+		return nil, err
+	}
+	return a, nil
+}
+
+func ownerKey(room, owner string) string {
+	return room + "/" + owner
+}
+
+// charge counts size bytes against the quotas of room and owner, unless
+// that would exceed one of them; a size of zero checks there is room left.
+func (f *Files) charge(room, owner string, size int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	roomUsage, ownerUsage := f.usage[room]+size, f.usage[ownerKey(room, owner)]+size
+	if size == 0 {
+		roomUsage, ownerUsage = roomUsage+1, ownerUsage+1
+	}
+	if (f.quota.Room > 0 && roomUsage > f.quota.Room) ||
+		(f.quota.Owner > 0 && ownerUsage > f.quota.Owner) {
+		return false
+	}
+	if size > 0 {
+		f.usage[room] += size
+		f.usage[ownerKey(room, owner)] += size
+	}
+	return true
+}
+
+// release gives the bytes of a deleted attachment back to its quotas.
+func (f *Files) release(a *Attachment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range []string{a.Room, ownerKey(a.Room, a.Owner)} {
+		if f.usage[key] -= a.Size; f.usage[key] <= 0 {
+			delete(f.usage, key)
+		}
+	}
+}
+
+// Get returns the attachment with the given ID, or ErrNotFound.
+func (f *Files) Get(id string) (*Attachment, error) {
+	rc, err := f.storage.Open(id + ".json")
+	if errors.Is(err, ErrInvalidKey) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var a Attachment
+	if err := json.NewDecoder(rc).Decode(&a); err != nil {
+		return nil, fmt.Errorf("error decoding attachment %s, err=%v", id, err)
+	}
+	return &a, nil
+}
+
+// Open returns the content of an attachment.
+func (f *Files) Open(id string) (io.ReadCloser, error) {
+	return f.storage.Open(id)
+}
+
+// OpenThumbnail returns the JPEG thumbnail of an image attachment.
+func (f *Files) OpenThumbnail(id string) (io.ReadCloser, error) {
+	return f.storage.Open(id + ".thumb")
+}
+
+// Prune deletes the attachments uploaded before t and reports how many.
+func (f *Files) Prune(t time.Time) (int, error) {
+	keys, err := f.storage.Keys()
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, key := range keys {
+		id, ok := strings.CutSuffix(key, ".json")
+		if !ok {
+			continue
+		}
+		a, err := f.Get(id)
+		if err != nil || a.Time.Before(t) {
+			f.delete(id)
+			if a != nil {
+				f.release(a)
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (f *Files) putMeta(a *Attachment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if _, err := f.storage.Put(a.ID+".json", bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("error storing attachment metadata, err=%v", err)
+	}
+	return nil
+}
+
+func (f *Files) delete(id string) {
+	for _, key := range []string{id + ".json", id, id + ".thumb"} {
+		f.storage.Delete(key)
+	}
+}
+
+// cleanName keeps the base name of an uploaded file, bounded in length.
+func cleanName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || !utf8.ValidString(name) {
+		name = "file"
+	}
+	for len(name) > maxNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
@@ -0,0 +1,110 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	ErrNotFound   = errors.New("file not found")
+	ErrInvalidKey = errors.New("invalid storage key")
+)
+
+// Storage keeps the blobs behind attachments under flat keys.
+type Storage interface {
+	// Put stores the content of r under key, replacing what was there.
+	Put(key string, r io.Reader) (int64, error)
+	// Open returns the content under key, or ErrNotFound.
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// Keys lists the stored keys.
+	Keys() ([]string, error)
+}
+
+// keyRe keeps keys to names that are safe as file names.
+var keyRe = regexp.MustCompile(`^[0-9a-zA-Z][0-9a-zA-Z._-]*$`)
+
+// DiskStorage keeps blobs as files of a directory.
+type DiskStorage struct {
+	dir string
+}
+
+// NewDiskStorage uses dir, creating it if needed.
+func NewDiskStorage(dir string) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating upload directory %s, err=%v", dir, err)
+	}
+	return &DiskStorage{dir: dir}, nil
+}
+
+func (s *DiskStorage) path(key string) (string, error) {
+	if !keyRe.MatchString(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+// Put writes to a temporary file first, so readers never see a partial
+// blob.
+func (s *DiskStorage) Put(key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskStorage) Open(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *DiskStorage) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStorage) Keys() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() && keyRe.MatchString(e.Name()) {
+			keys = append(keys, e.Name())
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,97 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+const (
+	// thumbnailSize bounds the longer side of thumbnails.
+	thumbnailSize = 320
+	// maxPixels refuses to decode images that would take too much memory.
+	maxPixels = 16_000_000
+)
+
+// thumbnailSlots bounds how many images are decoded at once, so a burst
+// of uploads can't take more than a few decoded images worth of memory.
+var thumbnailSlots = make(chan struct{}, 2)
+
+var errTooManyPixels = errors.New("image too large for a thumbnail")
+
+func thumbnailable(typ string) bool {
+	return typ == "image/png" || typ == "image/jpeg" || typ == "image/gif"
+}
+
+// makeThumbnail stores a JPEG thumbnail of the image attachment id.
+func (f *Files) makeThumbnail(id string) error {
+	rc, err := f.storage.Open(id)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return errTooManyPixels
+	}
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scale(img, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return err
+	}
+	_, err = f.storage.Put(id+".thumb", &buf)
+	return err
+}
+
+// scale shrinks img so its longer side is at most size, averaging the
+// source pixels under each target pixel.
+func scale(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	tw, th = max(tw, 1), max(th, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+max((y+1)*h/th, y*h/th+1)
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+max((x+1)*w/tw, x*w/tw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -3,8 +3,10 @@ package hub
 import (
 	"net"
 	"net/http"
+	"pinzoom/pkg/logger"
 
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 type Proto int
@@ -18,9 +20,13 @@ type Ctx struct {
 	Request   *http.Request
 	Response  http.ResponseWriter
 	WebSocket *websocket.Conn
+	// Log carries the request ID and, once known, the room, stream and
+	// participant IDs of this request.
+	Log *logrus.Entry
 
 	conn   net.Conn
 	params map[string]string
+	route  string
 }
 
 func NewContext(
@@ -36,6 +42,7 @@ func NewContext(
 		conn:      conn,
 		params:    params,
 		WebSocket: ws,
+		Log:       logger.For("router"),
 	}
 }
 
@@ -55,6 +62,15 @@ func (c *Ctx) SetParams(params map[string]string) {
 	c.params = params
 }
 
+// Route returns the pattern of the matched route, e.g. "/room/:uuid".
+func (c *Ctx) Route() string {
+	return c.route
+}
+
+func (c *Ctx) SetRoute(route string) {
+	c.route = route
+}
+
 func (c *Ctx) Proto() Proto {
 	if c.WebSocket == nil {
 		return ProtoHttp
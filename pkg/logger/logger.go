@@ -0,0 +1,118 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Field names shared by every subsystem so lines can be correlated.
+const (
+	FieldRequest     = "request_id"
+	FieldRoom        = "room"
+	FieldStream      = "stream"
+	FieldParticipant = "participant"
+	FieldIdentity    = "identity"
+	FieldSubsystem   = "subsystem"
+)
+
+var (
+	mu         sync.Mutex
+	formatter  logrus.Formatter = textFormatter()
+	output     io.Writer        = os.Stdout
+	level                       = logrus.InfoLevel
+	levels                      = map[string]logrus.Level{}
+	subsystems                  = map[string]*logrus.Logger{}
+)
+
+// Setup configures the format and the levels of all subsystem loggers and
+// of the standard logrus logger. spec overrides the level per subsystem and
+// looks like "router=debug,webrtc=warn".
+func Setup(format, defaultLevel, spec string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch format {
+	case "text":
+		formatter = textFormatter()
+	case "json":
+		formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	lvl, err := logrus.ParseLevel(defaultLevel)
+	if err != nil {
+		return err
+	}
+	level = lvl
+
+	levels = map[string]logrus.Level{}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid log level %q, want subsystem=level", pair)
+		}
+		if levels[name], err = logrus.ParseLevel(value); err != nil {
+			return err
+		}
+	}
+
+	configure(logrus.StandardLogger(), "")
+	for name, l := range subsystems {
+		configure(l, name)
+	}
+	return nil
+}
+
+// For returns the logger of a subsystem such as "router", "webrtc" or "chat".
+func For(subsystem string) *logrus.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+
+	l, ok := subsystems[subsystem]
+	if !ok {
+		l = logrus.New()
+		configure(l, subsystem)
+		subsystems[subsystem] = l
+	}
+	return l.WithField(FieldSubsystem, subsystem)
+}
+
+// Into moves the correlation fields of entry onto the logger of another
+// subsystem, so a request logged by the router keeps its IDs in webrtc.
+func Into(subsystem string, entry *logrus.Entry) *logrus.Entry {
+	fields := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if k != FieldSubsystem {
+			fields[k] = v
+		}
+	}
+	return For(subsystem).WithFields(fields)
+}
+
+func configure(l *logrus.Logger, subsystem string) {
+	l.SetFormatter(formatter)
+	l.SetOutput(output)
+	if lvl, ok := levels[subsystem]; ok {
+		l.SetLevel(lvl)
+	} else {
+		l.SetLevel(level)
+	}
+}
+
+func textFormatter() logrus.Formatter {
+	return &logrus.TextFormatter{
+		ForceColors:     true,
+		FullTimestamp:   true,
+		TimestampFormat: time.DateTime,
+	}
+}
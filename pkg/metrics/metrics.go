@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pinzoom"
+
+// Registry holds every pinzoom metric plus the Go runtime and process
+// collectors. Packages that report gauges at scrape time register their
+// own collectors here.
+var Registry = prometheus.NewRegistry()
+
+var (
+	RTPPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_packets_total",
+		Help:      "RTP packets received from publishers (in) and sent to subscribers (out).",
+	}, []string{"direction"})
+
+	RTPBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_bytes_total",
+		Help:      "RTP payload and header bytes received (in) and sent (out).",
+	}, []string{"direction"})
+
+	RTPDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rtp_dropped_packets_total",
+		Help:      "RTP packets read from a publisher that could not be forwarded.",
+	})
+
+	NegotiationAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "negotiation_attempts_total",
+		Help:      "Passes of SignalPeerConnections over the peers of a room.",
+	})
+
+	NegotiationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "negotiation_failures_total",
+		Help:      "Failed negotiation passes; reason is retry or gave_up after too many attempts.",
+	}, []string{"reason"})
+
+	WebsocketConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Open websocket connections by route.",
+	}, []string{"route"})
+
+	ChatMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chat_messages_total",
+		Help:      "Chat messages received from clients.",
+	})
+
+	ChatModeration = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chat_moderation_actions_total",
+		Help:      "Automatic chat moderation; action is blocked, flagged, warned or disconnected, reason the offense.",
+	}, []string{"action", "reason"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of routed HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RTPPackets,
+		RTPBytes,
+		RTPDropped,
+		NegotiationAttempts,
+		NegotiationFailures,
+		WebsocketConnections,
+		ChatMessages,
+		ChatModeration,
+		HTTPDuration,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
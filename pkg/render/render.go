@@ -0,0 +1,84 @@
+package render
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	layoutsGlob  = "layouts/*.html"
+	partialsGlob = "partials/*.html"
+	pagesGlob    = "*.html"
+)
+
+// Registry parses every page once together with the shared layouts and
+// partials. In dev mode the templates are reparsed before each render so
+// edits on disk show up without a restart.
+type Registry struct {
+	fsys  fs.FS
+	dev   bool
+	funcs template.FuncMap
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+func New(fsys fs.FS, dev bool, funcs template.FuncMap) (*Registry, error) {
+	r := &Registry{fsys: fsys, dev: dev, funcs: funcs}
+	if err := r.Load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load parses all pages from the registry filesystem and swaps them in.
+func (r *Registry) Load() error {
+	base, err := template.New("").Funcs(r.funcs).ParseFS(r.fsys, layoutsGlob, partialsGlob)
+	if err != nil {
+		return fmt.Errorf("error parsing layouts, err=%v", err)
+	}
+
+	files, err := fs.Glob(r.fsys, pagesGlob)
+	if err != nil {
+		return err
+	}
+
+	pages := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		tmpl, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if tmpl, err = tmpl.ParseFS(r.fsys, file); err != nil {
+			return fmt.Errorf("error parsing page %s, err=%v", file, err)
+		}
+		pages[strings.TrimSuffix(path.Base(file), path.Ext(file))] = tmpl
+	}
+
+	r.mu.Lock()
+	r.pages = pages
+	r.mu.Unlock()
+	return nil
+}
+
+// Render executes the "main" layout of the named page into w.
+func (r *Registry) Render(w io.Writer, page string, data interface{}) error {
+	if r.dev {
+		if err := r.Load(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.RLock()
+	tmpl, ok := r.pages[page]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("page %q is not registered", page)
+	}
+	return tmpl.ExecuteTemplate(w, "main", data)
+}
@@ -1,9 +1,22 @@
 package router
 
 import (
-	"github.com/sirupsen/logrus"
+	"crypto/subtle"
 	"net/http"
+	"net/url"
 	"pinzoom/pkg/hub"
+	"pinzoom/pkg/metrics"
+	"pinzoom/pkg/tracing"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func CORSMiddleware(next HandlerFunc) HandlerFunc {
@@ -26,7 +39,7 @@ func ErrorMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx *hub.Ctx) error {
 		defer func() {
 			if err := recover(); err != nil {
-				logrus.Printf("Internal server error: %v", err)
+				ctx.Log.Errorf("Internal server error: %v", err)
 				http.Error(ctx.Response, "Internal Server Error", http.StatusInternalServerError)
 			}
 		}()
@@ -34,3 +47,131 @@ func ErrorMiddleware(next HandlerFunc) HandlerFunc {
 		return next(ctx)
 	}
 }
+
+// MetricsMiddleware records the latency of every routed request by route
+// pattern, so parameters such as room IDs don't explode the label set.
+func MetricsMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *hub.Ctx) error {
+		start := time.Now()
+		err := next(ctx)
+
+		metrics.HTTPDuration.
+			WithLabelValues(ctx.Request.Method, ctx.Route(), strconv.Itoa(responseStatus(ctx))).
+			Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// AuthMiddleware rejects requests that carry neither the bearer token nor
+// the basic auth credentials. An empty token or user disables that scheme,
+// leaving both empty disables the check.
+func AuthMiddleware(token, user, password string) func(HandlerFunc) HandlerFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *hub.Ctx) error {
+			if token == "" && user == "" {
+				return next(ctx)
+			}
+			if token != "" {
+				bearer, ok := strings.CutPrefix(ctx.Request.Header.Get("Authorization"), "Bearer ")
+				if ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+					return next(ctx)
+				}
+			}
+			if user != "" {
+				u, p, ok := ctx.Request.BasicAuth()
+				if ok &&
+					subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 &&
+					subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+					return next(ctx)
+				}
+				ctx.Response.Header().Set("WWW-Authenticate", `Basic realm="pinzoom admin"`)
+			}
+			http.Error(ctx.Response, "Unauthorized", http.StatusUnauthorized)
+			return nil
+		}
+	}
+}
+
+// SameOriginMiddleware rejects browser requests sent from another origin,
+// so pages elsewhere can't ride on credentials the browser has cached for
+// the admin listener.
+func SameOriginMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *hub.Ctx) error {
+		origin := ctx.Request.Header.Get("Origin")
+		if origin == "" {
+			return next(ctx)
+		}
+		if u, err := url.Parse(origin); err != nil || u.Host != ctx.Request.Host {
+			http.Error(ctx.Response, "Forbidden", http.StatusForbidden)
+			return nil
+		}
+		return next(ctx)
+	}
+}
+
+// LoggingMiddleware writes one line per routed request with its method,
+// path, status, body size and duration.
+func LoggingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *hub.Ctx) error {
+		start := time.Now()
+		err := next(ctx)
+
+		fields := logrus.Fields{
+			"method":   ctx.Request.Method,
+			"path":     ctx.Request.URL.Path,
+			"status":   responseStatus(ctx),
+			"duration": time.Since(start).String(),
+		}
+		if resp, ok := ctx.Response.(*Response); ok {
+			fields["bytes"] = resp.Written()
+		}
+		if sc := trace.SpanContextFromContext(ctx.Request.Context()); sc.IsValid() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		ctx.Log.WithFields(fields).Info("request")
+		return err
+	}
+}
+
+// responseStatus reports 101 for upgraded websockets, whose handshake is
+// written on the hijacked connection.
+func responseStatus(ctx *hub.Ctx) int {
+	if ctx.Proto() == hub.ProtoWS {
+		return http.StatusSwitchingProtocols
+	}
+	if resp, ok := ctx.Response.(*Response); ok && resp.Status() != 0 {
+		return resp.Status()
+	}
+	return http.StatusOK
+}
+
+// TracingMiddleware starts a server span per routed request, continuing the
+// trace of the caller when it sends a traceparent header. The span context
+// is stored on ctx.Request so handlers can add child spans and attributes.
+func TracingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx *hub.Ctx) error {
+		parent := otel.GetTextMapPropagator().Extract(ctx.Request.Context(), propagation.HeaderCarrier(ctx.Request.Header))
+		spanCtx, span := tracing.Tracer.Start(parent, ctx.Request.Method+" "+ctx.Route(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(ctx.Request.Method),
+				semconv.HTTPRoute(ctx.Route()),
+				semconv.URLPath(ctx.Request.URL.Path),
+				tracing.AttrRequest.String(ctx.Response.Header().Get(requestIDHeader)),
+			))
+		defer span.End()
+		ctx.Request = ctx.Request.WithContext(spanCtx)
+
+		err := next(ctx)
+
+		status := responseStatus(ctx)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
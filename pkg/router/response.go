@@ -11,6 +11,7 @@ type Response struct {
 	conn        net.Conn
 	header      http.Header
 	status      int
+	written     int64
 	headersSent bool
 }
 
@@ -52,7 +53,20 @@ func (w *Response) Write(data []byte) (int, error) {
 		w.headersSent = true
 	}
 
-	return w.conn.Write(data)
+	n, err := w.conn.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+// Status returns the status code sent to the client, or 0 if nothing has
+// been written yet.
+func (w *Response) Status() int {
+	return w.status
+}
+
+// Written returns the number of body bytes sent to the client.
+func (w *Response) Written() int64 {
+	return w.written
 }
 
 func NewResponseWriter(conn net.Conn) *Response {
@@ -2,28 +2,37 @@ package router
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"pinzoom/pkg/hub"
+	"pinzoom/pkg/logger"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
-	"github.com/sirupsen/logrus"
+	"github.com/google/uuid"
 )
 
+// requestIDHeader is honoured when set by a proxy and echoed back otherwise.
+const requestIDHeader = "X-Request-ID"
+
+var log = logger.For("router")
+
 type HandlerFunc func(*hub.Ctx) error
 
 type Router struct {
 	routes     []Route
-	assetsDir  string
+	assets     *Assets
 	middleware []func(HandlerFunc) HandlerFunc
+	listening  atomic.Bool
 }
 
 type Route struct {
 	method  string
+	path    string
 	regex   *regexp.Regexp
 	handler HandlerFunc
 }
@@ -43,6 +52,14 @@ func (r *Router) Get(path string, handler HandlerFunc) {
 	r.Add(http.MethodGet, path, handler)
 }
 
+func (r *Router) Post(path string, handler HandlerFunc) {
+	r.Add(http.MethodPost, path, handler)
+}
+
+func (r *Router) Delete(path string, handler HandlerFunc) {
+	r.Add(http.MethodDelete, path, handler)
+}
+
 func (r *Router) Add(method, path string, handler HandlerFunc) {
 	regexPath := regexp.MustCompile(`:([a-zA-Z0-9_]+)`)
 	regexPattern := regexPath.ReplaceAllString(path, `(?P<$1>[^/]+)`)
@@ -51,13 +68,23 @@ func (r *Router) Add(method, path string, handler HandlerFunc) {
 	regex := regexp.MustCompile(regexPattern)
 	r.routes = append(r.routes, Route{
 		method:  method,
+		path:    path,
 		regex:   regex,
 		handler: handler,
 	})
 }
 
-func (r *Router) Static(dir string) {
-	r.assetsDir = dir
+// Static serves assets for any path that matches no route.
+func (r *Router) Static(assets *Assets) {
+	r.assets = assets
+}
+
+// HTTPHandler adapts a net/http handler to the router.
+func HTTPHandler(h http.Handler) HandlerFunc {
+	return func(ctx *hub.Ctx) error {
+		h.ServeHTTP(ctx.Response, ctx.Request)
+		return nil
+	}
 }
 
 func (r *Router) Serve(ctx *hub.Ctx) error {
@@ -71,6 +98,7 @@ func (r *Router) Serve(ctx *hub.Ctx) error {
 				}
 			}
 			ctx.SetParams(params)
+			ctx.SetRoute(route.path)
 
 			// Apply middleware in registered order
 			for _, mw := range r.middleware {
@@ -78,38 +106,87 @@ func (r *Router) Serve(ctx *hub.Ctx) error {
 			}
 
 			if err := route.handler(ctx); err != nil {
-				logrus.Error("Error handling request:", err)
+				ctx.Log.Error("Error handling request: ", err)
 			}
 			return nil
 		}
 	}
 
 	// Serve static files securely
-	if r.assetsDir != "" {
-		filePath := filepath.Join(r.assetsDir, filepath.Clean(strings.TrimPrefix(ctx.Request.URL.Path, "/")))
-		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-			http.ServeFile(ctx.Response, ctx.Request, filePath)
-			return nil
-		}
+	if r.assets != nil && r.assets.Serve(ctx) {
+		return nil
 	}
 
 	http.NotFound(ctx.Response, ctx.Request)
 	return nil
 }
 
-func (r *Router) ListenAndServe(addr string) error {
-	listener, err := net.Listen("tcp", addr)
+// ListenAndServe binds addr and serves it until ctx is cancelled. A bind
+// failure is returned instead of being logged.
+func (r *Router) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return r.ServeListener(ctx, listener)
+}
+
+// UnixPrefix marks a listener address as a Unix socket path.
+const UnixPrefix = "unix:"
+
+// Listen binds addr, so callers can fail startup before serving anything.
+// Addresses starting with UnixPrefix bind a Unix socket that only the
+// owner may connect to; a socket left behind by a previous run is removed.
+func Listen(addr string) (net.Listener, error) {
+	path, unix := strings.CutPrefix(addr, UnixPrefix)
+	if !unix {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("error binding %s, err=%v", addr, err)
+		}
+		return listener, nil
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale socket %s, err=%v", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
 	if err != nil {
-		logrus.Error("Error starting TCP listener:", err)
+		return nil, fmt.Errorf("error binding %s, err=%v", addr, err)
 	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error restricting %s, err=%v", path, err)
+	}
+	return listener, nil
+}
+
+// ServeListener accepts connections until ctx is cancelled, then closes the
+// listener so no new connections are taken. Connections that are already
+// being served are left running.
+func (r *Router) ServeListener(ctx context.Context, listener net.Listener) error {
 	defer listener.Close()
+	addr := listener.Addr().String()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 
-	logrus.Printf("Server is running on %s\n", addr)
+	r.listening.Store(true)
+	defer r.listening.Store(false)
+	log.Printf("Server is running on %s", addr)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			logrus.Println("Error accepting connection:", err)
+			if ctx.Err() != nil {
+				log.Printf("Server on %s stopped accepting connections", addr)
+				return nil
+			}
+			log.Error("Error accepting connection: ", err)
 			continue
 		}
 
@@ -117,26 +194,32 @@ func (r *Router) ListenAndServe(addr string) error {
 	}
 }
 
+// Listening reports whether the router is accepting connections.
+func (r *Router) Listening() bool {
+	return r.listening.Load()
+}
+
 func (r *Router) handleConnection(c net.Conn) {
 	defer c.Close()
 	ctx := hub.NewContext(nil, nil, nil, nil, c)
-	buf := make([]byte, 1024)
-	n, err := c.Read(buf)
-	if err != nil {
-		logrus.Println("Error reading fd:", err)
-		return
-	}
-	reader := bytes.NewBuffer(buf[:n])
-	req, err := http.ReadRequest(bufio.NewReader(reader))
+	req, err := http.ReadRequest(bufio.NewReader(c))
 	if err != nil {
-		logrus.Println("Error reading request:", err)
+		ctx.Log.Error("Error reading request: ", err)
 		return
 	}
 	respWriter := NewResponseWriter(c)
+	req.RemoteAddr = c.RemoteAddr().String()
 	ctx.Request = req
 	ctx.Response = respWriter
 
+	requestID := req.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	respWriter.Header().Set(requestIDHeader, requestID)
+	ctx.Log = ctx.Log.WithField(logger.FieldRequest, requestID)
+
 	if err := r.Serve(ctx); err != nil {
-		logrus.Println("Error serving request:", err)
+		ctx.Log.Error("Error serving request: ", err)
 	}
 }
@@ -0,0 +1,381 @@
+package router
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"pinzoom/pkg/hub"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	serviceWorker  = "sw.js"
+	webManifest    = "manifest.json"
+	immutableCache = "public, max-age=31536000, immutable"
+	revalidate     = "no-cache"
+)
+
+// References to other assets in stylesheets and the web manifest, which
+// are rewritten to fingerprinted URLs.
+var (
+	cssURL      = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+	manifestSrc = regexp.MustCompile(`"src"\s*:\s*"([^"]+)"`)
+)
+
+// Assets serves static files with content-hashed URLs. Every file is hashed
+// and compressed once when the manifest is built; requests for a hashed URL
+// can be cached forever, plain URLs are revalidated with the ETag.
+// Stylesheets and the web manifest refer to other files by their hashed
+// URLs too.
+type Assets struct {
+	fsys    fs.FS
+	dev     bool
+	startAt time.Time
+
+	files   map[string]*asset
+	hashed  map[string]*asset
+	version string
+}
+
+type asset struct {
+	name        string
+	url         string
+	contentType string
+	etag        string
+	body        []byte
+	gzip        []byte
+	brotli      []byte
+}
+
+// NewAssets builds the manifest for fsys. In dev mode nothing is cached:
+// files are read from fsys on every request and URLs are not fingerprinted.
+func NewAssets(fsys fs.FS, dev bool) (*Assets, error) {
+	a := &Assets{
+		fsys:    fsys,
+		dev:     dev,
+		startAt: time.Now(),
+		files:   make(map[string]*asset),
+		hashed:  make(map[string]*asset),
+	}
+	if dev {
+		return a, nil
+	}
+
+	names, err := a.names()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files referring to others are hashed last, once the URLs they
+	// refer to are known.
+	var referring []string
+	for _, name := range names {
+		switch {
+		case name == serviceWorker:
+		case refersToAssets(name):
+			referring = append(referring, name)
+		default:
+			if err := a.add(name, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range referring {
+		if err := a.add(name, a.rewrite); err != nil {
+			return nil, err
+		}
+	}
+
+	version := sha256.New()
+	for _, name := range names {
+		if f, ok := a.files[name]; ok {
+			version.Write([]byte(f.etag))
+		}
+	}
+	a.version = hex.EncodeToString(version.Sum(nil))[:12]
+
+	if sw, err := a.serviceWorker(); err != nil {
+		return nil, err
+	} else if sw != nil {
+		a.files[serviceWorker] = sw
+	}
+	return a, nil
+}
+
+// add hashes the file name into the manifest, rewriting its body first if
+// rewrite is set.
+func (a *Assets) add(name string, rewrite func(name string, body []byte) []byte) error {
+	body, err := fs.ReadFile(a.fsys, name)
+	if err != nil {
+		return err
+	}
+	if rewrite != nil {
+		body = rewrite(name, body)
+	}
+	f := newAsset(name, body)
+	f.url = hashedName(name, f.etag)
+	a.files[name] = f
+	a.hashed[f.url] = f
+	return nil
+}
+
+func refersToAssets(name string) bool {
+	return path.Ext(name) == ".css" || name == webManifest
+}
+
+// rewrite points the url() references of a stylesheet, or the icons of
+// the web manifest, at the fingerprinted URLs of the assets they name,
+// so pages load the files the service worker precached and get them
+// cached for good. Query strings are dropped, as the hash takes their
+// place; fragments are kept.
+func (a *Assets) rewrite(name string, body []byte) []byte {
+	pattern := cssURL
+	if name == webManifest {
+		pattern = manifestSrc
+	}
+	return pattern.ReplaceAllFunc(body, func(match []byte) []byte {
+		ref := string(pattern.FindSubmatch(match)[1])
+		if strings.Contains(ref, ":") || strings.HasPrefix(ref, "#") {
+			return match
+		}
+		target, fragment, _ := strings.Cut(ref, "#")
+		target, _, _ = strings.Cut(target, "?")
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(name), target)
+		}
+		f, ok := a.files[strings.TrimPrefix(path.Clean("/"+target), "/")]
+		if !ok {
+			return match
+		}
+		url := "/" + f.url
+		if fragment != "" {
+			url += "#" + fragment
+		}
+		return bytes.Replace(match, []byte(ref), []byte(url), 1)
+	})
+}
+
+// URL returns the fingerprinted URL for a file, or the plain path if the
+// file is unknown or the assets are served in dev mode.
+func (a *Assets) URL(name string) string {
+	if f, ok := a.files[strings.TrimPrefix(name, "/")]; ok && f.url != "" {
+		return "/" + f.url
+	}
+	return name
+}
+
+// FuncMap exposes URL to templates as "asset".
+func (a *Assets) FuncMap() map[string]interface{} {
+	return map[string]interface{}{
+		"asset": a.URL,
+	}
+}
+
+// Serve writes the requested file and reports whether one was found.
+func (a *Assets) Serve(ctx *hub.Ctx) bool {
+	name := strings.TrimPrefix(path.Clean("/"+ctx.Request.URL.Path), "/")
+	if a.dev {
+		return a.serveDev(ctx, name)
+	}
+
+	cacheControl := revalidate
+	f, ok := a.hashed[name]
+	if ok {
+		cacheControl = immutableCache
+	} else if f, ok = a.files[name]; !ok {
+		return false
+	}
+
+	header := ctx.Response.Header()
+	header.Set("Content-Type", f.contentType)
+	header.Set("Cache-Control", cacheControl)
+	header.Set("Vary", "Accept-Encoding")
+
+	body, etag := f.body, f.etag
+	switch accept := ctx.Request.Header.Get("Accept-Encoding"); {
+	case f.brotli != nil && acceptsEncoding(accept, "br"):
+		header.Set("Content-Encoding", "br")
+		body, etag = f.brotli, f.etag+"-br"
+	case f.gzip != nil && acceptsEncoding(accept, "gzip"):
+		header.Set("Content-Encoding", "gzip")
+		body, etag = f.gzip, f.etag+"-gz"
+	}
+	header.Set("ETag", strconv.Quote(etag))
+
+	http.ServeContent(ctx.Response, ctx.Request, f.name, a.startAt, bytes.NewReader(body))
+	return true
+}
+
+func (a *Assets) serveDev(ctx *hub.Ctx, name string) bool {
+	ctx.Response.Header().Set("Cache-Control", revalidate)
+	if name == serviceWorker {
+		sw, err := a.serviceWorker()
+		if err != nil {
+			log.Errorf("failed to render service worker, err=%v", err)
+			return false
+		}
+		if sw == nil {
+			return false
+		}
+		ctx.Response.Header().Set("Content-Type", sw.contentType)
+		ctx.Response.Write(sw.body)
+		return true
+	}
+	if info, err := fs.Stat(a.fsys, name); err != nil || info.IsDir() {
+		return false
+	}
+	http.ServeFileFS(ctx.Response, ctx.Request, a.fsys, name)
+	return true
+}
+
+// serviceWorker renders sw.js with the precache list taken from the
+// manifest, so the worker never goes stale when assets change.
+func (a *Assets) serviceWorker() (*asset, error) {
+	src, err := fs.ReadFile(a.fsys, serviceWorker)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s, err=%v", serviceWorker, err)
+	}
+	tmpl, err := template.New(serviceWorker).Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s, err=%v", serviceWorker, err)
+	}
+
+	names, err := a.names()
+	if err != nil {
+		return nil, err
+	}
+	precache := make([]string, 0, len(names))
+	for _, name := range names {
+		if name != serviceWorker && !legacyFont(name) {
+			precache = append(precache, a.URL("/"+name))
+		}
+	}
+	list, err := json.Marshal(precache)
+	if err != nil {
+		return nil, err
+	}
+
+	version := a.version
+	if a.dev {
+		version = "dev"
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, map[string]string{
+		"Version":  version,
+		"Precache": string(list),
+	}); err != nil {
+		return nil, fmt.Errorf("error executing %s, err=%v", serviceWorker, err)
+	}
+	return newAsset(serviceWorker, buf.Bytes()), nil
+}
+
+// legacyFont reports whether name is a font format only browsers without
+// WOFF2 fetch, which is not worth precaching.
+func legacyFont(name string) bool {
+	switch path.Ext(name) {
+	case ".eot", ".ttf", ".woff", ".svg":
+		return path.Dir(name) == "font"
+	}
+	return false
+}
+
+func (a *Assets) names() ([]string, error) {
+	var names []string
+	err := fs.WalkDir(a.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(name) != ".go" {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func newAsset(name string, body []byte) *asset {
+	sum := sha256.Sum256(body)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &asset{
+		name:        name,
+		contentType: contentType,
+		etag:        hex.EncodeToString(sum[:])[:16],
+		body:        body,
+		gzip:        compress(body, gzipEncode),
+		brotli:      compress(body, brotliEncode),
+	}
+}
+
+// hashedName inserts the hash before the extension: main.css -> main.<hash>.css.
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// compress keeps an encoded variant only when it saves at least a tenth of
+// the size; fonts and images are already compressed.
+func compress(body []byte, encode func(*bytes.Buffer, []byte) error) []byte {
+	var buf bytes.Buffer
+	if err := encode(&buf, body); err != nil || buf.Len() > len(body)*9/10 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func gzipEncode(buf *bytes.Buffer, body []byte) error {
+	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func brotliEncode(buf *bytes.Buffer, body []byte) error {
+	w := brotli.NewWriterLevel(buf, brotli.BestCompression)
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
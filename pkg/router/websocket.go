@@ -3,10 +3,12 @@ package router
 import (
 	"net/http"
 	"pinzoom/pkg/hub"
+	"pinzoom/pkg/metrics"
+	"pinzoom/pkg/tracing"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type WebSocketHandler struct {
@@ -23,17 +25,29 @@ var upgrader = websocket.Upgrader{
 }
 
 func (h WebSocketHandler) Serve(ctx *hub.Ctx) error {
+	spanCtx, span := tracing.Tracer.Start(ctx.Request.Context(), "websocket "+ctx.Route())
+	defer span.End()
+	ctx.Request = ctx.Request.WithContext(spanCtx)
+
 	// Устанавливаем таймаут для рукопожатия
 	upgrader.HandshakeTimeout = h.HandshakeTimeout
 
 	if err := Upgrade(ctx); err != nil {
-		logrus.Error("Failed to upgrade to WebSocket:", err)
+		ctx.Log.Error("Failed to upgrade to WebSocket: ", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upgrade failed")
 		return err
 	}
+	span.AddEvent("upgraded")
+
+	connections := metrics.WebsocketConnections.WithLabelValues(ctx.Route())
+	connections.Inc()
+	defer connections.Dec()
 
 	// Запускаем обработчик
 	if err := h.Handler(ctx); err != nil {
-		logrus.Error("Error handling WebSocket request:", err)
+		ctx.Log.Error("Error handling WebSocket request: ", err)
+		span.RecordError(err)
 		return err
 	}
 
@@ -42,18 +56,18 @@ func (h WebSocketHandler) Serve(ctx *hub.Ctx) error {
 
 func Upgrade(ctx *hub.Ctx) error {
 	if ctx.WebSocket != nil {
-		logrus.Warn("Connection already upgraded to WebSocket")
+		ctx.Log.Warn("Connection already upgraded to WebSocket")
 		return nil
 	}
 
 	ws, err := upgrader.Upgrade(ctx.Response, ctx.Request, nil)
 	if err != nil {
-		logrus.Error("Failed to upgrade connection to WebSocket:", err)
+		ctx.Log.Error("Failed to upgrade connection to WebSocket: ", err)
 		return err
 	}
 
 	ctx.WebSocket = ws
-	logrus.Info("WebSocket connection established")
+	ctx.Log.Info("WebSocket connection established")
 	return nil
 }
 
@@ -0,0 +1,175 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong room password")
+	ErrRoomLocked    = errors.New("room is locked")
+)
+
+// access holds the join restrictions of a room: an optional password, a
+// lock that refuses new joiners, the identities a host removed and the
+// participants whose admission tickets were revoked. Participants who got
+// in once carry an access key, so reconnects keep working while the room
+// is locked.
+type access struct {
+	mu       sync.RWMutex
+	password []byte
+	banned   map[string]bool
+	// revoked maps participants to when their last ticket expires.
+	revoked map[string]time.Time
+	locked  atomic.Bool
+	secret  [32]byte
+}
+
+func newAccess() *access {
+	a := &access{banned: make(map[string]bool), revoked: make(map[string]time.Time)}
+	if _, err := rand.Read(a.secret[:]); err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// SetPassword protects the room with password, or lifts the protection
+// when it is empty.
+func (r *Room) SetPassword(password string) error {
+	var hash []byte
+	if password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return err
+		}
+	}
+	r.access.mu.Lock()
+	r.access.password = hash
+	r.access.mu.Unlock()
+	return nil
+}
+
+// HasPassword reports whether joining the room needs a password.
+func (r *Room) HasPassword() bool {
+	r.access.mu.RLock()
+	defer r.access.mu.RUnlock()
+	return r.access.password != nil
+}
+
+// CheckPassword compares password with the room password.
+func (r *Room) CheckPassword(password string) error {
+	r.access.mu.RLock()
+	hash := r.access.password
+	r.access.mu.RUnlock()
+	if hash == nil {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// SetLocked locks or unlocks the room and tells its participants.
+func (r *Room) SetLocked(locked bool) {
+	if r.access.locked.Swap(locked) == locked {
+		return
+	}
+	data := "false"
+	if locked {
+		data = "true"
+	}
+	r.Peers.broadcast(&websocketMessage{Event: "locked", Data: data})
+}
+
+// Locked reports whether the room refuses new joiners.
+func (r *Room) Locked() bool {
+	return r.access.locked.Load()
+}
+
+// Restricted reports whether joining needs an access key.
+func (r *Room) Restricted() bool {
+	return r.Locked() || r.HasPassword()
+}
+
+// AccessKey is handed to participants once they are let in.
+func (r *Room) AccessKey() string {
+	mac := hmac.New(sha256.New, r.access.secret[:])
+	mac.Write([]byte(r.ID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckAccessKey reports whether key was handed out by AccessKey.
+func (r *Room) CheckAccessKey(key string) bool {
+	return hmac.Equal([]byte(key), []byte(r.AccessKey()))
+}
+
+// Ban removes a participant and refuses its identity for the rest of the
+// room's life, whatever access key it still holds. A participant without
+// an identity can only be kicked.
+func (r *Room) Ban(participant string) error {
+	var identity string
+	if err := r.Peers.update(participant, func(c *PeerConnectionState) {
+		identity = c.member
+	}); err != nil {
+		return err
+	}
+	if identity != "" {
+		r.access.mu.Lock()
+		r.access.banned[identity] = true
+		r.access.mu.Unlock()
+	}
+	return r.Kick(participant)
+}
+
+// revoke invalidates the admission tickets of participant.
+func (r *Room) revoke(participant string) {
+	now := time.Now()
+	r.access.mu.Lock()
+	defer r.access.mu.Unlock()
+	for p, expiry := range r.access.revoked {
+		if now.After(expiry) {
+			delete(r.access.revoked, p)
+		}
+	}
+	r.access.revoked[participant] = now.Add(AdmissionTTL)
+}
+
+func (r *Room) revoked(participant string) bool {
+	r.access.mu.RLock()
+	defer r.access.mu.RUnlock()
+	_, ok := r.access.revoked[participant]
+	return ok
+}
+
+// Banned reports whether a host removed identity from the room.
+func (r *Room) Banned(identity string) bool {
+	if identity == "" {
+		return false
+	}
+	r.access.mu.RLock()
+	defer r.access.mu.RUnlock()
+	return r.access.banned[identity]
+}
+
+type identityContextKey struct{}
+
+// WithIdentity stores the stable identity of a request, the subject of its
+// join token or its browser, by which a removed participant is banned.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+func identityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(identityContextKey{}).(string)
+	return identity
+}
@@ -0,0 +1,84 @@
+package webrtc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRoomPassword(t *testing.T) {
+	room := NewRoom("room", "stream")
+	if room.Restricted() || room.CheckPassword("") != nil {
+		t.Fatal("a new room is restricted")
+	}
+	if err := room.SetPassword("secret"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{"secret", nil},
+		{"", ErrWrongPassword},
+		{"Secret", ErrWrongPassword},
+	}
+	for _, tt := range tests {
+		if err := room.CheckPassword(tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("CheckPassword(%q) = %v, want %v", tt.password, err, tt.want)
+		}
+	}
+	if err := room.SetPassword(""); err != nil || room.Restricted() {
+		t.Errorf("room still restricted after the password was lifted, err=%v", err)
+	}
+}
+
+func TestAccessKey(t *testing.T) {
+	room := NewRoom("room", "stream")
+	other := NewRoom("room", "stream")
+	if !room.CheckAccessKey(room.AccessKey()) {
+		t.Error("the room's access key is refused")
+	}
+	for _, key := range []string{"", "00", other.AccessKey()} {
+		if room.CheckAccessKey(key) {
+			t.Errorf("CheckAccessKey(%q) = true", key)
+		}
+	}
+}
+
+func TestBan(t *testing.T) {
+	room := NewRoom("room", "stream")
+	for _, c := range []PeerConnectionState{
+		{ID: "p1", member: "browser:a"},
+		{ID: "p2"},
+	} {
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.PeerConnection, c.Websocket = pc, testWriter(t)
+		room.Peers.Connections = append(room.Peers.Connections, c)
+	}
+	ticket := room.AdmissionTicket("p1")
+
+	if err := room.Ban("p1"); err != nil {
+		t.Fatal(err)
+	}
+	if !room.Banned("browser:a") || room.Banned("browser:b") || room.Banned("") {
+		t.Error("Banned does not follow the removed identity")
+	}
+	if room.CheckAdmission(ticket) {
+		t.Error("the ticket of a banned participant is still valid")
+	}
+
+	// Without an identity there is nothing to ban, the participant is kicked.
+	if err := room.Ban("p2"); err != nil {
+		t.Fatal(err)
+	}
+	if room.Banned("") {
+		t.Error("an empty identity is banned")
+	}
+	if err := room.Ban("missing"); !errors.Is(err, ErrParticipantNotFound) {
+		t.Errorf("Ban(missing) = %v, want %v", err, ErrParticipantNotFound)
+	}
+}
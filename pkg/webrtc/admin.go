@@ -0,0 +1,190 @@
+package webrtc
+
+import (
+	"errors"
+	"pinzoom/pkg/logger"
+	"sort"
+	"time"
+)
+
+var (
+	ErrRoomNotFound        = errors.New("room not found")
+	ErrParticipantNotFound = errors.New("participant not found")
+)
+
+// RoomSummary is the listing entry of a live room.
+type RoomSummary struct {
+	ID           string    `json:"id"`
+	StreamID     string    `json:"streamId"`
+	Participants int       `json:"participants"`
+	Viewers      int       `json:"viewers"`
+	Tracks       int       `json:"tracks"`
+	ChatClients  int       `json:"chatClients"`
+	Locked       bool      `json:"locked"`
+	Protected    bool      `json:"protected"`
+	ChatEnabled  bool      `json:"chatEnabled"`
+	SlowMode     int       `json:"slowMode"`
+	Lobby        bool      `json:"lobby"`
+	Waiting      int       `json:"waiting"`
+	Created      time.Time `json:"created"`
+	Uptime       string    `json:"uptime"`
+}
+
+// RoomDetail describes a live room with its participants, forwarded tracks
+// and call quality.
+type RoomDetail struct {
+	RoomSummary
+	Peers   []ParticipantInfo `json:"peers"`
+	Pending []PendingInfo     `json:"pending"`
+	Audit   []AuditEntry      `json:"audit"`
+	Tracks  []TrackInfo       `json:"tracks"`
+	Quality []Quality         `json:"quality"`
+}
+
+type ParticipantInfo struct {
+	ID              string `json:"id"`
+	Identity        string `json:"identity,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Viewer          bool   `json:"viewer"`
+	Host            bool   `json:"host"`
+	ConnectionState string `json:"connectionState"`
+	ICEState        string `json:"iceState"`
+}
+
+type TrackInfo struct {
+	ID       string `json:"id"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+}
+
+// ListRooms returns a summary of every room, oldest first.
+func ListRooms() []RoomSummary {
+	RoomsLock.RLock()
+	rooms := make([]*Room, 0, len(Rooms))
+	for _, room := range Rooms {
+		rooms = append(rooms, room)
+	}
+	RoomsLock.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Created.Before(rooms[j].Created) })
+	summaries := make([]RoomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		summaries = append(summaries, room.Summary())
+	}
+	return summaries
+}
+
+// LookupRoom returns the room with the given ID.
+func LookupRoom(id string) (*Room, error) {
+	RoomsLock.RLock()
+	defer RoomsLock.RUnlock()
+	room, ok := Rooms[id]
+	if !ok {
+		return nil, ErrRoomNotFound
+	}
+	return room, nil
+}
+
+func (r *Room) Summary() RoomSummary {
+	s := RoomSummary{
+		ID:          r.ID,
+		StreamID:    r.StreamID,
+		Created:     r.Created,
+		Uptime:      time.Since(r.Created).Round(time.Second).String(),
+		Locked:      r.Locked(),
+		Protected:   r.HasPassword(),
+		ChatEnabled: r.ChatEnabled(),
+		Lobby:       r.Lobby(),
+		Waiting:     len(r.Pending()),
+	}
+	if r.Hub != nil {
+		s.ChatClients = r.Hub.ClientCount()
+		s.SlowMode = int(r.Hub.SlowMode().Seconds())
+	}
+
+	r.Peers.ListLock.RLock()
+	defer r.Peers.ListLock.RUnlock()
+	for _, c := range r.Peers.Connections {
+		if c.Viewer {
+			s.Viewers++
+		} else {
+			s.Participants++
+		}
+	}
+	s.Tracks = len(r.Peers.TrackLocals)
+	return s
+}
+
+func (r *Room) Detail() RoomDetail {
+	d := RoomDetail{
+		RoomSummary: r.Summary(),
+		Peers:       []ParticipantInfo{},
+		Pending:     r.Pending(),
+		Audit:       r.AuditLog(),
+		Tracks:      []TrackInfo{},
+		Quality:     Stats.Room(r.ID),
+	}
+
+	r.Peers.ListLock.RLock()
+	defer r.Peers.ListLock.RUnlock()
+	for _, c := range r.Peers.Connections {
+		d.Peers = append(d.Peers, ParticipantInfo{
+			ID:              c.ID,
+			Identity:        c.Identity,
+			Name:            c.Name,
+			Viewer:          c.Viewer,
+			Host:            c.Host,
+			ConnectionState: c.PeerConnection.ConnectionState().String(),
+			ICEState:        c.PeerConnection.ICEConnectionState().String(),
+		})
+	}
+	for _, t := range r.Peers.TrackLocals {
+		d.Tracks = append(d.Tracks, TrackInfo{ID: t.ID(), StreamID: t.StreamID(), Kind: t.Kind().String()})
+	}
+	return d
+}
+
+// Kick tells a participant it was removed and closes its connection. Its
+// admission ticket is revoked, so in lobby mode it has to wait again.
+func (r *Room) Kick(participant string) error {
+	r.Peers.ListLock.RLock()
+	var target *PeerConnectionState
+	for i := range r.Peers.Connections {
+		if r.Peers.Connections[i].ID == participant {
+			c := r.Peers.Connections[i]
+			target = &c
+			break
+		}
+	}
+	r.Peers.ListLock.RUnlock()
+	if target == nil {
+		return ErrParticipantNotFound
+	}
+	r.revoke(participant)
+
+	l := r.Peers.log.WithField(logger.FieldParticipant, participant)
+	if err := target.Websocket.WriteJSON(&websocketMessage{Event: "kicked"}); err != nil {
+		l.Errorf("failed to write kicked event, err=%v", err)
+	}
+	if err := target.PeerConnection.Close(); err != nil {
+		l.Errorf("failed to close peerConnection, err=%v", err)
+	}
+	target.Websocket.Conn.Close()
+	return nil
+}
+
+// Close unregisters the room, tells its participants the call is over and
+// disconnects them together with the chat clients.
+func (r *Room) Close() {
+	RoomsLock.Lock()
+	delete(Rooms, r.ID)
+	delete(Streams, r.StreamID)
+	RoomsLock.Unlock()
+
+	r.Peers.broadcast(&websocketMessage{Event: "closed"})
+	r.closeLobby()
+	r.Peers.closeAll()
+	if r.Hub != nil {
+		r.Hub.Close()
+	}
+}
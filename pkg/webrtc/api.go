@@ -0,0 +1,115 @@
+package webrtc
+
+import (
+	"pinzoom/pkg/metrics"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// newPeerConnection creates a PeerConnection with the default codecs and
+// interceptors plus a stats interceptor that feeds the stream counters of
+// this PeerConnection. The interceptor registry is built per connection,
+// so counters of different participants never share an SSRC key.
+func newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	counters := newStreamRegistry()
+	i := &interceptor.Registry{}
+	// The stats interceptor sits below the defaults, so it sees the
+	// receiver reports the report interceptor writes.
+	i.Add(statsInterceptorFactory{streams: counters})
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	streams.add(pc, counters)
+	return pc, nil
+}
+
+type statsInterceptorFactory struct {
+	streams *streamRegistry
+}
+
+func (f statsInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &statsInterceptor{streams: f.streams}, nil
+}
+
+// statsInterceptor counts RTP packets and bytes as they cross the wire and
+// records the loss and jitter carried by RTCP reception reports. Reports
+// written by us describe what we receive from publishers, reports read
+// from clients describe what they receive from us. Both are keyed by SSRC
+// within the PeerConnection.
+type statsInterceptor struct {
+	interceptor.NoOp
+	streams *streamRegistry
+}
+
+func (s *statsInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err == nil {
+			if pkts, err := rtcp.Unmarshal(b[:n]); err == nil {
+				s.streams.receptionReports(pkts)
+			}
+		}
+		return n, attributes, err
+	})
+}
+
+func (s *statsInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		s.streams.receptionReports(pkts)
+		return writer.Write(pkts, attributes)
+	})
+}
+
+// Close drops the counters once the PeerConnection is closed.
+func (s *statsInterceptor) Close() error {
+	streams.remove(s.streams)
+	return nil
+}
+
+func (s *statsInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	packets, bytes := metrics.RTPPackets.WithLabelValues("out"), metrics.RTPBytes.WithLabelValues("out")
+	counters := s.streams.bind(info)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err == nil {
+			packets.Inc()
+			bytes.Add(float64(n))
+			counters.add(n)
+		}
+		return n, err
+	})
+}
+
+func (s *statsInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	s.streams.unbind(info)
+}
+
+func (s *statsInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	packets, bytes := metrics.RTPPackets.WithLabelValues("in"), metrics.RTPBytes.WithLabelValues("in")
+	counters := s.streams.bind(info)
+	return interceptor.RTPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err == nil {
+			packets.Inc()
+			bytes.Add(float64(n))
+			counters.add(n)
+		}
+		return n, attributes, err
+	})
+}
+
+func (s *statsInterceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	s.streams.unbind(info)
+}
@@ -0,0 +1,60 @@
+package webrtc
+
+import (
+	"pinzoom/pkg/logger"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditSize bounds the moderation entries kept per room.
+const auditSize = 100
+
+var auditLog = logger.For("audit")
+
+// AuditEntry records a moderation action taken in a room.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+type audit struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// Audit logs a moderation action on the audit subsystem and keeps it with
+// the room. The actor is a participant ID or "admin".
+func (r *Room) Audit(actor, action, target, detail string) {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	auditLog.WithFields(r.Fields()).WithFields(logrus.Fields{
+		"actor":  actor,
+		"action": action,
+		"target": target,
+		"detail": detail,
+	}).Info("moderation action")
+
+	r.audit.mu.Lock()
+	defer r.audit.mu.Unlock()
+	r.audit.entries = append(r.audit.entries, entry)
+	if len(r.audit.entries) > auditSize {
+		r.audit.entries = r.audit.entries[len(r.audit.entries)-auditSize:]
+	}
+}
+
+// AuditLog returns the latest moderation actions of the room, oldest first.
+func (r *Room) AuditLog() []AuditEntry {
+	r.audit.mu.Lock()
+	defer r.audit.mu.Unlock()
+	return append([]AuditEntry{}, r.audit.entries...)
+}
@@ -0,0 +1,139 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"pinzoom/pkg/chat"
+	"pinzoom/pkg/logger"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDraining is returned for connections attempted while the server shuts down.
+var ErrDraining = errors.New("server is draining")
+
+var draining atomic.Bool
+
+// Draining reports whether the server stopped accepting rooms and connections.
+func Draining() bool {
+	return draining.Load()
+}
+
+// Drain stops accepting new rooms and connections, tells every participant
+// that the server is going away and waits up to timeout for the calls to
+// end. It reports whether all rooms emptied in time.
+func Drain(timeout time.Duration) bool {
+	draining.Store(true)
+
+	notice := fmt.Sprintf("Server is shutting down, the call will end in %s.", timeout)
+	for _, room := range snapshotRooms() {
+		room.Peers.broadcast(&websocketMessage{
+			Event: "shutdown",
+			Data:  strconv.Itoa(int(timeout.Seconds())),
+		})
+		if room.Hub != nil {
+			room.Hub.Broadcast(chat.System(notice))
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		participants := 0
+		for _, room := range snapshotRooms() {
+			participants += room.Peers.count()
+		}
+		if participants == 0 {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.Warnf("Drain timeout reached with %d participants still connected", participants)
+			return false
+		}
+	}
+}
+
+// Shutdown closes every PeerConnection and then every chat hub.
+func Shutdown() {
+	rooms := snapshotRooms()
+	for _, room := range rooms {
+		room.closeLobby()
+		room.Peers.closeAll()
+	}
+	for _, room := range rooms {
+		if room.Hub != nil {
+			room.Hub.Close()
+		}
+	}
+}
+
+// snapshotRooms returns rooms and streams without duplicates, since every
+// room is also registered as a stream.
+func snapshotRooms() []*Room {
+	RoomsLock.RLock()
+	defer RoomsLock.RUnlock()
+
+	seen := make(map[*Room]bool, len(Rooms))
+	rooms := make([]*Room, 0, len(Rooms))
+	for _, index := range []map[string]*Room{Rooms, Streams} {
+		for _, room := range index {
+			if !seen[room] {
+				seen[room] = true
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	return rooms
+}
+
+func (p *Peers) count() int {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+	return len(p.Connections)
+}
+
+func (p *Peers) broadcast(message *websocketMessage) {
+	p.send(message, false)
+}
+
+// send writes message to every participant, or only to the hosts. The
+// list lock is released before writing, and each write gives up after
+// broadcastWait, so a stalled client holds up neither signaling nor the
+// others. A failed write leaves the socket unusable, so it is closed and
+// the participant leaves.
+func (p *Peers) send(message *websocketMessage, hostsOnly bool) {
+	p.ListLock.RLock()
+	connections := append([]PeerConnectionState(nil), p.Connections...)
+	p.ListLock.RUnlock()
+
+	for _, c := range connections {
+		if hostsOnly && !c.Host {
+			continue
+		}
+		if err := c.Websocket.writeJSONWithin(message, broadcastWait); err != nil {
+			p.log.WithField(logger.FieldParticipant, c.ID).
+				Errorf("failed to write %s event, err=%v", message.Event, err)
+			c.Websocket.Conn.Close()
+		}
+	}
+}
+
+func (p *Peers) closeAll() {
+	p.ListLock.RLock()
+	connections := append([]PeerConnectionState(nil), p.Connections...)
+	p.ListLock.RUnlock()
+
+	for _, c := range connections {
+		if err := c.PeerConnection.Close(); err != nil {
+			p.log.WithField(logger.FieldParticipant, c.ID).
+				Errorf("failed to close peerConnection, err=%v", err)
+		}
+		c.Websocket.Conn.Close()
+	}
+}
@@ -0,0 +1,329 @@
+package webrtc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"pinzoom/pkg/logger"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrTokenHost   = errors.New("participant is a host by its join token")
+	ErrUnknownKind = errors.New("unknown media kind")
+)
+
+// hosts holds the keys handed to the room creator and to participants made
+// co-host. Revoking a key demotes its holder.
+type hosts struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// NewHostKey creates a secret key that makes its holder a host.
+func (r *Room) NewHostKey() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	key := hex.EncodeToString(b[:])
+
+	r.hosts.mu.Lock()
+	defer r.hosts.mu.Unlock()
+	if r.hosts.keys == nil {
+		r.hosts.keys = make(map[string]bool)
+	}
+	r.hosts.keys[key] = true
+	return key
+}
+
+// CheckHostKey reports whether key belongs to a current host.
+func (r *Room) CheckHostKey(key string) bool {
+	r.hosts.mu.Lock()
+	defer r.hosts.mu.Unlock()
+	return key != "" && r.hosts.keys[key]
+}
+
+func (r *Room) revokeHostKey(key string) {
+	r.hosts.mu.Lock()
+	defer r.hosts.mu.Unlock()
+	delete(r.hosts.keys, key)
+}
+
+type hostKeyContextKey struct{}
+
+// WithHostKey stores the host key a request was made with, so a
+// participant made host by it can be demoted later.
+func WithHostKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hostKeyContextKey{}, key)
+}
+
+func hostKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(hostKeyContextKey{}).(string)
+	return key
+}
+
+// mediaState holds what a host muted for a participant. Muted media is not
+// forwarded to the others.
+type mediaState struct {
+	audio   atomic.Bool
+	video   atomic.Bool
+	streams sync.Map
+}
+
+func (m *mediaState) muted(kind webrtc.RTPCodecType) bool {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return m.audio.Load()
+	case webrtc.RTPCodecTypeVideo:
+		return m.video.Load()
+	}
+	return false
+}
+
+// RosterEntry describes a participant of the call to the others.
+type RosterEntry struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name,omitempty"`
+	Host       bool     `json:"host"`
+	AudioMuted bool     `json:"audioMuted"`
+	VideoMuted bool     `json:"videoMuted"`
+	Streams    []string `json:"streams"`
+}
+
+// Roster lists the participants of the call, without viewers.
+func (r *Room) Roster() []RosterEntry {
+	r.Peers.ListLock.RLock()
+	defer r.Peers.ListLock.RUnlock()
+	roster := []RosterEntry{}
+	for _, c := range r.Peers.Connections {
+		if c.Viewer || c.media == nil || c.PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
+		entry := RosterEntry{
+			ID:         c.ID,
+			Name:       c.Name,
+			Host:       c.Host,
+			AudioMuted: c.media.audio.Load(),
+			VideoMuted: c.media.video.Load(),
+			Streams:    []string{},
+		}
+		c.media.streams.Range(func(id, _ interface{}) bool {
+			entry.Streams = append(entry.Streams, id.(string))
+			return true
+		})
+		roster = append(roster, entry)
+	}
+	return roster
+}
+
+// notifyRoster sends the roster to everyone in the call.
+func (r *Room) notifyRoster() {
+	data, err := json.Marshal(r.Roster())
+	if err != nil {
+		r.Peers.log.Errorf("failed to marshal roster, err=%v", err)
+		return
+	}
+	r.Peers.broadcast(&websocketMessage{Event: "participants", Data: string(data)})
+}
+
+// Mute stops or resumes forwarding the audio or video of a participant.
+func (r *Room) Mute(participant, kind string, muted bool) error {
+	var media *mediaState
+	err := r.Peers.update(participant, func(c *PeerConnectionState) {
+		media = c.media
+	})
+	if err != nil {
+		return err
+	}
+	if media == nil {
+		return ErrParticipantNotFound
+	}
+	switch kind {
+	case "audio":
+		media.audio.Store(muted)
+	case "video":
+		media.video.Store(muted)
+		if !muted {
+			r.Peers.DispatchKeyFrame()
+		}
+	default:
+		return ErrUnknownKind
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"participant": participant,
+		"kind":        kind,
+		"muted":       muted,
+	})
+	r.Peers.broadcast(&websocketMessage{Event: "muted", Data: string(data)})
+	r.notifyRoster()
+	return nil
+}
+
+// Promote makes a participant co-host and hands it a host key.
+func (r *Room) Promote(participant string) error {
+	key := r.NewHostKey()
+	var ws *ThreadSafeWriter
+	err := r.Peers.update(participant, func(c *PeerConnectionState) {
+		if c.hostKey != "" {
+			r.revokeHostKey(c.hostKey)
+		}
+		c.Host = true
+		c.hostKey = key
+		ws = c.Websocket
+	})
+	if err != nil {
+		r.revokeHostKey(key)
+		return err
+	}
+	if err := ws.WriteJSON(&websocketMessage{Event: "promoted", Data: key}); err != nil {
+		r.Peers.log.WithField(logger.FieldParticipant, participant).
+			Errorf("failed to write promoted event, err=%v", err)
+	}
+	r.sendLobby(ws)
+	r.notifyRoster()
+	return nil
+}
+
+// isTokenHost reports whether a participant is a host by its join token.
+func (r *Room) isTokenHost(participant string) bool {
+	tokenHost := false
+	_ = r.Peers.update(participant, func(c *PeerConnectionState) {
+		tokenHost = c.Host && c.hostKey == ""
+	})
+	return tokenHost
+}
+
+// Demote takes the host role from a participant. Hosts by join token keep
+// it, their token grants it on every join.
+func (r *Room) Demote(participant string) error {
+	var ws *ThreadSafeWriter
+	var tokenHost bool
+	err := r.Peers.update(participant, func(c *PeerConnectionState) {
+		if c.Host && c.hostKey == "" {
+			tokenHost = true
+			return
+		}
+		r.revokeHostKey(c.hostKey)
+		c.Host = false
+		c.hostKey = ""
+		ws = c.Websocket
+	})
+	if err != nil {
+		return err
+	}
+	if tokenHost {
+		return ErrTokenHost
+	}
+	if err := ws.WriteJSON(&websocketMessage{Event: "demoted"}); err != nil {
+		r.Peers.log.WithField(logger.FieldParticipant, participant).
+			Errorf("failed to write demoted event, err=%v", err)
+	}
+	r.notifyRoster()
+	return nil
+}
+
+// SetChatEnabled opens or closes the chat of the room for its clients.
+func (r *Room) SetChatEnabled(enabled bool) {
+	if r.Hub == nil || r.Hub.Disabled() == !enabled {
+		return
+	}
+	r.Hub.SetDisabled(!enabled)
+	data := "true"
+	if !enabled {
+		data = "false"
+	}
+	r.Peers.broadcast(&websocketMessage{Event: "chat", Data: data})
+}
+
+// chatModerated audits what a moderator did from the chat and keeps the
+// chat switch of the hosts in step.
+func (r *Room) chatModerated(actor, action, target, detail string) {
+	r.Audit(actor, action, target, detail)
+	if action == "chat" {
+		r.Peers.broadcast(&websocketMessage{Event: "chat", Data: detail})
+	}
+}
+
+// ChatEnabled reports whether chat clients may post.
+func (r *Room) ChatEnabled() bool {
+	return r.Hub == nil || !r.Hub.Disabled()
+}
+
+// IsHost reports whether a participant is currently a host.
+func (r *Room) IsHost(participant string) bool {
+	host := false
+	_ = r.Peers.update(participant, func(c *PeerConnectionState) {
+		host = c.Host
+	})
+	return host
+}
+
+// handleHostEvent applies a moderation request a host sent over signaling
+// and returns why it failed, if it did.
+func (r *Room) handleHostEvent(actor string, l *logrus.Entry, message *websocketMessage) error {
+	var err error
+	target, detail := message.Data, ""
+	switch message.Event {
+	case "mute":
+		var req struct {
+			Participant string `json:"participant"`
+			Kind        string `json:"kind"`
+			Muted       bool   `json:"muted"`
+		}
+		if err = json.Unmarshal([]byte(message.Data), &req); err == nil {
+			target = req.Participant
+			detail = req.Kind
+			if !req.Muted {
+				detail += " unmuted"
+			}
+			err = r.Mute(req.Participant, req.Kind, req.Muted)
+		}
+	case "remove":
+		err = r.Ban(message.Data)
+	case "end":
+		target = ""
+		defer r.Close()
+	case "promote":
+		err = r.Promote(message.Data)
+	case "demote":
+		err = r.Demote(message.Data)
+	case "transfer":
+		// A host by join token can't give the role away, only share it.
+		if r.isTokenHost(actor) {
+			err = ErrTokenHost
+		} else if err = r.Promote(message.Data); err == nil {
+			err = r.Demote(actor)
+		}
+	case "chat":
+		target, detail = "", message.Data
+		r.SetChatEnabled(message.Data == "true")
+	}
+
+	if err != nil {
+		l.WithField("target", target).Warnf("failed to apply %s, err=%v", message.Event, err)
+		return err
+	}
+	r.Audit(actor, message.Event, target, detail)
+	return nil
+}
+
+// update runs fn on the connection of a participant under the list lock.
+func (p *Peers) update(participant string, fn func(*PeerConnectionState)) error {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+	for i := range p.Connections {
+		if p.Connections[i].ID == participant && !p.Connections[i].Viewer {
+			fn(&p.Connections[i])
+			return nil
+		}
+	}
+	return ErrParticipantNotFound
+}
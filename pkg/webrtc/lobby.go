@@ -0,0 +1,317 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"pinzoom/pkg/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrDenied     = errors.New("denied by the host")
+	ErrRoomClosed = errors.New("room closed")
+)
+
+// AdmissionTTL is how long admission tickets and viewer grants are valid.
+const AdmissionTTL = 12 * time.Hour
+
+// lobby holds the participants waiting for a host to let them in while the
+// room is in lobby mode. Waiting participants have a signaling socket but no
+// PeerConnection and no chat.
+type lobby struct {
+	mu      sync.Mutex
+	enabled bool
+	pending []*pendingPeer
+}
+
+type pendingPeer struct {
+	PendingInfo
+	websocket *ThreadSafeWriter
+	// decision receives nil when a host admits the participant, ErrDenied
+	// or ErrRoomClosed otherwise.
+	decision chan error
+}
+
+// PendingInfo describes a participant waiting in the lobby.
+type PendingInfo struct {
+	ID       string    `json:"id"`
+	Identity string    `json:"identity,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// SetLobby turns lobby mode on or off. Turning it off lets everyone waiting in.
+func (r *Room) SetLobby(enabled bool) {
+	r.lobby.mu.Lock()
+	changed := r.lobby.enabled != enabled
+	r.lobby.enabled = enabled
+	r.lobby.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	data := "false"
+	if enabled {
+		data = "true"
+	}
+	r.Peers.broadcast(&websocketMessage{Event: "lobby", Data: data})
+	if !enabled {
+		r.AdmitAll()
+	}
+}
+
+// Lobby reports whether new participants wait for a host to admit them.
+func (r *Room) Lobby() bool {
+	r.lobby.mu.Lock()
+	defer r.lobby.mu.Unlock()
+	return r.lobby.enabled
+}
+
+// Pending lists the participants waiting in the lobby, longest waiting first.
+func (r *Room) Pending() []PendingInfo {
+	r.lobby.mu.Lock()
+	defer r.lobby.mu.Unlock()
+	pending := make([]PendingInfo, 0, len(r.lobby.pending))
+	for _, p := range r.lobby.pending {
+		pending = append(pending, p.PendingInfo)
+	}
+	return pending
+}
+
+// Admit lets a waiting participant into the call.
+func (r *Room) Admit(participant string) error {
+	return r.decide(participant, nil)
+}
+
+// Deny turns a waiting participant away.
+func (r *Room) Deny(participant string) error {
+	return r.decide(participant, ErrDenied)
+}
+
+// AdmitAll lets every waiting participant in and returns how many there were.
+func (r *Room) AdmitAll() int {
+	r.lobby.mu.Lock()
+	pending := r.lobby.pending
+	r.lobby.pending = nil
+	r.lobby.mu.Unlock()
+
+	for _, p := range pending {
+		p.decision <- nil
+	}
+	if len(pending) > 0 {
+		r.notifyPending()
+	}
+	return len(pending)
+}
+
+func (r *Room) decide(participant string, decision error) error {
+	r.lobby.mu.Lock()
+	var found *pendingPeer
+	for i, p := range r.lobby.pending {
+		if p.ID == participant {
+			found = p
+			r.lobby.pending = append(r.lobby.pending[:i], r.lobby.pending[i+1:]...)
+			break
+		}
+	}
+	r.lobby.mu.Unlock()
+	if found == nil {
+		return ErrParticipantNotFound
+	}
+
+	found.decision <- decision
+	r.notifyPending()
+	return nil
+}
+
+// closeLobby turns away everyone waiting, used when the room goes away.
+func (r *Room) closeLobby() {
+	r.lobby.mu.Lock()
+	pending := r.lobby.pending
+	r.lobby.pending = nil
+	r.lobby.mu.Unlock()
+
+	for _, p := range pending {
+		p.decision <- ErrRoomClosed
+	}
+}
+
+// wait parks a participant in the lobby until a host decides. It returns
+// nil once the participant is admitted, ErrDenied or ErrRoomClosed when it
+// is turned away and the read error when it leaves. Participants are let
+// straight in when the lobby is off or they carry a ticket from an earlier
+// admission, so reconnects don't wait again. Messages read while waiting
+// are dropped.
+func (r *Room) wait(p *pendingPeer, ticket string, messages <-chan *websocketMessage, errs <-chan error) error {
+	r.lobby.mu.Lock()
+	if !r.lobby.enabled || r.CheckAdmission(ticket) {
+		r.lobby.mu.Unlock()
+		return nil
+	}
+	p.decision = make(chan error, 1)
+	r.lobby.pending = append(r.lobby.pending, p)
+	r.lobby.mu.Unlock()
+
+	l := r.Peers.log.WithField(logger.FieldParticipant, p.ID)
+	l.Info("participant waiting in lobby")
+	if err := p.websocket.WriteJSON(&websocketMessage{Event: "waiting"}); err != nil {
+		l.Errorf("failed to write waiting event, err=%v", err)
+	}
+	r.notifyPending()
+
+	for {
+		select {
+		case err := <-p.decision:
+			return err
+		case <-messages:
+		case err := <-errs:
+			r.leaveLobby(p)
+			return err
+		}
+	}
+}
+
+func (r *Room) leaveLobby(p *pendingPeer) {
+	r.lobby.mu.Lock()
+	for i := range r.lobby.pending {
+		if r.lobby.pending[i] == p {
+			r.lobby.pending = append(r.lobby.pending[:i], r.lobby.pending[i+1:]...)
+			r.lobby.mu.Unlock()
+			r.notifyPending()
+			return
+		}
+	}
+	r.lobby.mu.Unlock()
+}
+
+// handleLobbyEvent applies a lobby decision a host sent over signaling.
+func (r *Room) handleLobbyEvent(actor string, l *logrus.Entry, message *websocketMessage) {
+	var err error
+	switch message.Event {
+	case "lobby":
+		r.SetLobby(message.Data == "true")
+	case "admit":
+		err = r.Admit(message.Data)
+	case "deny":
+		err = r.Deny(message.Data)
+	case "admit-all":
+		r.AdmitAll()
+	}
+	if err != nil {
+		l.WithField("target", message.Data).Warnf("failed to apply %s, err=%v", message.Event, err)
+		return
+	}
+	if message.Event == "lobby" {
+		r.Audit(actor, "lobby", "", message.Data)
+	} else {
+		r.Audit(actor, message.Event, message.Data, "")
+	}
+}
+
+// sendLobby tells a host joining the call about the lobby.
+func (r *Room) sendLobby(w *ThreadSafeWriter) {
+	data, err := json.Marshal(r.Pending())
+	if err != nil {
+		r.Peers.log.Errorf("failed to marshal lobby, err=%v", err)
+		return
+	}
+	enabled := "false"
+	if r.Lobby() {
+		enabled = "true"
+	}
+	for _, message := range []*websocketMessage{
+		{Event: "lobby", Data: enabled},
+		{Event: "pending", Data: string(data)},
+	} {
+		if err := w.WriteJSON(message); err != nil {
+			r.Peers.log.Errorf("failed to write %s event, err=%v", message.Event, err)
+		}
+	}
+}
+
+// notifyPending sends the lobby list to the hosts in the room.
+func (r *Room) notifyPending() {
+	data, err := json.Marshal(r.Pending())
+	if err != nil {
+		r.Peers.log.Errorf("failed to marshal lobby, err=%v", err)
+		return
+	}
+	r.Peers.broadcastHosts(&websocketMessage{Event: "pending", Data: string(data)})
+}
+
+// AdmissionTicket is handed to a participant once it is in the call. It
+// skips the lobby on reconnect and opens the room chat and files for
+// AdmissionTTL, or until the participant is kicked. It is private to the
+// participant and never accepted on stream routes.
+func (r *Room) AdmissionTicket(participant string) string {
+	return participant + "." + r.sign("admission:"+participant, time.Now().Add(AdmissionTTL))
+}
+
+// CheckAdmission reports whether ticket was handed out by AdmissionTicket
+// and is still valid.
+func (r *Room) CheckAdmission(ticket string) bool {
+	_, ok := r.AdmittedParticipant(ticket)
+	return ok
+}
+
+// AdmittedParticipant returns the participant a valid ticket was handed to.
+func (r *Room) AdmittedParticipant(ticket string) (string, bool) {
+	participant, signature, ok := strings.Cut(ticket, ".")
+	if !ok || !r.verify("admission:"+participant, signature) || r.revoked(participant) {
+		return "", false
+	}
+	return participant, true
+}
+
+// ViewerGrant is put into the stream links participants share. It lets
+// viewers watch the stream and use its chat while the room is in lobby
+// mode, for AdmissionTTL, and nothing more.
+func (r *Room) ViewerGrant() string {
+	return r.sign("viewer:"+r.StreamID, time.Now().Add(AdmissionTTL))
+}
+
+// StreamPath is the path of the stream of the room with a viewer grant,
+// the link participants share.
+func (r *Room) StreamPath() string {
+	return "/stream/" + r.StreamID + "?viewer=" + r.ViewerGrant()
+}
+
+// CheckViewerGrant reports whether grant was handed out by ViewerGrant and
+// is still valid.
+func (r *Room) CheckViewerGrant(grant string) bool {
+	return r.verify("viewer:"+r.StreamID, grant)
+}
+
+// sign returns "<expiry>.<mac>" for what, valid until expiry.
+func (r *Room) sign(what string, expiry time.Time) string {
+	unix := strconv.FormatInt(expiry.Unix(), 10)
+	return unix + "." + r.mac(what+"."+unix)
+}
+
+// verify checks a signature made by sign for what that has not expired.
+func (r *Room) verify(what, signature string) bool {
+	unix, mac, ok := strings.Cut(signature, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(r.mac(what+"."+unix))) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(unix, 10, 64)
+	return err == nil && time.Now().Unix() < expiry
+}
+
+func (r *Room) mac(data string) string {
+	mac := hmac.New(sha256.New, r.access.secret[:])
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *Peers) broadcastHosts(message *websocketMessage) {
+	p.send(message, true)
+}
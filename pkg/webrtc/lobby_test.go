@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdmissionTicket(t *testing.T) {
+	room := NewRoom("room", "stream")
+	other := NewRoom("other", "other-stream")
+	ticket := room.AdmissionTicket("p1")
+	participant, signature, _ := strings.Cut(ticket, ".")
+	expired := participant + "." + room.sign("admission:"+participant, time.Now().Add(-time.Second))
+
+	tests := []struct {
+		name   string
+		ticket string
+		want   bool
+	}{
+		{"valid", ticket, true},
+		{"empty", "", false},
+		{"no signature", "p1", false},
+		{"other participant", "p2." + signature, false},
+		{"forged mac", ticket[:len(ticket)-4] + "0000", false},
+		{"extended expiry", participant + ".9999999999." + strings.SplitN(signature, ".", 2)[1], false},
+		{"expired", expired, false},
+		{"other room", other.AdmissionTicket("p1"), false},
+		{"viewer grant", "p1." + room.ViewerGrant(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := room.CheckAdmission(tt.ticket); got != tt.want {
+				t.Errorf("CheckAdmission(%q) = %v, want %v", tt.ticket, got, tt.want)
+			}
+		})
+	}
+
+	if got, ok := room.AdmittedParticipant(ticket); !ok || got != "p1" {
+		t.Errorf("AdmittedParticipant = %q, %v, want p1", got, ok)
+	}
+	room.revoke("p1")
+	if room.CheckAdmission(ticket) || room.CheckAdmission(room.AdmissionTicket("p1")) {
+		t.Error("a revoked participant is still admitted")
+	}
+	if !room.CheckAdmission(room.AdmissionTicket("p2")) {
+		t.Error("revoking p1 revoked p2")
+	}
+}
+
+func TestViewerGrant(t *testing.T) {
+	room := NewRoom("room", "stream")
+	other := NewRoom("other", "other-stream")
+	grant := room.ViewerGrant()
+
+	tests := []struct {
+		name  string
+		grant string
+		want  bool
+	}{
+		{"valid", grant, true},
+		{"empty", "", false},
+		{"expired", room.sign("viewer:"+room.StreamID, time.Now().Add(-time.Second)), false},
+		{"other room", other.ViewerGrant(), false},
+		{"admission ticket", room.AdmissionTicket("p1"), false},
+		{"admission signature", strings.SplitN(room.AdmissionTicket("p1"), ".", 2)[1], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := room.CheckViewerGrant(tt.grant); got != tt.want {
+				t.Errorf("CheckViewerGrant(%q) = %v, want %v", tt.grant, got, tt.want)
+			}
+		})
+	}
+	path := room.StreamPath()
+	if g, ok := strings.CutPrefix(path, "/stream/stream?viewer="); !ok || !room.CheckViewerGrant(g) {
+		t.Errorf("StreamPath = %q, want the stream with a valid grant", path)
+	}
+}
+
+// testWriter returns a signaling writer whose messages are discarded.
+func testWriter(t *testing.T) *ThreadSafeWriter {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &ThreadSafeWriter{Conn: c}
+}
+
+func TestLobbyWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		lobby  bool
+		ticket func(r *Room) string
+		decide func(r *Room) error
+		want   error
+	}{
+		{name: "lobby off", ticket: func(*Room) string { return "" }},
+		{name: "valid ticket", lobby: true, ticket: func(r *Room) string { return r.AdmissionTicket("p1") }},
+		{name: "admitted", lobby: true, ticket: func(*Room) string { return "" },
+			decide: func(r *Room) error { return r.Admit("p1") }},
+		{name: "denied", lobby: true, ticket: func(*Room) string { return "" },
+			decide: func(r *Room) error { return r.Deny("p1") }, want: ErrDenied},
+		{name: "revoked ticket", lobby: true,
+			ticket: func(r *Room) string { ticket := r.AdmissionTicket("p1"); r.revoke("p1"); return ticket },
+			decide: func(r *Room) error { return r.Deny("p1") }, want: ErrDenied},
+		{name: "viewer grant", lobby: true, ticket: func(r *Room) string { return "p1." + r.ViewerGrant() },
+			decide: func(r *Room) error { return r.Deny("p1") }, want: ErrDenied},
+		{name: "room closed", lobby: true, ticket: func(*Room) string { return "" },
+			decide: func(r *Room) error { r.closeLobby(); return nil }, want: ErrRoomClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := NewRoom("room", "stream")
+			room.lobby.enabled = tt.lobby
+			p := &pendingPeer{PendingInfo: PendingInfo{ID: "p1"}, websocket: testWriter(t)}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- room.wait(p, tt.ticket(room), make(chan *websocketMessage), make(chan error))
+			}()
+			if tt.decide != nil {
+				deadline := time.Now().Add(time.Second)
+				for len(room.Pending()) == 0 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if err := tt.decide(room); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.want) {
+					t.Errorf("wait = %v, want %v", err, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("wait did not return")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package webrtc
+
+import (
+	"pinzoom/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	metrics.Registry.MustRegister(roomsCollector{})
+}
+
+var (
+	roomsDesc = prometheus.NewDesc(
+		"pinzoom_rooms", "Live rooms.", nil, nil)
+	participantsDesc = prometheus.NewDesc(
+		"pinzoom_room_participants", "Participants per room by role.", []string{"room", "role"}, nil)
+	tracksDesc = prometheus.NewDesc(
+		"pinzoom_room_forwarded_tracks", "Tracks forwarded to subscribers per room.", []string{"room"}, nil)
+)
+
+// roomsCollector reads the room registry on every scrape, so the gauges
+// never drift from the actual state.
+type roomsCollector struct{}
+
+func (roomsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsDesc
+	ch <- participantsDesc
+	ch <- tracksDesc
+}
+
+func (roomsCollector) Collect(ch chan<- prometheus.Metric) {
+	RoomsLock.RLock()
+	rooms := make(map[string]*Room, len(Rooms))
+	for id, room := range Rooms {
+		rooms[id] = room
+	}
+	RoomsLock.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(len(rooms)))
+	for id, room := range rooms {
+		room.Peers.ListLock.RLock()
+		publishers, viewers := 0, 0
+		for _, c := range room.Peers.Connections {
+			if c.Viewer {
+				viewers++
+			} else {
+				publishers++
+			}
+		}
+		tracks := len(room.Peers.TrackLocals)
+		room.Peers.ListLock.RUnlock()
+
+		ch <- prometheus.MustNewConstMetric(participantsDesc, prometheus.GaugeValue, float64(publishers), id, "publisher")
+		ch <- prometheus.MustNewConstMetric(participantsDesc, prometheus.GaugeValue, float64(viewers), id, "viewer")
+		ch <- prometheus.MustNewConstMetric(tracksDesc, prometheus.GaugeValue, float64(tracks), id)
+	}
+}
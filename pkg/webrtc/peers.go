@@ -1,17 +1,26 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
-	"log"
 	"pinzoom/pkg/chat"
+	"pinzoom/pkg/logger"
+	"pinzoom/pkg/metrics"
+	"pinzoom/pkg/tracing"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var log = logger.For("webrtc")
+
 var (
 	RoomsLock sync.RWMutex
 	Rooms     map[string]*Room
@@ -38,19 +47,77 @@ var (
 )
 
 type Room struct {
-	Peers *Peers
-	Hub   *chat.Hub
+	ID       string
+	StreamID string
+	Peers    *Peers
+	Hub      *chat.Hub
+	Created  time.Time
+
+	access *access
+	lobby  lobby
+	hosts  hosts
+	audit  audit
+}
+
+// NewRoom creates a room with an empty peer list and a chat hub. The caller
+// registers it and starts the hub.
+func NewRoom(id, streamID string) *Room {
+	room := &Room{
+		ID:       id,
+		StreamID: streamID,
+		Peers: &Peers{
+			TrackLocals: make(map[string]*webrtc.TrackLocalStaticRTP),
+			roomID:      id,
+			log: log.WithFields(logrus.Fields{
+				logger.FieldRoom:   id,
+				logger.FieldStream: streamID,
+			}),
+		},
+		Hub:     chat.NewHub(id),
+		Created: time.Now(),
+		access:  newAccess(),
+	}
+	room.Peers.room = room
+	room.Hub.OnModerate = room.chatModerated
+	return room
+}
+
+// Fields returns the log fields identifying the room and its stream.
+func (r *Room) Fields() logrus.Fields {
+	return logrus.Fields{
+		logger.FieldRoom:   r.ID,
+		logger.FieldStream: r.StreamID,
+	}
 }
 
 type Peers struct {
 	ListLock    sync.RWMutex
 	Connections []PeerConnectionState
 	TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+
+	roomID string
+	room   *Room
+	log    *logrus.Entry
 }
 
 type PeerConnectionState struct {
+	ID             string
 	PeerConnection *webrtc.PeerConnection
 	Websocket      *ThreadSafeWriter
+	Viewer         bool
+	// Identity and Name come from the join token, empty for anonymous
+	// participants.
+	Identity string
+	Name     string
+	// Host participants hold the moderate grant, by join token or host
+	// key, and moderate the call.
+	Host bool
+
+	hostKey string
+	// member is the stable identity a removal bans, see WithIdentity.
+	member string
+	media  *mediaState
+	trace  *peerTrace
 }
 
 type ThreadSafeWriter struct {
@@ -64,6 +131,18 @@ func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	return t.Conn.WriteJSON(v)
 }
 
+// broadcastWait bounds how long a broadcast waits for one participant.
+const broadcastWait = 5 * time.Second
+
+// writeJSONWithin is WriteJSON giving up after timeout.
+func (t *ThreadSafeWriter) writeJSONWithin(v interface{}, timeout time.Duration) error {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	t.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer t.Conn.SetWriteDeadline(time.Time{})
+	return t.Conn.WriteJSON(v)
+}
+
 func (p *Peers) AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
 	p.ListLock.Lock()
 	defer func() {
@@ -72,7 +151,7 @@ func (p *Peers) AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
 	}()
 	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
 	if err != nil {
-		log.Println(err.Error())
+		p.log.Errorf("failed to create local track, err=%v", err)
 		return nil
 	}
 	p.TrackLocals[t.ID()] = trackLocal
@@ -89,16 +168,22 @@ func (p *Peers) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
 }
 
 func (p *Peers) SignalPeerConnections() {
+	_, span := tracing.Tracer.Start(context.Background(), "SignalPeerConnections",
+		trace.WithAttributes(tracing.AttrRoom.String(p.roomID)))
+	defer span.End()
+
 	p.ListLock.Lock()
 	defer func() {
 		p.ListLock.Unlock()
 		p.DispatchKeyFrame()
 	}()
+	syncAttempt := 0
 	attemptSync := func() (tryAgain bool) {
+		metrics.NegotiationAttempts.Inc()
 		for i := range p.Connections {
 			if p.Connections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				p.log.WithField(logger.FieldParticipant, p.Connections[i].ID).Debug("removed closed peer connection")
 				p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
-				log.Println("a", p.Connections)
 				return true
 			}
 			existingSenders := map[string]bool{}
@@ -143,11 +228,17 @@ func (p *Peers) SignalPeerConnections() {
 			}); err != nil {
 				return true
 			}
+			if p.Connections[i].trace != nil {
+				p.Connections[i].trace.offerSent(syncAttempt)
+			}
 		}
 		return
 	}
-	for syncAttempt := 0; ; syncAttempt++ {
+	for ; ; syncAttempt++ {
+		span.SetAttributes(attribute.Int("pinzoom.sync_attempts", syncAttempt+1))
 		if syncAttempt == 25 {
+			metrics.NegotiationFailures.WithLabelValues("gave_up").Inc()
+			span.SetStatus(codes.Error, "gave up, retrying in 3s")
 			go func() {
 				time.Sleep(time.Second * 3)
 				p.SignalPeerConnections()
@@ -157,6 +248,7 @@ func (p *Peers) SignalPeerConnections() {
 		if !attemptSync() {
 			break
 		}
+		metrics.NegotiationFailures.WithLabelValues("retry").Inc()
 	}
 }
 
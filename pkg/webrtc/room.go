@@ -2,21 +2,90 @@ package webrtc
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"pinzoom/pkg/auth"
 	"pinzoom/pkg/hub"
+	"pinzoom/pkg/logger"
+	"pinzoom/pkg/metrics"
 	"sync"
+	"time"
 
-	"github.com/sirupsen/logrus"
-
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
 )
 
 func RoomConn(ctx *hub.Ctx, p *Peers) error {
+	if Draining() {
+		return ErrDraining
+	}
+
+	claims := auth.FromContext(ctx.Request.Context())
+	newPeer := PeerConnectionState{
+		ID: uuid.NewString(),
+		Websocket: &ThreadSafeWriter{
+			Conn:  ctx.WebSocket,
+			Mutex: sync.Mutex{},
+		},
+		Identity: claims.Subject,
+		Name:     claims.Name,
+		Host:     claims.Has(auth.GrantModerate),
+		hostKey:  hostKeyFrom(ctx.Request.Context()),
+		member:   identityFrom(ctx.Request.Context()),
+		media:    &mediaState{},
+	}
+	log := logger.Into("webrtc", ctx.Log).WithFields(logrus.Fields{
+		logger.FieldParticipant: newPeer.ID,
+		logger.FieldIdentity:    newPeer.Identity,
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	messages, readErrs := readMessages(ctx.WebSocket, done)
+
+	// Hosts skip the lobby, everyone else may have to wait for one.
+	if !newPeer.Host {
+		err := p.room.wait(&pendingPeer{
+			PendingInfo: PendingInfo{
+				ID:       newPeer.ID,
+				Identity: newPeer.Identity,
+				Name:     newPeer.Name,
+				Since:    time.Now(),
+			},
+			websocket: newPeer.Websocket,
+		}, ctx.Request.URL.Query().Get("admission"), messages, readErrs)
+		switch {
+		case errors.Is(err, ErrDenied):
+			log.Info("participant denied by host")
+			return newPeer.Websocket.WriteJSON(&websocketMessage{Event: "denied"})
+		case errors.Is(err, ErrRoomClosed):
+			return newPeer.Websocket.WriteJSON(&websocketMessage{Event: "closed"})
+		case err != nil:
+			return err
+		}
+	}
+	if err := newPeer.Websocket.WriteJSON(&websocketMessage{
+		Event: "admitted",
+		Data:  p.room.AdmissionTicket(newPeer.ID),
+	}); err != nil {
+		return err
+	}
+	if p.room.Lobby() {
+		if err := newPeer.Websocket.WriteJSON(&websocketMessage{
+			Event: "stream",
+			Data:  p.room.StreamPath(),
+		}); err != nil {
+			return err
+		}
+	}
+
 	var config webrtc.Configuration
 	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
 		config = turnConfig
 	}
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := newPeerConnection(config)
 	if err != nil {
 		return err
 	}
@@ -30,18 +99,24 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 		}
 	}
 
-	newPeer := PeerConnectionState{
-		PeerConnection: peerConnection,
-		Websocket: &ThreadSafeWriter{
-			Conn:  ctx.WebSocket,
-			Mutex: sync.Mutex{},
-		}}
+	newPeer.PeerConnection = peerConnection
+	newPeer.trace = newPeerTrace(ctx.Request.Context(), p, newPeer.ID)
+	defer newPeer.trace.close()
+	peerConnection.OnICEConnectionStateChange(newPeer.trace.iceStateChanged)
+
+	log.Info("participant joined room")
 
 	// Add our new PeerConnection to global list
 	p.ListLock.Lock()
 	p.Connections = append(p.Connections, newPeer)
 	p.ListLock.Unlock()
 
+	if newPeer.Host {
+		p.room.sendLobby(newPeer.Websocket)
+	}
+	p.room.notifyRoster()
+	defer p.room.notifyRoster()
+
 	// Trickle ICE. Emit server candidate to client
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
@@ -50,7 +125,7 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 
 		candidateString, err := json.Marshal(i.ToJSON())
 		if err != nil {
-			logrus.Errorf("failed to marshal iceCandidate in room, err=%v", err)
+			log.Errorf("failed to marshal iceCandidate in room, err=%v", err)
 			return
 		}
 
@@ -58,7 +133,7 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 			Event: "candidate",
 			Data:  string(candidateString),
 		}); writeErr != nil {
-			logrus.Errorf("failed to write JSON into WS in room, err=%v", writeErr)
+			log.Errorf("failed to write JSON into WS in room, err=%v", writeErr)
 		}
 	})
 
@@ -67,12 +142,12 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 		switch pp {
 		case webrtc.PeerConnectionStateFailed:
 			if err := peerConnection.Close(); err != nil {
-				logrus.Errorf("failed to close room peerConnection, err=%v", err)
+				log.Errorf("failed to close room peerConnection, err=%v", err)
 			}
 		case webrtc.PeerConnectionStateClosed:
 			p.SignalPeerConnections()
 		default:
-			logrus.Error("unhandled default case")
+			log.Debugf("peer connection state changed to %s", pp)
 		}
 	})
 
@@ -83,6 +158,8 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 			return
 		}
 		defer p.RemoveTrack(trackLocal)
+		newPeer.media.streams.Store(t.StreamID(), true)
+		p.room.notifyRoster()
 
 		buf := make([]byte, 1500)
 		for {
@@ -90,20 +167,24 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 			if err != nil {
 				return
 			}
+			// Media a host muted is read but no longer forwarded.
+			if newPeer.media.muted(t.Kind()) {
+				continue
+			}
 
 			if _, err = trackLocal.Write(buf[:i]); err != nil {
+				metrics.RTPDropped.Inc()
 				return
 			}
 		}
 	})
 
 	p.SignalPeerConnections()
-	message := &websocketMessage{}
 	for {
-		_, raw, err := ctx.WebSocket.ReadMessage()
-		if err != nil {
-			return err
-		} else if err := json.Unmarshal(raw, &message); err != nil {
+		var message *websocketMessage
+		select {
+		case message = <-messages:
+		case err := <-readErrs:
 			return err
 		}
 
@@ -123,9 +204,57 @@ func RoomConn(ctx *hub.Ctx, p *Peers) error {
 				return err
 			}
 
-			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+			err := peerConnection.SetRemoteDescription(answer)
+			newPeer.trace.answerReceived(err)
+			if err != nil {
 				return err
 			}
+		case "lock", "lobby", "admit", "deny", "admit-all", "mute", "remove", "end", "promote", "demote", "transfer", "chat":
+			if !p.room.IsHost(newPeer.ID) {
+				log.Warnf("%s requested by a participant who is not a host", message.Event)
+				continue
+			}
+			switch message.Event {
+			case "lock":
+				p.room.SetLocked(message.Data == "true")
+				p.room.Audit(newPeer.ID, "lock", "", message.Data)
+			case "lobby", "admit", "deny", "admit-all":
+				p.room.handleLobbyEvent(newPeer.ID, log, message)
+			default:
+				if err := p.room.handleHostEvent(newPeer.ID, log, message); err != nil {
+					if err := newPeer.Websocket.WriteJSON(&websocketMessage{Event: "failed", Data: err.Error()}); err != nil {
+						return err
+					}
+				}
+			}
 		}
 	}
 }
+
+// readMessages reads signaling messages in the background until the socket
+// fails or done is closed, so the socket of a participant waiting in the
+// lobby is still watched.
+func readMessages(conn *websocket.Conn, done <-chan struct{}) (<-chan *websocketMessage, <-chan error) {
+	messages := make(chan *websocketMessage)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			message := &websocketMessage{}
+			if err := json.Unmarshal(raw, message); err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return messages, errs
+}
@@ -0,0 +1,424 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Stats samples every PeerConnection of every room and keeps a rolling
+// window of samples per participant.
+var Stats = NewStatsCollector(2*time.Second, 15)
+
+// streams holds the per-SSRC counters of every PeerConnection, fed by its
+// stats interceptor.
+var streams = &peerStreams{peers: make(map[*webrtc.PeerConnection]*streamRegistry)}
+
+// Quality scores reported to clients and the admin API.
+const (
+	QualityGood    = "good"
+	QualityFair    = "fair"
+	QualityPoor    = "poor"
+	QualityUnknown = "unknown"
+)
+
+// TrackSample is the state of one RTP stream at sampling time. Inbound
+// streams are received from the participant, outbound ones are forwarded
+// to it.
+type TrackSample struct {
+	SSRC         uint32  `json:"ssrc"`
+	TrackID      string  `json:"trackId"`
+	Kind         string  `json:"kind"`
+	Direction    string  `json:"direction"`
+	Packets      uint64  `json:"packets"`
+	Bytes        uint64  `json:"bytes"`
+	BitrateKbps  float64 `json:"bitrateKbps"`
+	FractionLost float64 `json:"fractionLost"`
+	TotalLost    uint32  `json:"totalLost"`
+	JitterMs     float64 `json:"jitterMs"`
+}
+
+// Sample is one measurement of a participant's connection.
+type Sample struct {
+	Time   time.Time     `json:"time"`
+	RTTMs  float64       `json:"rttMs"`
+	Tracks []TrackSample `json:"tracks"`
+}
+
+// Quality summarizes the sampling window of a participant. Streams lists
+// the media stream IDs the participant publishes, so clients can match
+// the quality to the video they render.
+type Quality struct {
+	Participant string   `json:"participant"`
+	Viewer      bool     `json:"viewer"`
+	Streams     []string `json:"streams"`
+	Score       string   `json:"score"`
+	RTTMs       float64  `json:"rttMs"`
+	LossPercent float64  `json:"lossPercent"`
+	JitterMs    float64  `json:"jitterMs"`
+	BitrateKbps float64  `json:"bitrateKbps"`
+	Samples     []Sample `json:"samples,omitempty"`
+}
+
+type StatsCollector struct {
+	interval time.Duration
+	window   int
+
+	mu    sync.RWMutex
+	peers map[string]*peerWindow
+}
+
+type peerWindow struct {
+	room    string
+	viewer  bool
+	streams []string
+	samples []Sample
+	last    map[uint32]uint64
+}
+
+func NewStatsCollector(interval time.Duration, window int) *StatsCollector {
+	return &StatsCollector{
+		interval: interval,
+		window:   window,
+		peers:    make(map[string]*peerWindow),
+	}
+}
+
+// Run samples all rooms every interval and pushes a quality event to the
+// participants of each room until ctx is cancelled.
+func (c *StatsCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sample()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Room returns the quality of every participant in a room, including the
+// raw samples of the window.
+func (c *StatsCollector) Room(id string) []Quality {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	qualities := []Quality{}
+	for participant, w := range c.peers {
+		if w.room == id {
+			q := w.quality(participant)
+			q.Samples = append([]Sample(nil), w.samples...)
+			qualities = append(qualities, q)
+		}
+	}
+	return qualities
+}
+
+// Rooms returns the quality summary of every participant grouped by room.
+func (c *StatsCollector) Rooms() map[string][]Quality {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	rooms := make(map[string][]Quality)
+	for participant, w := range c.peers {
+		rooms[w.room] = append(rooms[w.room], w.quality(participant))
+	}
+	return rooms
+}
+
+func (c *StatsCollector) sample() {
+	RoomsLock.RLock()
+	rooms := make(map[string]*Room, len(Rooms))
+	for id, room := range Rooms {
+		rooms[id] = room
+	}
+	RoomsLock.RUnlock()
+
+	seen := make(map[string]bool)
+	for id, room := range rooms {
+		room.Peers.ListLock.RLock()
+		connections := append([]PeerConnectionState(nil), room.Peers.Connections...)
+		room.Peers.ListLock.RUnlock()
+
+		summary := make([]Quality, 0, len(connections))
+		for _, conn := range connections {
+			seen[conn.ID] = true
+			summary = append(summary, c.samplePeer(id, conn))
+		}
+		if len(summary) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(summary)
+		if err != nil {
+			room.Peers.log.Errorf("failed to marshal quality, err=%v", err)
+			continue
+		}
+		room.Peers.broadcast(&websocketMessage{Event: "quality", Data: string(data)})
+	}
+
+	c.mu.Lock()
+	for participant := range c.peers {
+		if !seen[participant] {
+			delete(c.peers, participant)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *StatsCollector) samplePeer(room string, conn PeerConnectionState) Quality {
+	now := time.Now()
+	pc := conn.PeerConnection
+	counters := streams.get(pc)
+	sample := Sample{Time: now, RTTMs: candidatePairRTT(pc.GetStats())}
+
+	var streamIDs []string
+	for _, receiver := range pc.GetReceivers() {
+		for _, track := range receiver.Tracks() {
+			if track == nil || track.SSRC() == 0 {
+				continue
+			}
+			sample.Tracks = append(sample.Tracks,
+				counters.sample(uint32(track.SSRC()), track.ID(), track.Kind().String(), "inbound"))
+			streamIDs = appendUnique(streamIDs, track.StreamID())
+		}
+	}
+	for _, sender := range pc.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			sample.Tracks = append(sample.Tracks,
+				counters.sample(uint32(encoding.SSRC), track.ID(), track.Kind().String(), "outbound"))
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w, ok := c.peers[conn.ID]
+	if !ok {
+		w = &peerWindow{room: room, last: make(map[uint32]uint64)}
+		c.peers[conn.ID] = w
+	}
+	w.viewer, w.streams = conn.Viewer, streamIDs
+
+	var previous *Sample
+	if len(w.samples) > 0 {
+		previous = &w.samples[len(w.samples)-1]
+	}
+	for i := range sample.Tracks {
+		t := &sample.Tracks[i]
+		if previous != nil {
+			if elapsed := now.Sub(previous.Time).Seconds(); elapsed > 0 {
+				if before, ok := w.last[t.SSRC]; ok && t.Bytes >= before {
+					t.BitrateKbps = float64(t.Bytes-before) * 8 / 1000 / elapsed
+				}
+			}
+		}
+		w.last[t.SSRC] = t.Bytes
+	}
+
+	w.samples = append(w.samples, sample)
+	if len(w.samples) > c.window {
+		w.samples = w.samples[len(w.samples)-c.window:]
+	}
+	return w.quality(conn.ID)
+}
+
+func (w *peerWindow) quality(participant string) Quality {
+	q := Quality{
+		Participant: participant,
+		Viewer:      w.viewer,
+		Streams:     w.streams,
+		Score:       QualityUnknown,
+	}
+	if len(w.samples) == 0 {
+		return q
+	}
+
+	var rtts, tracks int
+	for _, s := range w.samples {
+		if s.RTTMs > 0 {
+			q.RTTMs += s.RTTMs
+			rtts++
+		}
+		for _, t := range s.Tracks {
+			q.LossPercent += t.FractionLost * 100
+			q.JitterMs += t.JitterMs
+			tracks++
+		}
+	}
+	if rtts > 0 {
+		q.RTTMs /= float64(rtts)
+	}
+	if tracks > 0 {
+		q.LossPercent /= float64(tracks)
+		q.JitterMs /= float64(tracks)
+	}
+	for _, t := range w.samples[len(w.samples)-1].Tracks {
+		q.BitrateKbps += t.BitrateKbps
+	}
+
+	switch {
+	case rtts == 0 && tracks == 0:
+	case q.LossPercent < 2 && q.RTTMs < 200 && q.JitterMs < 30:
+		q.Score = QualityGood
+	case q.LossPercent < 8 && q.RTTMs < 400 && q.JitterMs < 60:
+		q.Score = QualityFair
+	default:
+		q.Score = QualityPoor
+	}
+	return q
+}
+
+// candidatePairRTT returns the current round trip time of the nominated
+// ICE candidate pair in milliseconds.
+func candidatePairRTT(report webrtc.StatsReport) float64 {
+	for _, s := range report {
+		if pair, ok := s.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			return pair.CurrentRoundTripTime * 1000
+		}
+	}
+	return 0
+}
+
+func appendUnique(list []string, v string) []string {
+	for _, s := range list {
+		if s == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
+
+type peerStreams struct {
+	mu    sync.RWMutex
+	peers map[*webrtc.PeerConnection]*streamRegistry
+}
+
+func (p *peerStreams) add(pc *webrtc.PeerConnection, r *streamRegistry) {
+	p.mu.Lock()
+	r.pc = pc
+	p.peers[pc] = r
+	p.mu.Unlock()
+}
+
+func (p *peerStreams) remove(r *streamRegistry) {
+	p.mu.Lock()
+	if r.pc != nil && p.peers[r.pc] == r {
+		delete(p.peers, r.pc)
+	}
+	p.mu.Unlock()
+}
+
+// get returns the counters of pc, or nil for a PeerConnection that is not
+// tracked, which samples as empty.
+func (p *peerStreams) get(pc *webrtc.PeerConnection) *streamRegistry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peers[pc]
+}
+
+// streamRegistry holds the counters of the streams of one PeerConnection.
+type streamRegistry struct {
+	pc *webrtc.PeerConnection
+
+	mu       sync.RWMutex
+	counters map[uint32]*streamCounters
+}
+
+type streamCounters struct {
+	ssrc      uint32
+	clockRate uint32
+	packets   atomic.Uint64
+	bytes     atomic.Uint64
+
+	mu           sync.Mutex
+	fractionLost float64
+	totalLost    uint32
+	jitter       uint32
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{counters: make(map[uint32]*streamCounters)}
+}
+
+func (r *streamRegistry) bind(info *interceptor.StreamInfo) *streamCounters {
+	counters := &streamCounters{ssrc: info.SSRC, clockRate: info.ClockRate}
+	r.mu.Lock()
+	r.counters[info.SSRC] = counters
+	r.mu.Unlock()
+	return counters
+}
+
+func (r *streamRegistry) unbind(info *interceptor.StreamInfo) {
+	r.mu.Lock()
+	delete(r.counters, info.SSRC)
+	r.mu.Unlock()
+}
+
+func (r *streamRegistry) get(ssrc uint32) *streamCounters {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.counters[ssrc]
+}
+
+// receptionReports records the reception report blocks of receiver and
+// sender reports.
+func (r *streamRegistry) receptionReports(pkts []rtcp.Packet) {
+	for _, pkt := range pkts {
+		var reports []rtcp.ReceptionReport
+		switch p := pkt.(type) {
+		case *rtcp.ReceiverReport:
+			reports = p.Reports
+		case *rtcp.SenderReport:
+			reports = p.Reports
+		default:
+			continue
+		}
+		for _, report := range reports {
+			if counters := r.get(report.SSRC); counters != nil {
+				counters.mu.Lock()
+				counters.fractionLost = float64(report.FractionLost) / 256
+				counters.totalLost = report.TotalLost
+				counters.jitter = report.Jitter
+				counters.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (r *streamRegistry) sample(ssrc uint32, trackID, kind, direction string) TrackSample {
+	t := TrackSample{SSRC: ssrc, TrackID: trackID, Kind: kind, Direction: direction}
+	counters := r.get(ssrc)
+	if counters == nil {
+		return t
+	}
+
+	t.Packets, t.Bytes = counters.packets.Load(), counters.bytes.Load()
+	counters.mu.Lock()
+	t.FractionLost, t.TotalLost = counters.fractionLost, counters.totalLost
+	if counters.clockRate > 0 {
+		t.JitterMs = float64(counters.jitter) / float64(counters.clockRate) * 1000
+	}
+	counters.mu.Unlock()
+	return t
+}
+
+func (c *streamCounters) add(n int) {
+	c.packets.Add(1)
+	c.bytes.Add(uint64(n))
+}
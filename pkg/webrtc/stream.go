@@ -2,22 +2,32 @@ package webrtc
 
 import (
 	"encoding/json"
-	"log"
 	"os"
+	"pinzoom/pkg/auth"
+	"pinzoom/pkg/hub"
+	"pinzoom/pkg/logger"
 	"sync"
 
-	"github.com/gorilla/websocket"
+	"github.com/google/uuid"
 	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
 )
 
-func StreamConn(c *websocket.Conn, p *Peers) {
+func StreamConn(ctx *hub.Ctx, p *Peers) {
+	c := ctx.WebSocket
+	log := logger.Into("webrtc", ctx.Log)
+	if Draining() {
+		log.Warn(ErrDraining)
+		c.Close()
+		return
+	}
 	var config webrtc.Configuration
 	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
 		config = turnConfig
 	}
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := newPeerConnection(config)
 	if err != nil {
-		log.Print(err)
+		log.Errorf("failed to create stream peerConnection, err=%v", err)
 		return
 	}
 	defer peerConnection.Close()
@@ -25,41 +35,55 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
 		}); err != nil {
-			log.Print(err)
+			log.Errorf("failed to add stream transceiver, err=%v", err)
 			return
 		}
 	}
+	claims := auth.FromContext(ctx.Request.Context())
 	newPeer := PeerConnectionState{
+		ID:             uuid.NewString(),
 		PeerConnection: peerConnection,
 		Websocket: &ThreadSafeWriter{
 			Conn:  c,
 			Mutex: sync.Mutex{},
-		}}
+		},
+		Viewer:   true,
+		Identity: claims.Subject,
+		Name:     claims.Name,
+	}
+	newPeer.trace = newPeerTrace(ctx.Request.Context(), p, newPeer.ID)
+	defer newPeer.trace.close()
+	peerConnection.OnICEConnectionStateChange(newPeer.trace.iceStateChanged)
+	log = log.WithFields(logrus.Fields{
+		logger.FieldParticipant: newPeer.ID,
+		logger.FieldIdentity:    newPeer.Identity,
+	})
+	log.Info("viewer joined stream")
+
 	p.ListLock.Lock()
 	p.Connections = append(p.Connections, newPeer)
 	p.ListLock.Unlock()
-	log.Println(p.Connections)
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
 			return
 		}
 		candidateString, err := json.Marshal(i.ToJSON())
 		if err != nil {
-			log.Println(err)
+			log.Errorf("failed to marshal iceCandidate in stream, err=%v", err)
 			return
 		}
 		if writeErr := newPeer.Websocket.WriteJSON(&websocketMessage{
 			Event: "candidate",
 			Data:  string(candidateString),
 		}); writeErr != nil {
-			log.Println(writeErr)
+			log.Errorf("failed to write JSON into WS in stream, err=%v", writeErr)
 		}
 	})
 	peerConnection.OnConnectionStateChange(func(pp webrtc.PeerConnectionState) {
 		switch pp {
 		case webrtc.PeerConnectionStateFailed:
 			if err := peerConnection.Close(); err != nil {
-				log.Print(err)
+				log.Errorf("failed to close stream peerConnection, err=%v", err)
 			}
 		case webrtc.PeerConnectionStateClosed:
 			p.SignalPeerConnections()
@@ -70,31 +94,33 @@ func StreamConn(c *websocket.Conn, p *Peers) {
 	for {
 		_, raw, err := c.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			log.Debugf("stream websocket closed, err=%v", err)
 			return
 		} else if err := json.Unmarshal(raw, &message); err != nil {
-			log.Println(err)
+			log.Errorf("failed to unmarshal stream message, err=%v", err)
 			return
 		}
 		switch message.Event {
 		case "candidate":
 			candidate := webrtc.ICECandidateInit{}
 			if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
-				log.Println(err)
+				log.Errorf("failed to unmarshal candidate, err=%v", err)
 				return
 			}
 			if err := peerConnection.AddICECandidate(candidate); err != nil {
-				log.Println(err)
+				log.Errorf("failed to add ICE candidate, err=%v", err)
 				return
 			}
 		case "answer":
 			answer := webrtc.SessionDescription{}
 			if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
-				log.Println(err)
+				log.Errorf("failed to unmarshal answer, err=%v", err)
 				return
 			}
-			if err := peerConnection.SetRemoteDescription(answer); err != nil {
-				log.Println(err)
+			err := peerConnection.SetRemoteDescription(answer)
+			newPeer.trace.answerReceived(err)
+			if err != nil {
+				log.Errorf("failed to set remote description, err=%v", err)
 				return
 			}
 		}
@@ -0,0 +1,100 @@
+package webrtc
+
+import (
+	"context"
+	"sync"
+
+	"pinzoom/pkg/tracing"
+
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// peerTrace holds the spans of one participant: ICE establishment and the
+// offer/answer round trip in flight. Both are children of the websocket
+// session span the participant joined with.
+type peerTrace struct {
+	ctx   context.Context
+	attrs []attribute.KeyValue
+
+	mu    sync.Mutex
+	ice   trace.Span
+	offer trace.Span
+}
+
+func newPeerTrace(ctx context.Context, room *Peers, participant string) *peerTrace {
+	attrs := []attribute.KeyValue{
+		tracing.AttrRoom.String(room.roomID),
+		tracing.AttrParticipant.String(participant),
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+
+	t := &peerTrace{ctx: ctx, attrs: attrs}
+	_, t.ice = tracing.Tracer.Start(ctx, "ice", trace.WithAttributes(attrs...))
+	return t
+}
+
+// iceStateChanged ends the ICE span once the connection is established or
+// has failed.
+func (t *peerTrace) iceStateChanged(state webrtc.ICEConnectionState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ice == nil {
+		return
+	}
+
+	t.ice.AddEvent(state.String())
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		t.ice.SetStatus(codes.Ok, "")
+	case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+		t.ice.SetStatus(codes.Error, state.String())
+	default:
+		return
+	}
+	t.ice.End()
+	t.ice = nil
+}
+
+// offerSent starts a negotiation span that ends when the answer arrives. An
+// offer still waiting for its answer is superseded by the new one.
+func (t *peerTrace) offerSent(attempt int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.offer != nil {
+		t.offer.SetStatus(codes.Error, "superseded by a new offer")
+		t.offer.End()
+	}
+	_, t.offer = tracing.Tracer.Start(t.ctx, "negotiation", trace.WithAttributes(
+		append(t.attrs, attribute.Int("pinzoom.sync_attempt", attempt))...,
+	))
+}
+
+func (t *peerTrace) answerReceived(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.offer == nil {
+		return
+	}
+	if err != nil {
+		t.offer.RecordError(err)
+		t.offer.SetStatus(codes.Error, "failed to apply answer")
+	}
+	t.offer.End()
+	t.offer = nil
+}
+
+// close ends whatever is still open when the participant leaves.
+func (t *peerTrace) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, span := range []trace.Span{t.ice, t.offer} {
+		if span != nil {
+			span.SetStatus(codes.Error, "participant left")
+			span.End()
+		}
+	}
+	t.ice, t.offer = nil, nil
+}
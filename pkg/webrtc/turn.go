@@ -0,0 +1,123 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// TURNCheckInterval is how often MonitorTURN checks the TURN servers.
+const TURNCheckInterval = 30 * time.Second
+
+// errTURNPending is reported until the first background check finished.
+var errTURNPending = errors.New("turn check pending")
+
+// turnStatus caches the result of the latest background TURN check.
+var turnStatus = struct {
+	mu  sync.RWMutex
+	err error
+}{err: errTURNPending}
+
+// MonitorTURN runs CheckTURN at start and then every interval until ctx is
+// cancelled, so readiness probes read a cached result instead of dialing
+// the TURN servers themselves.
+func MonitorTURN(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		err := CheckTURN(checkCtx)
+		cancel()
+		if err != nil {
+			log.Warnf("TURN check failed, err=%v", err)
+		}
+		turnStatus.mu.Lock()
+		turnStatus.err = err
+		turnStatus.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TURNStatus returns the result of the latest check run by MonitorTURN.
+func TURNStatus(context.Context) error {
+	turnStatus.mu.RLock()
+	defer turnStatus.mu.RUnlock()
+	return turnStatus.err
+}
+
+// CheckTURN sends a STUN binding request to every TURN server peers are
+// configured with and fails if one of them does not answer. Outside of
+// production no TURN server is used and the check always passes.
+func CheckTURN(ctx context.Context) error {
+	if os.Getenv("ENVIRONMENT") != "PRODUCTION" {
+		return nil
+	}
+	for _, server := range turnConfig.ICEServers {
+		for _, url := range server.URLs {
+			if !strings.HasPrefix(url, "turn:") {
+				continue
+			}
+			if err := stunBinding(ctx, url); err != nil {
+				return fmt.Errorf("error reaching %s, err=%v", url, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stunBinding performs a single binding transaction with the server of a
+// turn: URL, over the transport the URL asks for.
+func stunBinding(ctx context.Context, url string) error {
+	address, query, _ := strings.Cut(strings.TrimPrefix(url, "turn:"), "?")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "3478")
+	}
+	network := "udp"
+	if query == "transport=tcp" {
+		network = "tcp"
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(2 * time.Second)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err := conn.Write(request.Raw); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	response := &stun.Message{Raw: buf[:n]}
+	if err := response.Decode(); err != nil {
+		return err
+	}
+	if response.TransactionID != request.TransactionID {
+		return fmt.Errorf("unexpected transaction in response")
+	}
+	return nil
+}
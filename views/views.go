@@ -0,0 +1,8 @@
+package views
+
+import "embed"
+
+// FS holds the page templates, layouts and partials compiled into the binary.
+//
+//go:embed *.html layouts partials
+var FS embed.FS